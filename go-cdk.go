@@ -6,18 +6,35 @@ import (
   "github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
   "github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
   "github.com/aws/aws-cdk-go/awscdk/v2/awsapigateway"
+  "github.com/aws/aws-cdk-go/awscdk/v2/awscognito"
+  "github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
+  "github.com/aws/aws-cdk-go/awscdk/v2/awsses"
+  "fmt"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
 )
 
+// matches the IDENTITY_BACKEND values the lambda understands
+const (
+  IDENTITY_BACKEND_LOCAL = "local"
+  IDENTITY_BACKEND_COGNITO = "cognito"
+)
+
 type GoCdkStackProps struct {
 	awscdk.StackProps
+  // IDENTITY_BACKEND_LOCAL (the default) keeps users in userTable and signs our own jwts,
+  // IDENTITY_BACKEND_COGNITO provisions a user pool and puts a cognito authorizer in front of the api
+  IdentityBackend string
 }
 
 func NewGoCdkStack(scope constructs.Construct, id string, props *GoCdkStackProps) awscdk.Stack {
 	var sprops awscdk.StackProps
+  identityBackend := IDENTITY_BACKEND_LOCAL
 	if props != nil {
 		sprops = props.StackProps
+    if props.IdentityBackend != "" {
+      identityBackend = props.IdentityBackend
+    }
 	}
 	stack := awscdk.NewStack(scope, &id, &sprops)
 
@@ -43,7 +60,152 @@ func NewGoCdkStack(scope constructs.Construct, id string, props *GoCdkStackProps
     TableName: jsii.String("blogsTable"),
   })
 
+  // lists blogs sorted by created_at without a scan, "listing" holds the same value on every blog
+  blogTable.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+    IndexName: jsii.String("createdAtIndex"),
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("listing"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+    SortKey: &awsdynamodb.Attribute{
+      Name: jsii.String("created_at"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+  })
+
+
+
+  // a user's blogs, newest first
+  blogTable.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+    IndexName: jsii.String("authorIndex"),
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("author"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+    SortKey: &awsdynamodb.Attribute{
+      Name: jsii.String("created_at"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+  })
+
+  // refresh tokens are stored as sha256 hashes, dynamodb drops them once expires_at has passed
+  refreshTokenTable := awsdynamodb.NewTable(stack, jsii.String("myRefreshTokenTable"), &awsdynamodb.TableProps{
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("token_hash"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+    TimeToLiveAttribute: jsii.String("expires_at"),
+
+    // this table name maps to const in refresh_tokens.go const table name
+    TableName: jsii.String("refreshTokensTable"),
+  })
+
+  // finds every token of a family when reuse is detected
+  refreshTokenTable.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+    IndexName: jsii.String("familyIndex"),
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("family_id"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+  })
+
+  // signs a user out everywhere
+  refreshTokenTable.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+    IndexName: jsii.String("usernameIndex"),
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("username"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+  })
+
+  // revoked access tokens, kept only until the token would have expired anyway
+  revokedTokenTable := awsdynamodb.NewTable(stack, jsii.String("myRevokedTokenTable"), &awsdynamodb.TableProps{
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("id"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+    TimeToLiveAttribute: jsii.String("expires_at"),
+
+    // this table name maps to const in revocations.go const table name
+    TableName: jsii.String("revokedTokensTable"),
+  })
+
+  // failed login counters per username and source ip, forgotten a day after the last failure
+  loginAttemptTable := awsdynamodb.NewTable(stack, jsii.String("myLoginAttemptTable"), &awsdynamodb.TableProps{
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("id"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+    TimeToLiveAttribute: jsii.String("expires_at"),
 
+    // this table name maps to const in login_attempts.go const table name
+    TableName: jsii.String("loginAttemptsTable"),
+  })
+
+  // hashes of the emailed reset tokens, each one is usable once and for an hour
+  passwordResetTable := awsdynamodb.NewTable(stack, jsii.String("myPasswordResetTable"), &awsdynamodb.TableProps{
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("token_hash"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+    TimeToLiveAttribute: jsii.String("expires_at"),
+
+    // this table name maps to const in password_resets.go const table name
+    TableName: jsii.String("passwordResetsTable"),
+  })
+
+  // api keys for machine clients, looked up by the id in the key and stored as a sha256 hash
+  apiKeyTable := awsdynamodb.NewTable(stack, jsii.String("myApiKeyTable"), &awsdynamodb.TableProps{
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("id"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+    TimeToLiveAttribute: jsii.String("expires_at"),
+
+    // this table name maps to const in api_keys.go const table name
+    TableName: jsii.String("apiKeysTable"),
+  })
+
+  // lists a user's keys
+  apiKeyTable.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+    IndexName: jsii.String("usernameIndex"),
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("username"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+  })
+
+  // oidc sign ins that were started and not finished, each one is usable once and for 10 minutes
+  oidcStateTable := awsdynamodb.NewTable(stack, jsii.String("myOidcStateTable"), &awsdynamodb.TableProps{
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("state_hash"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+    TimeToLiveAttribute: jsii.String("expires_at"),
+
+    // this table name maps to const in oidc.go const table name
+    TableName: jsii.String("oidcStateTable"),
+  })
+
+  // external oidc accounts by provider and subject, and the user each one signs in as
+  identityLinkTable := awsdynamodb.NewTable(stack, jsii.String("myIdentityLinkTable"), &awsdynamodb.TableProps{
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("id"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+
+    // this table name maps to const in oidc.go const table name
+    TableName: jsii.String("identityLinksTable"),
+  })
+
+  // removes a user's links when the account is deleted
+  identityLinkTable.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+    IndexName: jsii.String("usernameIndex"),
+    PartitionKey: &awsdynamodb.Attribute{
+      Name: jsii.String("username"),
+      Type: awsdynamodb.AttributeType_STRING,
+    },
+  })
 
 	// The code that defines your stack goes here
 
@@ -56,13 +218,151 @@ func NewGoCdkStack(scope constructs.Construct, id string, props *GoCdkStackProps
     Handler: jsii.String("main"),
   })
   
+  // checks tokens and api keys before api gateway calls myFunction, see lambda/authorizer.
+  // Build it with `make build-authorizer` in lambda/
+  authorizerFunction := awslambda.NewFunction(stack, jsii.String("myAuthorizerFunction"), &awslambda.FunctionProps{
+    Runtime: awslambda.Runtime_PROVIDED_AL2023(),
+    Code: awslambda.AssetCode_FromAsset(jsii.String("lambda/authorizer.zip"), nil),
+    Handler: jsii.String("main"),
+  })
+
+  // myFunction takes the principal the authorizer put in the request context instead of verifying the token again.
+  // Set for every route, routes without the authorizer have no such context and are checked as before
+  myFunction.AddEnvironment(jsii.String("TRUST_AUTHORIZER_CONTEXT"), jsii.String("true"), nil)
+
+  userTable.GrantReadData(authorizerFunction)
+  revokedTokenTable.GrantReadData(authorizerFunction)
+  // records when an api key was last used
+  apiKeyTable.GrantReadWriteData(authorizerFunction)
+
   userTable.GrantReadWriteData(myFunction)
   blogTable.GrantReadWriteData(myFunction)
+  refreshTokenTable.GrantReadWriteData(myFunction)
+  revokedTokenTable.GrantReadWriteData(myFunction)
+  loginAttemptTable.GrantReadWriteData(myFunction)
+  passwordResetTable.GrantReadWriteData(myFunction)
+  apiKeyTable.GrantReadWriteData(myFunction)
+  oidcStateTable.GrantReadWriteData(myFunction)
+  identityLinkTable.GrantReadWriteData(myFunction)
+
+  // reset and verification emails go out through ses from this address, set with `cdk deploy -c sesFromAddress=no-reply@example.com`.
+  // Without it the lambda only logs them
+  sesFromAddress, _ := stack.Node().TryGetContext(jsii.String("sesFromAddress")).(string)
+  if sesFromAddress != "" {
+    senderIdentity := awsses.NewEmailIdentity(stack, jsii.String("mySenderIdentity"), &awsses.EmailIdentityProps{
+      Identity: awsses.Identity_Email(jsii.String(sesFromAddress)),
+    })
+    senderIdentity.GrantSendEmail(myFunction)
+    myFunction.AddEnvironment(jsii.String("SES_FROM_ADDRESS"), jsii.String(sesFromAddress), nil)
+  }
+
+  // frontend page that reads ?token= and posts it to /password/reset
+  passwordResetUrl, _ := stack.Node().TryGetContext(jsii.String("passwordResetUrl")).(string)
+  if passwordResetUrl != "" {
+    myFunction.AddEnvironment(jsii.String("PASSWORD_RESET_URL"), jsii.String(passwordResetUrl), nil)
+  }
+
+  // where the verification link in the registration email points, the api's own
+  // /verify-email works too. Without it the email carries the bare token
+  emailVerificationUrl, _ := stack.Node().TryGetContext(jsii.String("emailVerificationUrl")).(string)
+  if emailVerificationUrl != "" {
+    myFunction.AddEnvironment(jsii.String("EMAIL_VERIFICATION_URL"), jsii.String(emailVerificationUrl), nil)
+  }
+
+  // json object of oidc providers users can sign in with, see OIDC_PROVIDERS in the README.
+  // Set with `cdk deploy -c oidcProviders='{"google": {...}}'`
+  oidcProviders, _ := stack.Node().TryGetContext(jsii.String("oidcProviders")).(string)
+  if oidcProviders != "" {
+    myFunction.AddEnvironment(jsii.String("OIDC_PROVIDERS"), jsii.String(oidcProviders), nil)
+  }
+
+  // jwt signing key set, the lambda reads it at runtime so keys can be rotated without a redeploy.
+  // The generated value is only a placeholder, run lambda/cmd/rotatekeys against the secret after
+  // the first deploy to put the first key in, and again whenever a key should be rotated
+  jwtSecret := awssecretsmanager.NewSecret(stack, jsii.String("jwtSigningSecret"), &awssecretsmanager.SecretProps{
+    Description: jsii.String("RS256/ES256 key set used to sign and verify the api's jwts, written by lambda/cmd/rotatekeys"),
+    GenerateSecretString: &awssecretsmanager.SecretStringGenerator{
+      PasswordLength: jsii.Number(64),
+      ExcludePunctuation: jsii.Bool(true),
+    },
+  })
+  jwtSecret.GrantRead(myFunction, nil)
+  myFunction.AddEnvironment(jsii.String("JWT_SECRET_ARN"), jwtSecret.SecretArn(), nil)
+
+  awscdk.NewCfnOutput(stack, jsii.String("JwtSigningSecretArn"), &awscdk.CfnOutputProps{
+    Value: jwtSecret.SecretArn(),
+  })
+
+  // with cognito, api gateway checks the id token before the lambda runs and the lambda
+  // verifies it again against the pool's jwks, so a direct invoke can't skip the check
+  var protectedMethod *awsapigateway.MethodOptions
+  localIdentity := identityBackend != IDENTITY_BACKEND_COGNITO
+
+  myFunction.AddEnvironment(jsii.String("IDENTITY_BACKEND"), jsii.String(identityBackend), nil)
+  authorizerFunction.AddEnvironment(jsii.String("IDENTITY_BACKEND"), jsii.String(identityBackend), nil)
+
+  if !localIdentity {
+    userPool := awscognito.NewUserPool(stack, jsii.String("myUserPool"), &awscognito.UserPoolProps{
+      SelfSignUpEnabled: jsii.Bool(true),
+      SignInAliases: &awscognito.SignInAliases{
+        Username: jsii.Bool(true),
+        Email: jsii.Bool(true),
+      },
+      AutoVerify: &awscognito.AutoVerifiedAttrs{
+        Email: jsii.Bool(true),
+      },
+      PasswordPolicy: &awscognito.PasswordPolicy{
+        MinLength: jsii.Number(12),
+      },
+      Mfa: awscognito.Mfa_OPTIONAL,
+      MfaSecondFactor: &awscognito.MfaSecondFactor{
+        Otp: jsii.Bool(true),
+        Sms: jsii.Bool(false),
+      },
+      AccountRecovery: awscognito.AccountRecovery_EMAIL_ONLY,
+    })
+
+    // users in a group named after a role (author, editor, admin) get that role
+    for _, role := range []string{"author", "editor", "admin"} {
+      awscognito.NewCfnUserPoolGroup(stack, jsii.String("myUserPoolGroup-" + role), &awscognito.CfnUserPoolGroupProps{
+        UserPoolId: userPool.UserPoolId(),
+        GroupName: jsii.String(role),
+      })
+    }
+
+    userPoolClient := userPool.AddClient(jsii.String("myUserPoolClient"), &awscognito.UserPoolClientOptions{
+      AuthFlows: &awscognito.AuthFlow{
+        UserSrp: jsii.Bool(true),
+        UserPassword: jsii.Bool(true),
+      },
+    })
+
+    authorizer := awsapigateway.NewCognitoUserPoolsAuthorizer(stack, jsii.String("myCognitoAuthorizer"), &awsapigateway.CognitoUserPoolsAuthorizerProps{
+      CognitoUserPools: &[]awscognito.IUserPool{userPool},
+    })
+
+    protectedMethod = &awsapigateway.MethodOptions{
+      AuthorizationType: awsapigateway.AuthorizationType_COGNITO,
+      Authorizer: authorizer,
+    }
+
+    myFunction.AddEnvironment(jsii.String("COGNITO_USER_POOL_ID"), userPool.UserPoolId(), nil)
+    myFunction.AddEnvironment(jsii.String("COGNITO_CLIENT_ID"), userPoolClient.UserPoolClientId(), nil)
+    authorizerFunction.AddEnvironment(jsii.String("COGNITO_USER_POOL_ID"), userPool.UserPoolId(), nil)
+    authorizerFunction.AddEnvironment(jsii.String("COGNITO_CLIENT_ID"), userPoolClient.UserPoolClientId(), nil)
+
+    awscdk.NewCfnOutput(stack, jsii.String("UserPoolId"), &awscdk.CfnOutputProps{
+      Value: userPool.UserPoolId(),
+    })
+    awscdk.NewCfnOutput(stack, jsii.String("UserPoolClientId"), &awscdk.CfnOutputProps{
+      Value: userPoolClient.UserPoolClientId(),
+    })
+  }
 
   api := awsapigateway.NewRestApi(stack, jsii.String("myAPIGateway"), &awsapigateway.RestApiProps{
     DefaultCorsPreflightOptions: &awsapigateway.CorsOptions{
-      AllowHeaders: jsii.Strings("Content-Type", "Authorization"),
-      AllowMethods: jsii.Strings("POST", "GET", "PUT", "DELETE", "OPTIONS"),
+      AllowHeaders: jsii.Strings("Content-Type", "Authorization", "X-API-Key"),
+      AllowMethods: jsii.Strings("POST", "GET", "PUT", "PATCH", "DELETE", "OPTIONS"),
       AllowOrigins: jsii.Strings("*"),
     },
     // need to enable cloudwatch logging for this to work
@@ -73,26 +373,154 @@ func NewGoCdkStack(scope constructs.Construct, id string, props *GoCdkStackProps
 
   integration := awsapigateway.NewLambdaIntegration(myFunction, nil)
 
+  // the authorizer only verifies, so it gets the public keys from the api's jwks instead of the
+  // signing secret. Built from the api id rather than api.Url(), the stage depends on the
+  // authorizer and that would be a cycle. "prod" is the RestApi default stage
+  if localIdentity {
+    jwksUrl := fmt.Sprintf("https://%s.execute-api.%s.amazonaws.com/prod/.well-known/jwks.json", *api.RestApiId(), *stack.Region())
+    authorizerFunction.AddEnvironment(jsii.String("JWT_JWKS_URL"), jsii.String(jwksUrl), nil)
+  }
+
+  // a request authorizer sees both headers, a token authorizer only Authorization and would turn
+  // away api keys sent as X-API-Key. Not cached, with caching api gateway answers 401 itself unless
+  // every identity source is there, and clients send one header or the other
+  requestAuthorizer := awsapigateway.NewRequestAuthorizer(stack, jsii.String("myRequestAuthorizer"), &awsapigateway.RequestAuthorizerProps{
+    Handler: authorizerFunction,
+    IdentitySources: &[]*string{
+      awsapigateway.IdentitySource_Header(jsii.String("Authorization")),
+      awsapigateway.IdentitySource_Header(jsii.String("X-API-Key")),
+    },
+    ResultsCacheTtl: awscdk.Duration_Seconds(jsii.Number(0)),
+  })
+
+  // the routes machine clients call, api keys work as "Authorization: Bearer gck_..." or X-API-Key
+  authorizedMethod := &awsapigateway.MethodOptions{
+    AuthorizationType: awsapigateway.AuthorizationType_CUSTOM,
+    Authorizer: requestAuthorizer,
+  }
+
   //define routes
-  registerResource := api.Root().AddResource(jsii.String("register"), nil)
-  registerResource.AddMethod(jsii.String("POST"), integration, nil)
+  // local accounts only, with cognito these are the user pool's job
+  if localIdentity {
+    registerResource := api.Root().AddResource(jsii.String("register"), nil)
+    registerResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    loginResource := api.Root().AddResource(jsii.String("login"), nil)
+    loginResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    loginMFAResource := loginResource.AddResource(jsii.String("mfa"), nil)
+    loginMFAResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    passwordResource := api.Root().AddResource(jsii.String("password"), nil)
+
+    passwordForgotResource := passwordResource.AddResource(jsii.String("forgot"), nil)
+    passwordForgotResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    passwordResetResource := passwordResource.AddResource(jsii.String("reset"), nil)
+    passwordResetResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    verifyEmailResource := api.Root().AddResource(jsii.String("verify-email"), nil)
+    verifyEmailResource.AddMethod(jsii.String("GET"), integration, nil)
+
+    verifyEmailResendResource := verifyEmailResource.AddResource(jsii.String("resend"), nil)
+    verifyEmailResendResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    tokenResource := api.Root().AddResource(jsii.String("token"), nil)
+    tokenRefreshResource := tokenResource.AddResource(jsii.String("refresh"), nil)
+    tokenRefreshResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    // public keys other services use to verify our access tokens
+    wellKnownResource := api.Root().AddResource(jsii.String(".well-known"), nil)
+    jwksResource := wellKnownResource.AddResource(jsii.String("jwks.json"), nil)
+    jwksResource.AddMethod(jsii.String("GET"), integration, nil)
+
+    // sign in with an external oidc provider
+    oidcResource := api.Root().AddResource(jsii.String("oidc"), nil)
+    oidcProviderResource := oidcResource.AddResource(jsii.String("{provider}"), nil)
+
+    oidcStartResource := oidcProviderResource.AddResource(jsii.String("start"), nil)
+    oidcStartResource.AddMethod(jsii.String("GET"), integration, nil)
+
+    oidcCallbackResource := oidcProviderResource.AddResource(jsii.String("callback"), nil)
+    oidcCallbackResource.AddMethod(jsii.String("GET"), integration, nil)
 
-  loginResource := api.Root().AddResource(jsii.String("login"), nil)
-  loginResource.AddMethod(jsii.String("POST"), integration, nil)
+    // the link_url from POST /me/identities/{provider}, it carries its own single use token
+    oidcLinkResource := oidcProviderResource.AddResource(jsii.String("link"), nil)
+    oidcLinkResource.AddMethod(jsii.String("GET"), integration, nil)
+  }
+
+  logoutResource := api.Root().AddResource(jsii.String("logout"), nil)
+  logoutResource.AddMethod(jsii.String("POST"), integration, protectedMethod)
 
   blogResource := api.Root().AddResource(jsii.String("blog"), nil)
-  blogResource.AddMethod(jsii.String("POST"), integration, nil)
+  blogResource.AddMethod(jsii.String("POST"), integration, authorizedMethod)
 
   blogWithSlugResource := blogResource.AddResource(jsii.String("{slug}"), nil)
   blogWithSlugResource.AddMethod(jsii.String("GET"), integration, nil)
-  blogWithSlugResource.AddMethod(jsii.String("PUT"), integration, nil)
-  blogWithSlugResource.AddMethod(jsii.String("DELETE"), integration, nil)
+  blogWithSlugResource.AddMethod(jsii.String("PUT"), integration, authorizedMethod)
+  blogWithSlugResource.AddMethod(jsii.String("DELETE"), integration, authorizedMethod)
+
+  // admin only, brings back a soft deleted blog
+  blogRestoreResource := blogWithSlugResource.AddResource(jsii.String("restore"), nil)
+  blogRestoreResource.AddMethod(jsii.String("POST"), integration, protectedMethod)
+
+  // admin only, removes the blog for good
+  blogPurgeResource := blogWithSlugResource.AddResource(jsii.String("purge"), nil)
+  blogPurgeResource.AddMethod(jsii.String("DELETE"), integration, protectedMethod)
 
   blogsResource := api.Root().AddResource(jsii.String("blogs"), nil)
   blogsResource.AddMethod(jsii.String("GET"), integration, nil)
 
+  usersResource := api.Root().AddResource(jsii.String("users"), nil)
+  userWithUsernameResource := usersResource.AddResource(jsii.String("{username}"), nil)
+
+  userBlogsResource := userWithUsernameResource.AddResource(jsii.String("blogs"), nil)
+  userBlogsResource.AddMethod(jsii.String("GET"), integration, nil)
+
+  // admin only, revokes every session of the user
+  userSessionsResource := userWithUsernameResource.AddResource(jsii.String("sessions"), nil)
+  userSessionsResource.AddMethod(jsii.String("DELETE"), integration, protectedMethod)
+
+  if localIdentity {
+    userWithUsernameResource.AddMethod(jsii.String("GET"), integration, nil)
+
+    // admin only, replaces the user's roles
+    userRolesResource := userWithUsernameResource.AddResource(jsii.String("roles"), nil)
+    userRolesResource.AddMethod(jsii.String("PUT"), integration, nil)
+
+    // admin only, lifts a login lockout
+    userUnlockResource := userWithUsernameResource.AddResource(jsii.String("unlock"), nil)
+    userUnlockResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    meResource := api.Root().AddResource(jsii.String("me"), nil)
+    meResource.AddMethod(jsii.String("GET"), integration, nil)
+    meResource.AddMethod(jsii.String("PATCH"), integration, nil)
+    meResource.AddMethod(jsii.String("DELETE"), integration, nil)
+
+    mePasswordResource := meResource.AddResource(jsii.String("password"), nil)
+    mePasswordResource.AddMethod(jsii.String("PUT"), integration, nil)
+
+    meAPIKeysResource := meResource.AddResource(jsii.String("api-keys"), nil)
+    meAPIKeysResource.AddMethod(jsii.String("POST"), integration, nil)
+    meAPIKeysResource.AddMethod(jsii.String("GET"), integration, nil)
+
+    meAPIKeyWithIdResource := meAPIKeysResource.AddResource(jsii.String("{id}"), nil)
+    meAPIKeyWithIdResource.AddMethod(jsii.String("DELETE"), integration, nil)
+
+    // links an oidc provider account to the signed in user
+    meIdentitiesResource := meResource.AddResource(jsii.String("identities"), nil)
+    meIdentityWithProviderResource := meIdentitiesResource.AddResource(jsii.String("{provider}"), nil)
+    meIdentityWithProviderResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    meMFAResource := meResource.AddResource(jsii.String("mfa"), nil)
+    meMFAResource.AddMethod(jsii.String("POST"), integration, nil)
+
+    meMFAVerifyResource := meMFAResource.AddResource(jsii.String("verify"), nil)
+    meMFAVerifyResource.AddMethod(jsii.String("POST"), integration, nil)
+  }
+
   protectedResource := api.Root().AddResource(jsii.String("protected"), nil)
-  protectedResource.AddMethod(jsii.String("GET"), integration, nil)
+  protectedResource.AddMethod(jsii.String("GET"), integration, authorizedMethod)
 
 	// example resource
 	// queue := awssqs.NewQueue(stack, jsii.String("GoCdkQueue"), &awssqs.QueueProps{
@@ -107,10 +535,14 @@ func main() {
 
 	app := awscdk.NewApp(nil)
 
+  // `cdk deploy -c identityBackend=cognito` switches sign in over to a cognito user pool
+  identityBackend, _ := app.Node().TryGetContext(jsii.String("identityBackend")).(string)
+
 	NewGoCdkStack(app, "GoCdkStack", &GoCdkStackProps{
-		awscdk.StackProps{
+		StackProps: awscdk.StackProps{
 			Env: env(),
 		},
+		IdentityBackend: identityBackend,
 	})
 
 	app.Synth(nil)
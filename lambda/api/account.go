@@ -0,0 +1,305 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"lambda-func/database"
+	"lambda-func/hasher"
+	"lambda-func/middleware"
+	"lambda-func/policy"
+	"lambda-func/types"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// what happens to the blogs of a deleted account
+const (
+  BLOGS_ANONYMIZE = "anonymize"
+  BLOGS_REASSIGN = "reassign"
+)
+
+// user accounts and their public profiles
+type AccountHandler struct {
+  userStore database.UserStore
+  blogStore database.BlogStore
+  identityLinkStore database.IdentityLinkStore
+  loginAttemptStore database.LoginAttemptStore
+  tokenHandler TokenHandler
+  passwordHasher hasher.PasswordHasher
+}
+
+func NewAccountHandler(userStore database.UserStore, blogStore database.BlogStore, identityLinkStore database.IdentityLinkStore, loginAttemptStore database.LoginAttemptStore, tokenHandler TokenHandler, passwordHasher hasher.PasswordHasher) AccountHandler {
+  return AccountHandler{
+    userStore: userStore,
+    blogStore: blogStore,
+    identityLinkStore: identityLinkStore,
+    loginAttemptStore: loginAttemptStore,
+    tokenHandler: tokenHandler,
+    passwordHasher: passwordHasher,
+  }
+}
+
+// the signed in user's own account, the only place their email and roles are shown
+func (api AccountHandler) GetAccountHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  user, err := api.userStore.GetUser(principal.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return jsonResponse(user.Account(), http.StatusOK)
+}
+
+// partial update of the profile, only the fields present in the body change
+func (api AccountHandler) UpdateAccountHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  var update types.UpdateProfile
+
+  err := json.Unmarshal([]byte(request.Body), &update)
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  if update.DisplayName == nil && update.Bio == nil && update.AvatarURL == nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request - nothing to update",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  violations := policy.ValidateProfile(update)
+  if len(violations) > 0 {
+    return violationsResponse(violations)
+  }
+
+  user, err := api.userStore.UpdateProfile(principal.Username, update)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return jsonResponse(user.Account(), http.StatusOK)
+}
+
+// public, anyone can look up a profile
+func (api AccountHandler) GetProfileHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  username := policy.NormalizeUsername(request.PathParameters["username"])
+
+  if username == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  user, err := api.userStore.GetUser(username)
+
+  if errors.Is(err, database.ErrUserNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "User not found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return jsonResponse(user.Profile(), http.StatusOK)
+}
+
+// removes the account after checking the password again. Blogs are kept, either credited to
+// "deleted-user" (the default) or handed to another author with {"blogs":"reassign","reassign-to":"bob"}
+func (api AccountHandler) DeleteAccountHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  type DeleteRequest struct {
+    Password string `json:"password"`
+    Blogs string `json:"blogs"`
+    ReassignTo string `json:"reassign-to"`
+  }
+
+  var deleteRequest DeleteRequest
+
+  err := json.Unmarshal([]byte(request.Body), &deleteRequest)
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  user, err := api.userStore.GetUser(principal.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if user.PasswordHash == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Set a password with PUT /me/password before deleting the account",
+      StatusCode: http.StatusForbidden,
+    }, nil
+  }
+
+  if deleteRequest.Password == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  response, err := checkCurrentPassword(api.loginAttemptStore, api.passwordHasher, user, deleteRequest.Password, "Password is incorrect")
+  if response != nil {
+    return *response, err
+  }
+
+  newAuthor := types.DELETED_USER
+
+  switch deleteRequest.Blogs {
+    case "", BLOGS_ANONYMIZE:
+    case BLOGS_REASSIGN:
+      newAuthor = policy.NormalizeUsername(deleteRequest.ReassignTo)
+
+      response, err := api.checkReassignTarget(user.Username, newAuthor)
+      if response != nil {
+        return *response, err
+      }
+    default:
+      return events.APIGatewayProxyResponse{
+        Body: "blogs must be anonymize or reassign",
+        StatusCode: http.StatusBadRequest,
+      }, nil
+  }
+
+  // blogs first, a failure part way leaves the account in place so the request can be retried
+  err = api.blogStore.ReassignBlogs(user.Username, newAuthor)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // a later account with the same username must not inherit the api keys or linked oidc accounts,
+  // revoking the sessions deletes the keys
+  err = api.tokenHandler.revokeSessions(user.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.identityLinkStore.DeleteUserIdentityLinks(user.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.userStore.DeleteUser(user.Username)
+  if err != nil && !errors.Is(err, database.ErrUserNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: "Account deleted",
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// body takes a Profile or Account, never a User
+func jsonResponse[T types.Profile | types.Account](body T, statusCode int) (events.APIGatewayProxyResponse, error) {
+  responseBody, err := json.Marshal(body)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    StatusCode: statusCode,
+    Headers: map[string]string{
+      "Content-Type": "application/json",
+    },
+    Body: string(responseBody),
+  }, nil
+}
+
+// blogs can only go to another existing account that is allowed to write them
+func (api AccountHandler) checkReassignTarget(username string, target string) (*events.APIGatewayProxyResponse, error) {
+  if target == "" || target == username {
+    return &events.APIGatewayProxyResponse{
+      Body: "reassign-to must name another user",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  targetUser, err := api.userStore.GetUser(target)
+
+  if errors.Is(err, database.ErrUserNotFound) {
+    return &events.APIGatewayProxyResponse{
+      Body: "reassign-to user not found",
+      StatusCode: http.StatusUnprocessableEntity,
+    }, nil
+  }
+
+  if err != nil {
+    return &events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  targetPrincipal := types.Principal{Username: targetUser.Username, Roles: targetUser.UserRoles()}
+  if !targetPrincipal.HasRole(types.RoleAuthor) {
+    return &events.APIGatewayProxyResponse{
+      Body: "reassign-to user is not an author",
+      StatusCode: http.StatusUnprocessableEntity,
+    }, nil
+  }
+
+  return nil, nil
+}
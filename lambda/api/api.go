@@ -2,25 +2,41 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"lambda-func/database"
+	"lambda-func/hasher"
+	"lambda-func/middleware"
+	"lambda-func/policy"
 	"lambda-func/types"
 	"net/http"
 	"github.com/aws/aws-lambda-go/events"
   "fmt"
+  "strconv"
   "time"
 )
 
 type UserHandler struct {
   userStore database.UserStore
+  loginAttemptStore database.LoginAttemptStore
+  tokenIssuer TokenIssuer
+  passwordPolicy policy.PasswordPolicy
+  passwordHasher hasher.PasswordHasher
+  emailVerificationHandler EmailVerificationHandler
 }
 
 type BlogHandler struct {
   blogStore database.BlogStore
 }
 
-func NewUserHandler(userStore database.UserStore) UserHandler {
+func NewUserHandler(userStore database.UserStore, loginAttemptStore database.LoginAttemptStore, tokenIssuer TokenIssuer, passwordPolicy policy.PasswordPolicy, passwordHasher hasher.PasswordHasher, emailVerificationHandler EmailVerificationHandler) UserHandler {
   return UserHandler {
     userStore:  userStore,
+    loginAttemptStore: loginAttemptStore,
+    tokenIssuer: tokenIssuer,
+    passwordPolicy: passwordPolicy,
+    passwordHasher: passwordHasher,
+    emailVerificationHandler: emailVerificationHandler,
   }
 }
 
@@ -42,6 +58,13 @@ func (api BlogHandler) GetBlogHandler(request events.APIGatewayProxyRequest) (ev
 
   blog, err := api.blogStore.GetBlog(slug)
 
+  if errors.Is(err, database.ErrBlogNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "Blog not found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
   if err != nil {
     return events.APIGatewayProxyResponse{
       Body: "Internal Server Error",
@@ -49,8 +72,6 @@ func (api BlogHandler) GetBlogHandler(request events.APIGatewayProxyRequest) (ev
     }, err
   }
 
-  // @TODO handle not found response
-
   responseBody, err := json.Marshal(blog)
 
   return events.APIGatewayProxyResponse{
@@ -59,8 +80,46 @@ func (api BlogHandler) GetBlogHandler(request events.APIGatewayProxyRequest) (ev
   }, nil
 }
 
+const (
+  DEFAULT_PAGE_SIZE=20
+  MAX_PAGE_SIZE=100
+)
+
 func (api BlogHandler) GetAllBlogsHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-  blogs, err := api.blogStore.GetAllBlogs()
+  limit, ok := parseLimit(request.QueryStringParameters["limit"])
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: fmt.Sprintf("Invalid Request - limit must be between 1 and %d", MAX_PAGE_SIZE),
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  cursor := request.QueryStringParameters["cursor"]
+
+  var page types.BlogPage
+  var err error
+
+  // without an order blogs come back in table order
+  switch request.QueryStringParameters["order"] {
+    case "":
+      page, err = api.blogStore.GetAllBlogs(limit, cursor)
+    case "newest":
+      page, err = api.blogStore.ListBlogsByCreatedAt(true, limit, cursor)
+    case "oldest":
+      page, err = api.blogStore.ListBlogsByCreatedAt(false, limit, cursor)
+    default:
+      return events.APIGatewayProxyResponse{
+        Body: "Invalid Request - order must be newest or oldest",
+        StatusCode: http.StatusBadRequest,
+      }, nil
+  }
+
+  if errors.Is(err, database.ErrInvalidCursor) {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request - bad cursor",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
 
   if err != nil {
     return events.APIGatewayProxyResponse{
@@ -69,14 +128,7 @@ func (api BlogHandler) GetAllBlogsHandler(request events.APIGatewayProxyRequest)
     }, err
   }
 
-  if len(blogs) == 0 {
-    return events.APIGatewayProxyResponse{
-      StatusCode: http.StatusOK,
-      Body:       `[]`,
-    }, nil
-  }
-
-  responseBody, err := json.Marshal(blogs)
+  responseBody, err := json.Marshal(page)
   if err != nil {
     return events.APIGatewayProxyResponse{
       StatusCode: http.StatusInternalServerError,
@@ -90,6 +142,19 @@ func (api BlogHandler) GetAllBlogsHandler(request events.APIGatewayProxyRequest)
   }, nil
 }
 
+func parseLimit(value string) (int64, bool) {
+  if value == "" {
+    return DEFAULT_PAGE_SIZE, true
+  }
+
+  limit, err := strconv.ParseInt(value, 10, 64)
+  if err != nil || limit < 1 || limit > MAX_PAGE_SIZE {
+    return 0, false
+  }
+
+  return limit, true
+}
+
 func (api BlogHandler) CreateBlogHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
   var newBlog types.Blog
 
@@ -109,14 +174,30 @@ func (api BlogHandler) CreateBlogHandler(request events.APIGatewayProxyRequest)
     }, err
   }
 
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
   newBlog.Slug = types.Slugify(newBlog.Title)
+  newBlog.Author = principal.Username
 
-  date := time.Now()
-  newBlog.CreatedAt = date.Format("Jan 2, 2009")
+  // ISO-8601 in UTC so created_at sorts correctly in the createdAtIndex
+  newBlog.CreatedAt = time.Now().UTC().Format(time.RFC3339)
 
 
   err = api.blogStore.InsertBlog(newBlog)
 
+  if errors.Is(err, database.ErrBlogExists) {
+    return events.APIGatewayProxyResponse{
+      Body: "A blog with this title already exists",
+      StatusCode: http.StatusConflict,
+    }, nil
+  }
+
   if err != nil {
     return events.APIGatewayProxyResponse{
       Body: "Internal Server Error",
@@ -130,27 +211,179 @@ func (api BlogHandler) CreateBlogHandler(request events.APIGatewayProxyRequest)
   }, nil
 }
 
-func (api UserHandler) RegisterUserHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-  var registerUser types.RegisterUser
+func (api BlogHandler) UpdateBlogHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  slug := request.PathParameters["slug"]
 
-  //map json to type
-  err := json.Unmarshal([]byte(request.Body), &registerUser)
+  if slug == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  response, err := api.authorizeBlogWrite(request, slug)
+  if response != nil {
+    return *response, err
+  }
+
+  var update types.UpdateBlog
+
+  err = json.Unmarshal([]byte(request.Body), &update)
 
   if err != nil {
     return events.APIGatewayProxyResponse{
       Body: "Invalid Request",
       StatusCode: http.StatusBadRequest,
-    }, err
+    }, nil
+  }
+
+  if update.Title == nil && update.Description == nil && update.Content == nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request - nothing to update",
+      StatusCode: http.StatusBadRequest,
+    }, nil
   }
 
-  if registerUser.Username == "" || registerUser.Password == "" {
+  // same rule as create, a blog can't end up with an empty field
+  if (update.Title != nil && *update.Title == "") || (update.Description != nil && *update.Description == "") || (update.Content != nil && *update.Content == "") {
     return events.APIGatewayProxyResponse{
       Body: "Invalid Request - fields empty",
       StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  updatedAt := time.Now().UTC().Format(time.RFC3339)
+
+  blog, err := api.blogStore.UpdateBlog(slug, update, updatedAt)
+
+  if errors.Is(err, database.ErrBlogNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "Blog not found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  responseBody, err := json.Marshal(blog)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    StatusCode: http.StatusOK,
+    Body:       string(responseBody),
+  }, nil
+}
+
+// soft delete, the blog can be brought back with RestoreBlogHandler until it is purged
+func (api BlogHandler) DeleteBlogHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  slug := request.PathParameters["slug"]
+
+  if slug == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  response, err := api.authorizeBlogWrite(request, slug)
+  if response != nil {
+    return *response, err
+  }
+
+  deletedAt := time.Now().UTC().Format(time.RFC3339)
+
+  err = api.blogStore.DeleteBlog(slug, deletedAt)
+
+  if errors.Is(err, database.ErrBlogNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "Blog not found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: "Successfully Deleted Blog",
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+func (api BlogHandler) RestoreBlogHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  slug := request.PathParameters["slug"]
+
+  if slug == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  blog, err := api.blogStore.RestoreBlog(slug)
+
+  if errors.Is(err, database.ErrBlogNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "Deleted blog not found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
     }, err
   }
 
-  userExists, err := api.userStore.DoesUserExist(registerUser.Username) 
+  responseBody, err := json.Marshal(blog)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    StatusCode: http.StatusOK,
+    Body:       string(responseBody),
+  }, nil
+}
+
+// permanently removes the blog, this can't be undone
+func (api BlogHandler) PurgeBlogHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  slug := request.PathParameters["slug"]
+
+  if slug == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  err := api.blogStore.PurgeBlog(slug)
+
+  if errors.Is(err, database.ErrBlogNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "Blog not found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
   if err != nil {
     return events.APIGatewayProxyResponse{
       Body: "Internal Server Error",
@@ -158,32 +391,205 @@ func (api UserHandler) RegisterUserHandler(request events.APIGatewayProxyRequest
     }, err
   }
 
-  if userExists {
+  return events.APIGatewayProxyResponse{
+    Body: "Successfully Purged Blog",
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// only the blog's author or an editor may change it, returns a response when the caller may not
+func (api BlogHandler) authorizeBlogWrite(request events.APIGatewayProxyRequest, slug string) (*events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return &events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  blog, err := api.blogStore.GetBlog(slug)
+
+  if errors.Is(err, database.ErrBlogNotFound) {
+    return &events.APIGatewayProxyResponse{
+      Body: "Blog not found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  if err != nil {
+    return &events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // blogs written before authorship was recorded have no author, only editors can touch them
+  if (blog.Author == "" || blog.Author != principal.Username) && !principal.HasRole(types.RoleEditor) {
+    return &events.APIGatewayProxyResponse{
+      Body: "Forbidden",
+      StatusCode: http.StatusForbidden,
+    }, nil
+  }
+
+  return nil, nil
+}
+
+func (api BlogHandler) GetUserBlogsHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  username := request.PathParameters["username"]
+
+  if username == "" {
     return events.APIGatewayProxyResponse{
-      Body: "User already exists",
-      StatusCode: http.StatusConflict,
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  limit, ok := parseLimit(request.QueryStringParameters["limit"])
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: fmt.Sprintf("Invalid Request - limit must be between 1 and %d", MAX_PAGE_SIZE),
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  page, err := api.blogStore.ListBlogsByAuthor(username, limit, request.QueryStringParameters["cursor"])
+
+  if errors.Is(err, database.ErrInvalidCursor) {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request - bad cursor",
+      StatusCode: http.StatusBadRequest,
     }, nil
   }
 
-  user, err := types.NewUser(registerUser)
   if err != nil {
     return events.APIGatewayProxyResponse{
       Body: "Internal Server Error",
       StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  responseBody, err := json.Marshal(page)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
     }, nil
   }
 
-  err = api.userStore.InsertUser(user)
+  return events.APIGatewayProxyResponse{
+    StatusCode: http.StatusOK,
+    Body:       string(responseBody),
+  }, nil
+}
+
+func (api UserHandler) RegisterUserHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  var registerUser types.RegisterUser
+
+  //map json to type
+  err := json.Unmarshal([]byte(request.Body), &registerUser)
+
   if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  registerUser.Username = policy.NormalizeUsername(registerUser.Username)
+  registerUser.Email = policy.NormalizeEmail(registerUser.Email)
+
+  violations := policy.ValidateUsername(registerUser.Username)
+  violations = append(violations, api.passwordPolicy.Validate(registerUser.Username, registerUser.Password)...)
+  violations = append(violations, policy.ValidateEmail(registerUser.Email)...)
+
+  if len(violations) > 0 {
+    return violationsResponse(violations)
+  }
+
+  // a name held by an account whose first verification link expired unused can be taken again,
+  // otherwise anyone could hold any name by registering it with an address they don't own.
+  // Counted from created_at, resends would let the squatter keep it alive
+  pendingCreatedBefore := time.Now().Add(-types.EMAIL_VERIFICATION_TOKEN_TTL)
+  reclaim := false
+
+  existingUser, err := api.userStore.GetUser(registerUser.Username)
+  if err != nil && !errors.Is(err, database.ErrUserNotFound) {
     return events.APIGatewayProxyResponse{
       Body: "Internal Server Error",
       StatusCode: http.StatusInternalServerError,
     }, err
   }
 
+  if err == nil {
+    createdAt, parseErr := time.Parse(time.RFC3339, existingUser.CreatedAt)
+    reclaim = existingUser.IsPendingVerification() && parseErr == nil && createdAt.Before(pendingCreatedBefore)
+
+    if !reclaim {
+      return events.APIGatewayProxyResponse{
+        Body: "User already exists",
+        StatusCode: http.StatusConflict,
+      }, nil
+    }
+  }
+
+  user, err := types.NewUser(registerUser, api.passwordHasher)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if reclaim {
+    err = api.userStore.ReclaimPendingUser(user, pendingCreatedBefore)
+  } else {
+    err = api.userStore.InsertUser(user)
+  }
+
+  // someone registered the same name since GetUser
+  if errors.Is(err, database.ErrUserExists) {
+    return events.APIGatewayProxyResponse{
+      Body: "User already exists",
+      StatusCode: http.StatusConflict,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // the account exists either way, a failed send is only logged and the user can ask for a resend
+  err = api.emailVerificationHandler.sendVerification(user)
+
   return events.APIGatewayProxyResponse{
-    Body: "Successfully Registered",
+    Body: "Successfully Registered, check your email to verify your address before logging in",
     StatusCode: http.StatusOK,
+  }, err
+}
+
+// 422 with every rule that failed, so the client can show them all at once
+func violationsResponse(violations []policy.Violation) (events.APIGatewayProxyResponse, error) {
+  type ViolationsResponse struct {
+    Errors []policy.Violation `json:"errors"`
+  }
+
+  responseBody, err := json.Marshal(ViolationsResponse{Errors: violations})
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    StatusCode: http.StatusUnprocessableEntity,
+    Headers: map[string]string{
+      "Content-Type": "application/json",
+    },
+    Body: string(responseBody),
   }, nil
 }
 
@@ -204,8 +610,10 @@ func (api UserHandler) LoginUser(request events.APIGatewayProxyRequest) (events.
     }, err
   }
 
-  user, err := api.userStore.GetUser(loginRequest.Username)
+  username := policy.NormalizeUsername(loginRequest.Username)
+  attemptKeys := loginAttemptKeys(username, request.RequestContext.Identity.SourceIP)
 
+  lockedUntil, err := lockedUntil(api.loginAttemptStore, attemptKeys)
   if err != nil {
     return events.APIGatewayProxyResponse{
       Body: "Internal Server Error",
@@ -213,18 +621,219 @@ func (api UserHandler) LoginUser(request events.APIGatewayProxyRequest) (events.
     }, err
   }
 
-  if !types.ValidatePassword(user.PasswordHash, loginRequest.Password) {
+  // the password isn't even checked while locked, so guesses during the lock are worthless
+  if !lockedUntil.IsZero() {
+    return events.APIGatewayProxyResponse{
+      Body: "Too many failed login attempts, try again later",
+      StatusCode: http.StatusTooManyRequests,
+      Headers: map[string]string{
+        "Retry-After": retryAfterSeconds(lockedUntil),
+      },
+    }, nil
+  }
+
+  user, err := api.userStore.GetUser(username)
+
+  // accounts created before usernames were normalized may still have upper case letters
+  if errors.Is(err, database.ErrUserNotFound) && username != loginRequest.Username {
+    user, err = api.userStore.GetUser(loginRequest.Username)
+  }
+
+  if err != nil && !errors.Is(err, database.ErrUserNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // unknown users still pay for a hash comparison and get the same answer as a wrong password,
+  // so neither the status nor the timing tells which usernames exist
+  passwordHash := user.PasswordHash
+  if errors.Is(err, database.ErrUserNotFound) {
+    passwordHash = api.passwordHasher.DummyHash()
+  }
+
+  if !passwordMatches(api.passwordHasher, passwordHash, loginRequest.Password) || errors.Is(err, database.ErrUserNotFound) {
+    err = recordFailedLogin(api.loginAttemptStore, attemptKeys)
+    if err != nil {
+      return events.APIGatewayProxyResponse{
+        Body: "Internal Server Error",
+        StatusCode: http.StatusInternalServerError,
+      }, err
+    }
+
     return events.APIGatewayProxyResponse{
       Body: "Invalid Credentials",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  // only said once the password is right, so it doesn't tell anyone else the username exists
+  if user.IsPendingVerification() {
+    return events.APIGatewayProxyResponse{
+      Body: "Email address not verified",
+      StatusCode: http.StatusForbidden,
+    }, nil
+  }
+
+  // only the username counter, clearing the ip one would let one good account reset it
+  err = api.loginAttemptStore.ResetLoginAttempts(userLoginAttemptID(username))
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // the plain password is only around at login, so this is the one chance to move an old hash
+  // to the current algorithm and cost. Failing to do so must not fail the login
+  if api.passwordHasher.NeedsRehash(user.PasswordHash) {
+    api.rehashPassword(user, loginRequest.Password)
+  }
+
+  if user.MFAEnabled {
+    return api.mfaChallengeResponse(user)
+  }
+
+  return api.tokenResponse(user)
+}
+
+// admin only, replaces the user's roles. Tokens already issued keep the old roles until they expire
+func (api UserHandler) SetUserRolesHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  username := request.PathParameters["username"]
+
+  if username == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  type RolesRequest struct {
+    Roles []string `json:"roles"`
+  }
+
+  var rolesRequest RolesRequest
+
+  err := json.Unmarshal([]byte(request.Body), &rolesRequest)
+
+  if err != nil || len(rolesRequest.Roles) == 0 {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
       StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  roles := []string{}
+  seen := map[string]bool{}
+
+  for _, role := range rolesRequest.Roles {
+    if !types.IsValidRole(role) {
+      return events.APIGatewayProxyResponse{
+        Body: fmt.Sprintf("Invalid Request - unknown role %q", role),
+        StatusCode: http.StatusBadRequest,
+      }, nil
+    }
+
+    if !seen[role] {
+      seen[role] = true
+      roles = append(roles, role)
+    }
+  }
+
+  err = api.userStore.UpdateUserRoles(username, roles)
+
+  if errors.Is(err, database.ErrUserNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "User not found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
     }, err
   }
 
-  accessToken := types.CreateToken(user)
-  successMsg := fmt.Sprintf(`{"access-token": "%s"}`, accessToken)
+  return events.APIGatewayProxyResponse{
+    Body: "Successfully Updated Roles",
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+func (api UserHandler) rehashPassword(user types.User, password string) {
+  passwordHash, err := api.passwordHasher.Hash(password)
+  if err != nil {
+    log.Printf("failed to rehash password of %s: %v", user.Username, err)
+    return
+  }
+
+  err = api.userStore.RehashPassword(user.Username, user.PasswordHash, passwordHash)
+  if err != nil {
+    log.Printf("failed to store rehashed password of %s: %v", user.Username, err)
+  }
+}
+
+// a stored hash that can't be parsed never matches, the error is only worth a log line
+func passwordMatches(passwordHasher hasher.PasswordHasher, encoded string, password string) bool {
+  ok, err := passwordHasher.Verify(encoded, password)
+  if err != nil {
+    log.Printf("failed to verify password: %v", err)
+  }
+
+  return ok
+}
+
+// the password was right, the client still has to send a code to /login/mfa with this token
+func (api UserHandler) mfaChallengeResponse(user types.User) (events.APIGatewayProxyResponse, error) {
+  mfaToken, err := types.CreateMFAToken(user, api.tokenIssuer.keyProvider, api.tokenIssuer.tokenConfig)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  responseBody, err := json.Marshal(types.MFAChallengeResponse{
+    MFARequired: true,
+    MFAToken: mfaToken,
+  })
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: string(responseBody),
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// admin only, clears the failed login counter and lock for the username
+func (api UserHandler) UnlockUserHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  username := request.PathParameters["username"]
+
+  if username == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  err := api.loginAttemptStore.ResetLoginAttempts(userLoginAttemptID(policy.NormalizeUsername(username)))
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
 
   return events.APIGatewayProxyResponse{
-    Body: successMsg,
+    Body: "Successfully Unlocked User",
     StatusCode: http.StatusOK,
   }, nil
 }
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"lambda-func/database"
+	"lambda-func/middleware"
+	"lambda-func/types"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+  MAX_API_KEYS_PER_USER = 20
+  MAX_API_KEY_TTL_DAYS = 365
+)
+
+type APIKeyHandler struct {
+  apiKeyStore database.APIKeyStore
+}
+
+func NewAPIKeyHandler(apiKeyStore database.APIKeyStore) APIKeyHandler {
+  return APIKeyHandler{
+    apiKeyStore: apiKeyStore,
+  }
+}
+
+// {"name":"ci","scopes":["blogs:write"],"expires-in-days":90}, the key itself is only in this response
+func (api APIKeyHandler) CreateAPIKeyHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  type CreateRequest struct {
+    Name string `json:"name"`
+    Scopes []string `json:"scopes"`
+    ExpiresInDays int `json:"expires-in-days"`
+  }
+
+  var createRequest CreateRequest
+
+  err := json.Unmarshal([]byte(request.Body), &createRequest)
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  if createRequest.Name == "" || len(createRequest.Name) > 64 {
+    return events.APIGatewayProxyResponse{
+      Body: "name must be between 1 and 64 characters",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  scopes := []string{}
+  seen := map[string]bool{}
+  for _, scope := range createRequest.Scopes {
+    if !types.IsValidScope(scope) {
+      return events.APIGatewayProxyResponse{
+        Body: "Invalid scope: " + scope,
+        StatusCode: http.StatusBadRequest,
+      }, nil
+    }
+
+    if !seen[scope] {
+      seen[scope] = true
+      scopes = append(scopes, scope)
+    }
+  }
+
+  if len(scopes) == 0 {
+    return events.APIGatewayProxyResponse{
+      Body: "at least one scope is required",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  if createRequest.ExpiresInDays < 0 || createRequest.ExpiresInDays > MAX_API_KEY_TTL_DAYS {
+    return events.APIGatewayProxyResponse{
+      Body: "expires-in-days must be between 0 (never) and 365",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  existing, err := api.apiKeyStore.ListAPIKeys(principal.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if len(existing) >= MAX_API_KEYS_PER_USER {
+    return events.APIGatewayProxyResponse{
+      Body: "Too many API keys, revoke one first",
+      StatusCode: http.StatusConflict,
+    }, nil
+  }
+
+  ttl := time.Duration(createRequest.ExpiresInDays) * time.Hour * 24
+
+  plainKey, apiKey, err := types.NewAPIKey(principal.Username, createRequest.Name, scopes, ttl)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.apiKeyStore.InsertAPIKey(apiKey)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  responseBody, err := json.Marshal(types.CreatedAPIKey{APIKey: apiKey, Key: plainKey})
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: string(responseBody),
+    StatusCode: http.StatusCreated,
+  }, nil
+}
+
+func (api APIKeyHandler) ListAPIKeysHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  apiKeys, err := api.apiKeyStore.ListAPIKeys(principal.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  type ListResponse struct {
+    Items []types.APIKey `json:"items"`
+  }
+
+  responseBody, err := json.Marshal(ListResponse{Items: apiKeys})
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: string(responseBody),
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+func (api APIKeyHandler) RevokeAPIKeyHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  id := request.PathParameters["id"]
+
+  if id == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  err := api.apiKeyStore.DeleteAPIKey(principal.Username, id)
+
+  if errors.Is(err, database.ErrAPIKeyNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "API key not found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: "Successfully Revoked API Key",
+    StatusCode: http.StatusOK,
+  }, nil
+}
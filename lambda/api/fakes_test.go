@@ -0,0 +1,389 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"lambda-func/database"
+	"lambda-func/hasher"
+	"lambda-func/keys"
+	"lambda-func/notify"
+	"lambda-func/policy"
+	"lambda-func/types"
+)
+
+// in memory stand ins for the dynamo stores. Each embeds its interface so a method a test
+// doesn't expect to be called panics instead of quietly doing nothing
+
+type fakeUserStore struct {
+  database.UserStore
+  users map[string]types.User
+}
+
+func newFakeUserStore(users ...types.User) *fakeUserStore {
+  s := &fakeUserStore{users: map[string]types.User{}}
+  for _, user := range users {
+    s.users[user.Username] = user
+  }
+
+  return s
+}
+
+func (s *fakeUserStore) GetUser(username string) (types.User, error) {
+  user, ok := s.users[username]
+  if !ok {
+    return types.User{}, database.ErrUserNotFound
+  }
+
+  return user, nil
+}
+
+func (s *fakeUserStore) InsertUser(user types.User) error {
+  if _, ok := s.users[user.Username]; ok {
+    return database.ErrUserExists
+  }
+
+  s.users[user.Username] = user
+  return nil
+}
+
+func (s *fakeUserStore) ReclaimPendingUser(user types.User, createdBefore time.Time) error {
+  existing, ok := s.users[user.Username]
+  if !ok || !existing.IsPendingVerification() || existing.CreatedAt >= createdBefore.UTC().Format(time.RFC3339) {
+    return database.ErrUserExists
+  }
+
+  s.users[user.Username] = user
+  return nil
+}
+
+func (s *fakeUserStore) UpdatePassword(username string, passwordHash string, changedAt time.Time) error {
+  user, ok := s.users[username]
+  if !ok {
+    return database.ErrUserNotFound
+  }
+
+  user.PasswordHash = passwordHash
+  user.PasswordChangedAt = changedAt.UTC().Format(time.RFC3339Nano)
+  s.users[username] = user
+  return nil
+}
+
+func (s *fakeUserStore) SetInitialPassword(username string, passwordHash string, changedAt time.Time) error {
+  user, ok := s.users[username]
+  if !ok || user.PasswordHash != "" {
+    return database.ErrPasswordAlreadySet
+  }
+
+  user.PasswordHash = passwordHash
+  user.PasswordChangedAt = changedAt.UTC().Format(time.RFC3339Nano)
+  s.users[username] = user
+  return nil
+}
+
+func (s *fakeUserStore) RehashPassword(username string, oldHash string, newHash string) error {
+  user, ok := s.users[username]
+  if !ok || user.PasswordHash != oldHash {
+    return database.ErrPasswordChanged
+  }
+
+  user.PasswordHash = newHash
+  s.users[username] = user
+  return nil
+}
+
+func (s *fakeUserStore) VerifyEmail(username string) error {
+  user, ok := s.users[username]
+  if !ok {
+    return database.ErrUserNotFound
+  }
+
+  user.Status = types.UserStatusActive
+  s.users[username] = user
+  return nil
+}
+
+type fakeLoginAttemptStore struct {
+  database.LoginAttemptStore
+  attempts map[string]types.LoginAttempts
+}
+
+func newFakeLoginAttemptStore() *fakeLoginAttemptStore {
+  return &fakeLoginAttemptStore{attempts: map[string]types.LoginAttempts{}}
+}
+
+func (s *fakeLoginAttemptStore) GetLoginAttempts(id string) (types.LoginAttempts, error) {
+  return s.attempts[id], nil
+}
+
+func (s *fakeLoginAttemptStore) RecordFailedLogin(id string, expiresAt time.Time) (types.LoginAttempts, error) {
+  attempts := s.attempts[id]
+  attempts.ID = id
+  attempts.FailedCount++
+  attempts.ExpiresAt = expiresAt.Unix()
+  s.attempts[id] = attempts
+  return attempts, nil
+}
+
+func (s *fakeLoginAttemptStore) LockLogin(id string, lockedUntil time.Time) error {
+  attempts := s.attempts[id]
+  attempts.LockedUntil = lockedUntil.Unix()
+  s.attempts[id] = attempts
+  return nil
+}
+
+func (s *fakeLoginAttemptStore) ResetLoginAttempts(id string) error {
+  delete(s.attempts, id)
+  return nil
+}
+
+type fakePasswordResetStore struct {
+  resets map[string]types.PasswordReset
+}
+
+func newFakePasswordResetStore() *fakePasswordResetStore {
+  return &fakePasswordResetStore{resets: map[string]types.PasswordReset{}}
+}
+
+func (s *fakePasswordResetStore) InsertPasswordReset(reset types.PasswordReset) error {
+  s.resets[reset.TokenHash] = reset
+  return nil
+}
+
+func (s *fakePasswordResetStore) ConsumePasswordReset(tokenHash string, usedAt time.Time) (types.PasswordReset, error) {
+  reset, ok := s.resets[tokenHash]
+  if !ok || reset.UsedAt != "" || reset.ExpiresAt <= usedAt.Unix() {
+    return types.PasswordReset{}, database.ErrPasswordResetInvalid
+  }
+
+  reset.UsedAt = usedAt.UTC().Format(time.RFC3339)
+  s.resets[tokenHash] = reset
+  return reset, nil
+}
+
+type fakeRefreshTokenStore struct {
+  database.RefreshTokenStore
+  tokens map[string]types.RefreshToken
+}
+
+func newFakeRefreshTokenStore() *fakeRefreshTokenStore {
+  return &fakeRefreshTokenStore{tokens: map[string]types.RefreshToken{}}
+}
+
+func (s *fakeRefreshTokenStore) InsertRefreshToken(token types.RefreshToken) error {
+  s.tokens[token.TokenHash] = token
+  return nil
+}
+
+func (s *fakeRefreshTokenStore) GetRefreshToken(tokenHash string) (types.RefreshToken, error) {
+  token, ok := s.tokens[tokenHash]
+  if !ok {
+    return types.RefreshToken{}, database.ErrRefreshTokenNotFound
+  }
+
+  return token, nil
+}
+
+func (s *fakeRefreshTokenStore) MarkRefreshTokenUsed(tokenHash string, usedAt time.Time) error {
+  token := s.tokens[tokenHash]
+  if token.UsedAt != "" {
+    return database.ErrRefreshTokenReused
+  }
+
+  token.UsedAt = usedAt.UTC().Format(time.RFC3339)
+  s.tokens[tokenHash] = token
+  return nil
+}
+
+func (s *fakeRefreshTokenStore) RevokeRefreshTokenFamily(familyID string) error {
+  for hash, token := range s.tokens {
+    if token.FamilyID == familyID {
+      token.Revoked = true
+      s.tokens[hash] = token
+    }
+  }
+
+  return nil
+}
+
+func (s *fakeRefreshTokenStore) RevokeUserRefreshTokens(username string) error {
+  for hash, token := range s.tokens {
+    if token.Username == username {
+      token.Revoked = true
+      s.tokens[hash] = token
+    }
+  }
+
+  return nil
+}
+
+// records what was revoked
+type fakeRevocationStore struct {
+  database.RevocationStore
+  revokedTokens map[string]time.Time
+  revokedBefore map[string]time.Time
+  revokedUntil map[string]time.Time
+}
+
+func newFakeRevocationStore() *fakeRevocationStore {
+  return &fakeRevocationStore{
+    revokedTokens: map[string]time.Time{},
+    revokedBefore: map[string]time.Time{},
+    revokedUntil: map[string]time.Time{},
+  }
+}
+
+func (s *fakeRevocationStore) RevokeToken(tokenID string, expiresAt time.Time) error {
+  s.revokedTokens[tokenID] = expiresAt
+  return nil
+}
+
+func (s *fakeRevocationStore) ConsumeToken(tokenID string, expiresAt time.Time) error {
+  if _, ok := s.revokedTokens[tokenID]; ok {
+    return database.ErrTokenAlreadyUsed
+  }
+
+  s.revokedTokens[tokenID] = expiresAt
+  return nil
+}
+
+func (s *fakeRevocationStore) RevokeUserTokens(username string, revokedBefore time.Time, expiresAt time.Time) error {
+  s.revokedBefore[username] = revokedBefore
+  s.revokedUntil[username] = expiresAt
+  return nil
+}
+
+type fakeAPIKeyStore struct {
+  database.APIKeyStore
+  deletedFor []string
+}
+
+func (s *fakeAPIKeyStore) DeleteUserAPIKeys(username string) error {
+  s.deletedFor = append(s.deletedFor, username)
+  return nil
+}
+
+type fakeOIDCStateStore struct {
+  states map[string]types.OIDCState
+}
+
+func (s *fakeOIDCStateStore) InsertOIDCState(state types.OIDCState) error {
+  s.states[state.StateHash] = state
+  return nil
+}
+
+func (s *fakeOIDCStateStore) ConsumeOIDCState(stateHash string, now time.Time) (types.OIDCState, error) {
+  state, ok := s.states[stateHash]
+  if !ok || state.ExpiresAt <= now.Unix() {
+    return types.OIDCState{}, database.ErrOIDCStateInvalid
+  }
+
+  delete(s.states, stateHash)
+  return state, nil
+}
+
+type fakeIdentityLinkStore struct {
+  database.IdentityLinkStore
+  links map[string]types.IdentityLink
+}
+
+func (s *fakeIdentityLinkStore) InsertIdentityLink(link types.IdentityLink) error {
+  if _, ok := s.links[link.ID]; ok {
+    return database.ErrIdentityLinkExists
+  }
+
+  s.links[link.ID] = link
+  return nil
+}
+
+func (s *fakeIdentityLinkStore) GetIdentityLink(provider string, subject string) (types.IdentityLink, error) {
+  link, ok := s.links[types.IdentityLinkID(provider, subject)]
+  if !ok {
+    return types.IdentityLink{}, database.ErrIdentityLinkNotFound
+  }
+
+  return link, nil
+}
+
+// keeps what would have been sent
+type fakeNotifier struct {
+  messages []notify.Message
+}
+
+func (n *fakeNotifier) Send(message notify.Message) error {
+  n.messages = append(n.messages, message)
+  return nil
+}
+
+// a key provider with one fresh ES256 key
+func newTestKeyProvider(t *testing.T) keys.KeyProvider {
+  t.Helper()
+
+  key, err := keys.GenerateKey(keys.ALG_ES256, time.Now())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  data, err := keys.KeySet{}.Rotate(key, time.Now(), time.Hour).Marshal()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  t.Setenv("TEST_JWT_SIGNING_KEYS", string(data))
+  return keys.NewEnvKeyProvider("TEST_JWT_SIGNING_KEYS")
+}
+
+// the handlers wired to fresh fakes, tests reach into the stores to set up and check state
+type testHandlers struct {
+  userStore *fakeUserStore
+  loginAttemptStore *fakeLoginAttemptStore
+  refreshTokenStore *fakeRefreshTokenStore
+  revocationStore *fakeRevocationStore
+  apiKeyStore *fakeAPIKeyStore
+  tokenIssuer TokenIssuer
+  tokenHandler TokenHandler
+  passwordHasher hasher.PasswordHasher
+  passwordPolicy policy.PasswordPolicy
+}
+
+func newTestHandlers(t *testing.T, users ...types.User) testHandlers {
+  t.Helper()
+
+  passwordHasher, err := hasher.NewPasswordHasher()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  passwordPolicy, err := policy.NewPasswordPolicy()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  h := testHandlers{
+    userStore: newFakeUserStore(users...),
+    loginAttemptStore: newFakeLoginAttemptStore(),
+    refreshTokenStore: newFakeRefreshTokenStore(),
+    revocationStore: newFakeRevocationStore(),
+    apiKeyStore: &fakeAPIKeyStore{},
+    passwordHasher: passwordHasher,
+    passwordPolicy: passwordPolicy,
+  }
+
+  h.tokenIssuer = NewTokenIssuer(h.refreshTokenStore, newTestKeyProvider(t), types.NewTokenConfig())
+  h.tokenHandler = NewTokenHandler(h.userStore, h.refreshTokenStore, h.revocationStore, h.apiKeyStore, h.tokenIssuer)
+
+  return h
+}
+
+// a user with password as their password, active unless changed by the caller
+func testUser(t *testing.T, passwordHasher hasher.PasswordHasher, username string, password string) types.User {
+  t.Helper()
+
+  user, err := types.NewUser(types.RegisterUser{Username: username, Password: password, Email: username + "@example.com"}, passwordHasher)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  user.Status = types.UserStatusActive
+  return user
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"lambda-func/database"
+	"lambda-func/hasher"
+	"lambda-func/types"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// after this many failures in FAILED_LOGIN_WINDOW logins are locked, the lock doubles with
+// every further failure up to LOCKOUT_MAX. The ip limit is higher since users share addresses
+const (
+  USER_LOCKOUT_THRESHOLD = 5
+  IP_LOCKOUT_THRESHOLD = 20
+  LOCKOUT_BASE = time.Second * 30
+  LOCKOUT_MAX = time.Hour * 1
+  FAILED_LOGIN_WINDOW = time.Hour * 24
+)
+
+type loginAttemptKey struct {
+  id string
+  threshold int
+}
+
+func loginAttemptKeys(username string, sourceIP string) []loginAttemptKey {
+  attemptKeys := []loginAttemptKey{
+    {id: userLoginAttemptID(username), threshold: USER_LOCKOUT_THRESHOLD},
+  }
+
+  if sourceIP != "" {
+    attemptKeys = append(attemptKeys, loginAttemptKey{id: "ip#" + sourceIP, threshold: IP_LOCKOUT_THRESHOLD})
+  }
+
+  return attemptKeys
+}
+
+func userLoginAttemptID(username string) string {
+  return "user#" + username
+}
+
+func lockoutDuration(failedCount int, threshold int) time.Duration {
+  if failedCount < threshold {
+    return 0
+  }
+
+  lockout := LOCKOUT_BASE
+  for i := threshold; i < failedCount && lockout < LOCKOUT_MAX; i++ {
+    lockout *= 2
+  }
+
+  if lockout > LOCKOUT_MAX {
+    return LOCKOUT_MAX
+  }
+
+  return lockout
+}
+
+// the latest lock over all keys, zero when none of them is locked
+func lockedUntil(loginAttemptStore database.LoginAttemptStore, attemptKeys []loginAttemptKey) (time.Time, error) {
+  var until time.Time
+
+  for _, attemptKey := range attemptKeys {
+    attempts, err := loginAttemptStore.GetLoginAttempts(attemptKey.id)
+    if err != nil {
+      return until, err
+    }
+
+    if attempts.IsLocked() && time.Unix(attempts.LockedUntil, 0).After(until) {
+      until = time.Unix(attempts.LockedUntil, 0)
+    }
+  }
+
+  return until, nil
+}
+
+func recordFailedLogin(loginAttemptStore database.LoginAttemptStore, attemptKeys []loginAttemptKey) error {
+  now := time.Now()
+
+  for _, attemptKey := range attemptKeys {
+    attempts, err := loginAttemptStore.RecordFailedLogin(attemptKey.id, now.Add(FAILED_LOGIN_WINDOW))
+    if err != nil {
+      return err
+    }
+
+    if lockout := lockoutDuration(attempts.FailedCount, attemptKey.threshold); lockout > 0 {
+      err = loginAttemptStore.LockLogin(attemptKey.id, now.Add(lockout))
+      if err != nil {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
+
+// for routes that ask a signed in user for their password again. Wrong guesses count against the
+// same per-username lock as logins, a stolen access token mustn't allow unlimited guessing.
+// A nil response means the password matched
+func checkCurrentPassword(loginAttemptStore database.LoginAttemptStore, passwordHasher hasher.PasswordHasher, user types.User, password string, incorrectBody string) (*events.APIGatewayProxyResponse, error) {
+  attemptKeys := []loginAttemptKey{
+    {id: userLoginAttemptID(user.Username), threshold: USER_LOCKOUT_THRESHOLD},
+  }
+
+  until, err := lockedUntil(loginAttemptStore, attemptKeys)
+  if err != nil {
+    return &events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if !until.IsZero() {
+    return &events.APIGatewayProxyResponse{
+      Body: "Too many failed attempts, try again later",
+      StatusCode: http.StatusTooManyRequests,
+      Headers: map[string]string{
+        "Retry-After": retryAfterSeconds(until),
+      },
+    }, nil
+  }
+
+  if !passwordMatches(passwordHasher, user.PasswordHash, password) {
+    err = recordFailedLogin(loginAttemptStore, attemptKeys)
+    if err != nil {
+      return &events.APIGatewayProxyResponse{
+        Body: "Internal Server Error",
+        StatusCode: http.StatusInternalServerError,
+      }, err
+    }
+
+    return &events.APIGatewayProxyResponse{
+      Body: incorrectBody,
+      StatusCode: http.StatusForbidden,
+    }, nil
+  }
+
+  err = loginAttemptStore.ResetLoginAttempts(userLoginAttemptID(user.Username))
+  if err != nil {
+    return &events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return nil, nil
+}
+
+func retryAfterSeconds(until time.Time) string {
+  seconds := int64(time.Until(until).Seconds()) + 1
+  return strconv.FormatInt(seconds, 10)
+}
@@ -0,0 +1,328 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"lambda-func/database"
+	"lambda-func/middleware"
+	"lambda-func/totp"
+	"lambda-func/types"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const RECOVERY_CODE_COUNT = 10
+
+// starts enrollment, the secret only becomes active once a code from it is verified
+func (api UserHandler) EnrollMFAHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  user, err := api.userStore.GetUser(principal.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if user.MFAEnabled {
+    return events.APIGatewayProxyResponse{
+      Body: "MFA already enabled",
+      StatusCode: http.StatusConflict,
+    }, nil
+  }
+
+  secret, err := totp.GenerateSecret()
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.userStore.SetPendingMFASecret(user.Username, secret)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  type EnrollResponse struct {
+    Secret string `json:"secret"`
+    OtpauthURI string `json:"otpauth-uri"`
+  }
+
+  responseBody, err := json.Marshal(EnrollResponse{
+    Secret: secret,
+    OtpauthURI: totp.URI(api.tokenIssuer.tokenConfig.Issuer, user.Username, secret),
+  })
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    StatusCode: http.StatusOK,
+    Body:       string(responseBody),
+  }, nil
+}
+
+// checks the first code from the authenticator, turns mfa on and returns the recovery codes.
+// This is the only time the recovery codes are shown
+func (api UserHandler) VerifyMFAHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  type VerifyRequest struct {
+    Code string `json:"code"`
+  }
+
+  var verifyRequest VerifyRequest
+
+  err := json.Unmarshal([]byte(request.Body), &verifyRequest)
+
+  if err != nil || verifyRequest.Code == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  user, err := api.userStore.GetUser(principal.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if user.MFAPendingSecret == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "No MFA enrollment in progress",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  step, ok := totp.Validate(user.MFAPendingSecret, verifyRequest.Code, time.Now(), 0)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid code",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  recoveryCodes, recoveryCodeHashes, err := generateRecoveryCodes()
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.userStore.EnableMFA(user.Username, user.MFAPendingSecret, recoveryCodeHashes, step)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  type VerifyResponse struct {
+    RecoveryCodes []string `json:"recovery-codes"`
+  }
+
+  responseBody, err := json.Marshal(VerifyResponse{RecoveryCodes: recoveryCodes})
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    StatusCode: http.StatusOK,
+    Body:       string(responseBody),
+  }, nil
+}
+
+// second login step, exchanges the mfa token from /login and a totp or recovery code for real tokens
+func (api UserHandler) LoginMFAHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  type MFALoginRequest struct {
+    MFAToken string `json:"mfa-token"`
+    Code string `json:"code"`
+    RecoveryCode string `json:"recovery-code"`
+  }
+
+  var mfaLoginRequest MFALoginRequest
+
+  err := json.Unmarshal([]byte(request.Body), &mfaLoginRequest)
+
+  if err != nil || mfaLoginRequest.MFAToken == "" || (mfaLoginRequest.Code == "" && mfaLoginRequest.RecoveryCode == "") {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  claims, err := types.ParseToken(mfaLoginRequest.MFAToken, types.TokenUseMFA, api.tokenIssuer.keyProvider, api.tokenIssuer.tokenConfig)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid MFA token",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  // six digits are guessable, the codes count towards the same lockout as passwords
+  attemptKeys := loginAttemptKeys(claims.Subject, request.RequestContext.Identity.SourceIP)
+
+  lockedUntil, err := lockedUntil(api.loginAttemptStore, attemptKeys)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if !lockedUntil.IsZero() {
+    return events.APIGatewayProxyResponse{
+      Body: "Too many failed login attempts, try again later",
+      StatusCode: http.StatusTooManyRequests,
+      Headers: map[string]string{
+        "Retry-After": retryAfterSeconds(lockedUntil),
+      },
+    }, nil
+  }
+
+  user, err := api.userStore.GetUser(claims.Subject)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid MFA token",
+      StatusCode: http.StatusUnauthorized,
+    }, err
+  }
+
+  if !user.MFAEnabled {
+    return events.APIGatewayProxyResponse{
+      Body: "MFA is not enabled",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  if mfaLoginRequest.Code != "" {
+    step, ok := totp.Validate(user.MFASecret, mfaLoginRequest.Code, time.Now(), user.MFALastStep)
+    if ok {
+      err = api.userStore.RecordMFAStep(user.Username, step)
+    } else {
+      err = database.ErrMFACodeReused
+    }
+  } else {
+    err = api.userStore.UseRecoveryCode(user.Username, hashRecoveryCode(mfaLoginRequest.RecoveryCode))
+  }
+
+  if errors.Is(err, database.ErrMFACodeReused) || errors.Is(err, database.ErrRecoveryCodeInvalid) {
+    err = recordFailedLogin(api.loginAttemptStore, attemptKeys)
+    if err != nil {
+      return events.APIGatewayProxyResponse{
+        Body: "Internal Server Error",
+        StatusCode: http.StatusInternalServerError,
+      }, err
+    }
+
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid code",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.loginAttemptStore.ResetLoginAttempts(userLoginAttemptID(user.Username))
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return api.tokenResponse(user)
+}
+
+// access and refresh token pair for a user who passed every login step
+func (api UserHandler) tokenResponse(user types.User) (events.APIGatewayProxyResponse, error) {
+  tokens, err := api.tokenIssuer.IssueTokens(user, "")
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  responseBody, err := json.Marshal(tokens)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: string(responseBody),
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// codes look like abcd-efgh-ijkl-mnop, only their sha256 is stored
+func generateRecoveryCodes() ([]string, []string, error) {
+  encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+  codes := []string{}
+  hashes := []string{}
+
+  for i := 0; i < RECOVERY_CODE_COUNT; i++ {
+    raw := make([]byte, 10)
+    _, err := rand.Read(raw)
+    if err != nil {
+      return nil, nil, err
+    }
+
+    plain := strings.ToLower(encoding.EncodeToString(raw))
+    code := plain[0:4] + "-" + plain[4:8] + "-" + plain[8:12] + "-" + plain[12:16]
+
+    codes = append(codes, code)
+    hashes = append(hashes, hashRecoveryCode(code))
+  }
+
+  return codes, hashes, nil
+}
+
+// users type codes however they like, dashes, spaces and case don't matter
+func hashRecoveryCode(code string) string {
+  normalized := strings.ToLower(code)
+  normalized = strings.ReplaceAll(normalized, "-", "")
+  normalized = strings.ReplaceAll(normalized, " ", "")
+
+  return types.HashToken(normalized)
+}
@@ -0,0 +1,502 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"lambda-func/database"
+	"lambda-func/middleware"
+	"lambda-func/oidc"
+	"lambda-func/policy"
+	"lambda-func/types"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// how many random suffixes are tried when the name suggested by the provider is taken
+const OIDC_USERNAME_ATTEMPTS = 5
+
+// holds the hash of the state, so a callback only completes in the browser that started the sign in.
+// Without it anyone could send a victim their own callback url and sign them in as, or link, the wrong account
+const OIDC_STATE_COOKIE = "oidc_state"
+
+// sign in with an external oidc provider, authorization code flow with pkce
+type OIDCHandler struct {
+  providers oidc.Providers
+  oidcStateStore database.OIDCStateStore
+  identityLinkStore database.IdentityLinkStore
+  userStore database.UserStore
+  // makes link tokens single use
+  revocationStore database.RevocationStore
+  userHandler UserHandler
+}
+
+func NewOIDCHandler(providers oidc.Providers, oidcStateStore database.OIDCStateStore, identityLinkStore database.IdentityLinkStore, userStore database.UserStore, revocationStore database.RevocationStore, userHandler UserHandler) OIDCHandler {
+  return OIDCHandler{
+    providers: providers,
+    oidcStateStore: oidcStateStore,
+    identityLinkStore: identityLinkStore,
+    userStore: userStore,
+    revocationStore: revocationStore,
+    userHandler: userHandler,
+  }
+}
+
+// GET /oidc/{provider}/start sends the browser to the provider's sign in page
+func (api OIDCHandler) StartOIDCHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  return api.redirectToProvider(request, "")
+}
+
+// POST /me/identities/{provider} links a provider account to the signed in user. The call carries a
+// bearer token, which a browser navigation can't, and a cookie set on its response wouldn't be kept
+// by a frontend on another origin. So it only returns a link_url, GET /oidc/{provider}/link with a
+// short lived single use token, that the frontend opens. That navigation sets the state cookie
+func (api OIDCHandler) LinkOIDCHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  providerName := request.PathParameters["provider"]
+
+  if _, err := api.providers.Get(providerName); err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Unknown sign in provider",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  linkToken, err := types.CreateOIDCLinkToken(types.User{Username: principal.Username}, api.userHandler.tokenIssuer.keyProvider, api.userHandler.tokenIssuer.tokenConfig)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  linkURL := apiBaseURL(request) + "/oidc/" + url.PathEscape(providerName) + "/link?token=" + url.QueryEscape(linkToken)
+
+  responseBody, err := json.Marshal(map[string]string{
+    "link_url": linkURL,
+  })
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: string(responseBody),
+    StatusCode: http.StatusOK,
+    Headers: map[string]string{
+      "Content-Type": "application/json",
+      "Cache-Control": "no-store",
+    },
+  }, nil
+}
+
+// GET /oidc/{provider}/link?token= is the link_url from LinkOIDCHandler, it starts the provider
+// sign in for the token's user in this browser
+func (api OIDCHandler) StartLinkOIDCHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  invalidLink := events.APIGatewayProxyResponse{
+    Body: "Link is invalid or has expired, start again",
+    StatusCode: http.StatusBadRequest,
+  }
+
+  claims, err := types.ParseToken(request.QueryStringParameters["token"], types.TokenUseOIDCLink, api.userHandler.tokenIssuer.keyProvider, api.userHandler.tokenIssuer.tokenConfig)
+  if err != nil {
+    return invalidLink, nil
+  }
+
+  // whoever sees the url after it was opened, in history or a referer, can't start a link with it
+  err = api.revocationStore.ConsumeToken(claims.ID, claims.ExpiresAt.Time)
+  if errors.Is(err, database.ErrTokenAlreadyUsed) {
+    return invalidLink, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return api.redirectToProvider(request, claims.Subject)
+}
+
+// stores the state, sets its cookie and sends the browser to the provider
+func (api OIDCHandler) redirectToProvider(request events.APIGatewayProxyRequest, linkUsername string) (events.APIGatewayProxyResponse, error) {
+  authorizationURL, state, response, err := api.begin(request.PathParameters["provider"], linkUsername)
+  if response != nil {
+    return *response, err
+  }
+
+  return events.APIGatewayProxyResponse{
+    StatusCode: http.StatusFound,
+    Headers: map[string]string{
+      "Location": authorizationURL,
+      "Cache-Control": "no-store",
+      "Referrer-Policy": "no-referrer",
+      "Set-Cookie": stateCookie(request, types.HashToken(state), int(types.OIDC_STATE_TTL.Seconds())),
+    },
+  }, nil
+}
+
+// GET /oidc/{provider}/callback is where the provider sends the browser back with a code. The state
+// has to be one we handed out, for this provider, unused, and match the browser's state cookie. The user
+// is found by the provider's subject, a first sign in creates an account, and then our normal tokens
+// (or an mfa challenge) are returned
+func (api OIDCHandler) OIDCCallbackHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  response, err := api.callback(request)
+
+  // single use like the state. A cookie that didn't match is left, a forged callback mustn't end a real sign in
+  if stateCookieMatches(request) {
+    if response.Headers == nil {
+      response.Headers = map[string]string{}
+    }
+    response.Headers["Set-Cookie"] = stateCookie(request, "", -1)
+  }
+
+  return response, err
+}
+
+func (api OIDCHandler) callback(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  providerName := request.PathParameters["provider"]
+  query := request.QueryStringParameters
+
+  provider, err := api.providers.Get(providerName)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Unknown sign in provider",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  // the user cancelled or the provider refused, the state is left to expire
+  if query["error"] != "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Sign in was cancelled or failed at the provider",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  if query["code"] == "" || query["state"] == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  invalidState := events.APIGatewayProxyResponse{
+    Body: "Sign in attempt is invalid or has expired, start again",
+    StatusCode: http.StatusBadRequest,
+  }
+
+  // checked before the state is consumed, so a forged callback can't burn the victim's real one
+  if !stateCookieMatches(request) {
+    return invalidState, nil
+  }
+
+  state, err := api.oidcStateStore.ConsumeOIDCState(types.HashToken(query["state"]), time.Now())
+  if errors.Is(err, database.ErrOIDCStateInvalid) {
+    return invalidState, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if state.Provider != providerName {
+    return invalidState, nil
+  }
+
+  idToken, err := provider.Exchange(query["code"], state.CodeVerifier)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Failed to complete sign in with the provider",
+      StatusCode: http.StatusBadGateway,
+    }, err
+  }
+
+  identity, err := provider.VerifyIDToken(idToken, state.Nonce)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, err
+  }
+
+  if state.LinkUsername != "" {
+    return api.link(providerName, identity, state.LinkUsername)
+  }
+
+  user, err := api.findOrCreateUser(providerName, identity)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // the provider stands in for the password, a second factor set up here is still asked for
+  if user.MFAEnabled {
+    return api.userHandler.mfaChallengeResponse(user)
+  }
+
+  return api.userHandler.tokenResponse(user)
+}
+
+// stores state, nonce and pkce verifier for the callback and builds the provider's authorization url,
+// the state is returned for the cookie
+func (api OIDCHandler) begin(providerName string, linkUsername string) (string, string, *events.APIGatewayProxyResponse, error) {
+  provider, err := api.providers.Get(providerName)
+  if err != nil {
+    return "", "", &events.APIGatewayProxyResponse{
+      Body: "Unknown sign in provider",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  values := make([]string, 3)
+  for i := range values {
+    values[i], err = oidc.RandomString()
+    if err != nil {
+      return "", "", &events.APIGatewayProxyResponse{
+        Body: "Internal Server Error",
+        StatusCode: http.StatusInternalServerError,
+      }, err
+    }
+  }
+  state, nonce, codeVerifier := values[0], values[1], values[2]
+
+  authorizationURL, err := provider.AuthorizationURL(state, nonce, codeVerifier)
+  if err != nil {
+    return "", "", &events.APIGatewayProxyResponse{
+      Body: "Sign in provider is unavailable",
+      StatusCode: http.StatusBadGateway,
+    }, err
+  }
+
+  err = api.oidcStateStore.InsertOIDCState(types.NewOIDCState(state, providerName, nonce, codeVerifier, linkUsername))
+  if err != nil {
+    return "", "", &events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return authorizationURL, state, nil, nil
+}
+
+// scoped to the api's /oidc/ paths. A negative maxAge deletes the cookie
+func stateCookie(request events.APIGatewayProxyRequest, value string, maxAge int) string {
+  cookie := http.Cookie{
+    Name: OIDC_STATE_COOKIE,
+    Value: value,
+    Path: stagePrefix(request) + "/oidc/",
+    MaxAge: maxAge,
+    HttpOnly: true,
+    Secure: true,
+    SameSite: http.SameSiteLaxMode,
+  }
+
+  return cookie.String()
+}
+
+// request.Path doesn't have the stage, the request context path does, so this is whatever is in
+// front of the route
+func stagePrefix(request events.APIGatewayProxyRequest) string {
+  return strings.TrimSuffix(request.RequestContext.Path, request.Path)
+}
+
+// where the api is reachable, as the client called it
+func apiBaseURL(request events.APIGatewayProxyRequest) string {
+  host := request.RequestContext.DomainName
+  if host == "" {
+    host = middleware.HeaderValue(request.Headers, "Host")
+  }
+
+  scheme := middleware.HeaderValue(request.Headers, "X-Forwarded-Proto")
+  if scheme == "" {
+    scheme = "https"
+  }
+
+  return scheme + "://" + host + stagePrefix(request)
+}
+
+func stateCookieMatches(request events.APIGatewayProxyRequest) bool {
+  state := request.QueryStringParameters["state"]
+  if state == "" {
+    return false
+  }
+
+  return subtle.ConstantTimeCompare([]byte(requestCookie(request, OIDC_STATE_COOKIE)), []byte(types.HashToken(state))) == 1
+}
+
+func requestCookie(request events.APIGatewayProxyRequest, name string) string {
+  header := http.Header{}
+  for key, value := range request.Headers {
+    if strings.EqualFold(key, "Cookie") {
+      header.Add("Cookie", value)
+    }
+  }
+
+  cookie, err := (&http.Request{Header: header}).Cookie(name)
+  if err != nil {
+    return ""
+  }
+
+  return cookie.Value
+}
+
+func (api OIDCHandler) link(providerName string, identity oidc.Identity, username string) (events.APIGatewayProxyResponse, error) {
+  err := api.identityLinkStore.InsertIdentityLink(types.NewIdentityLink(providerName, identity.Subject, username, verifiedEmail(identity)))
+
+  if errors.Is(err, database.ErrIdentityLinkExists) {
+    link, err := api.identityLinkStore.GetIdentityLink(providerName, identity.Subject)
+    if err != nil {
+      return events.APIGatewayProxyResponse{
+        Body: "Internal Server Error",
+        StatusCode: http.StatusInternalServerError,
+      }, err
+    }
+
+    if link.Username != username {
+      return events.APIGatewayProxyResponse{
+        Body: "This provider account is already linked to another user",
+        StatusCode: http.StatusConflict,
+      }, nil
+    }
+  } else if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: "Successfully Linked " + providerName,
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// accounts are never matched by email, whoever controls an address at the provider would
+// otherwise get into the local account using it
+func (api OIDCHandler) findOrCreateUser(providerName string, identity oidc.Identity) (types.User, error) {
+  link, err := api.identityLinkStore.GetIdentityLink(providerName, identity.Subject)
+  if err == nil {
+    return api.userStore.GetUser(link.Username)
+  }
+
+  if !errors.Is(err, database.ErrIdentityLinkNotFound) {
+    return types.User{}, err
+  }
+
+  user, err := api.createUser(identity)
+  if err != nil {
+    return types.User{}, err
+  }
+
+  err = api.identityLinkStore.InsertIdentityLink(types.NewIdentityLink(providerName, identity.Subject, user.Username, user.Email))
+
+  // a second callback for the same new subject got there first, use its account instead
+  if errors.Is(err, database.ErrIdentityLinkExists) {
+    deleteErr := api.userStore.DeleteUser(user.Username)
+    if deleteErr != nil {
+      log.Printf("failed to delete duplicate oidc user %s: %v", user.Username, deleteErr)
+    }
+
+    link, err = api.identityLinkStore.GetIdentityLink(providerName, identity.Subject)
+    if err != nil {
+      return types.User{}, err
+    }
+
+    return api.userStore.GetUser(link.Username)
+  }
+
+  if err != nil {
+    return types.User{}, err
+  }
+
+  return user, nil
+}
+
+// named after the provider's preferred_username or the email's local part, with a random suffix
+// when that is taken or not a valid username
+func (api OIDCHandler) createUser(identity oidc.Identity) (types.User, error) {
+  base := policy.SuggestUsername(identity.PreferredUsername)
+  if base == "" {
+    base = policy.SuggestUsername(localPart(identity.Email))
+  }
+
+  candidates := []string{}
+  if base != "" {
+    candidates = append(candidates, base)
+  } else {
+    base = "user"
+  }
+
+  for i := 0; i < OIDC_USERNAME_ATTEMPTS; i++ {
+    suffix := make([]byte, 3)
+    _, err := rand.Read(suffix)
+    if err != nil {
+      return types.User{}, err
+    }
+
+    candidates = append(candidates, base + "-" + hex.EncodeToString(suffix))
+  }
+
+  for _, username := range candidates {
+    user := types.NewExternalUser(username, verifiedEmail(identity))
+
+    err := api.userStore.InsertUser(user)
+    if errors.Is(err, database.ErrUserExists) {
+      continue
+    }
+
+    if err != nil {
+      return types.User{}, err
+    }
+
+    return user, nil
+  }
+
+  return types.User{}, errors.New("failed to find a free username for the oidc user")
+}
+
+// unverified addresses aren't stored, password reset emails would go to someone else
+func verifiedEmail(identity oidc.Identity) string {
+  if !identity.EmailVerified {
+    return ""
+  }
+
+  email := policy.NormalizeEmail(identity.Email)
+  if len(policy.ValidateEmail(email)) > 0 {
+    return ""
+  }
+
+  return email
+}
+
+func localPart(email string) string {
+  at := strings.LastIndex(email, "@")
+  if at < 0 {
+    return ""
+  }
+
+  return email[:at]
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/golang-jwt/jwt/v5"
+	"lambda-func/keys"
+	"lambda-func/oidc"
+	"lambda-func/types"
+)
+
+// an oidc provider that signs in "provider-subject" straight away. The id token carries whatever
+// nonce the test last set, as a real provider would carry the one from the authorization request
+type testProvider struct {
+  server *httptest.Server
+  nonce string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+  t.Helper()
+
+  key, err := keys.GenerateKey(keys.ALG_ES256, time.Now())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  jwks, err := keys.KeySet{}.Rotate(key, time.Now(), time.Hour).JWKS()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  p := &testProvider{}
+  mux := http.NewServeMux()
+  p.server = httptest.NewServer(mux)
+  t.Cleanup(p.server.Close)
+
+  mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(map[string]string{
+      "issuer": p.server.URL,
+      "authorization_endpoint": p.server.URL + "/authorize",
+      "token_endpoint": p.server.URL + "/token",
+      "jwks_uri": p.server.URL + "/jwks",
+    })
+  })
+
+  mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(jwks)
+  })
+
+  mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+    now := time.Now()
+    token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+      "iss": p.server.URL,
+      "aud": "test-client",
+      "sub": "provider-subject",
+      "nonce": p.nonce,
+      "iat": now.Unix(),
+      "exp": now.Add(time.Minute).Unix(),
+    })
+    token.Header["kid"] = key.ID
+
+    idToken, err := token.SignedString(key.PrivateKey())
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+  })
+
+  return p
+}
+
+// the cookie a response sets, if any
+func setCookie(response events.APIGatewayProxyResponse) *http.Cookie {
+  cookies := (&http.Response{Header: http.Header{"Set-Cookie": {response.Headers["Set-Cookie"]}}}).Cookies()
+  if len(cookies) == 0 {
+    return nil
+  }
+
+  return cookies[0]
+}
+
+// a request as api gateway passes it on the prod stage
+func stageRequest(method string, path string, query map[string]string, headers map[string]string) events.APIGatewayProxyRequest {
+  request := events.APIGatewayProxyRequest{
+    HTTPMethod: method,
+    Path: path,
+    PathParameters: map[string]string{"provider": "test"},
+    QueryStringParameters: query,
+    Headers: headers,
+  }
+  request.RequestContext.Path = "/prod" + path
+  request.RequestContext.DomainName = "api.example.com"
+
+  return request
+}
+
+func TestLinkOIDCStateCookieRoundTrip(t *testing.T) {
+  provider := newTestProvider(t)
+
+  h := newTestHandlers(t)
+  h.userStore.users["alice"] = testUser(t, h.passwordHasher, "alice", "correct horse battery")
+
+  stateStore := &fakeOIDCStateStore{states: map[string]types.OIDCState{}}
+  linkStore := &fakeIdentityLinkStore{links: map[string]types.IdentityLink{}}
+  userHandler := NewUserHandler(h.userStore, h.loginAttemptStore, h.tokenIssuer, h.passwordPolicy, h.passwordHasher, EmailVerificationHandler{})
+  providers := oidc.Providers{
+    "test": oidc.NewProvider("test", oidc.ProviderConfig{
+      Issuer: provider.server.URL,
+      ClientID: "test-client",
+      RedirectURL: "https://api.example.com/prod/oidc/test/callback",
+    }, provider.server.Client()),
+  }
+  api := NewOIDCHandler(providers, stateStore, linkStore, h.userStore, h.revocationStore, userHandler)
+
+  // the signed in user asks for a link url, a plain json call
+  linkRequest := stageRequest("POST", "/me/identities/test", nil, nil)
+  linkRequest.RequestContext.Authorizer = authenticatedRequest("alice", "").RequestContext.Authorizer
+
+  response, err := api.LinkOIDCHandler(linkRequest)
+  if err != nil || response.StatusCode != http.StatusOK {
+    t.Fatalf("LinkOIDCHandler() = %d %q, %v", response.StatusCode, response.Body, err)
+  }
+
+  if response.Headers["Set-Cookie"] != "" {
+    t.Errorf("link url response sets a cookie, a cross origin frontend wouldn't keep it")
+  }
+
+  var linkResponse struct {
+    LinkURL string `json:"link_url"`
+  }
+  json.Unmarshal([]byte(response.Body), &linkResponse)
+
+  linkURL, err := url.Parse(linkResponse.LinkURL)
+  if err != nil || linkURL.Scheme != "https" || linkURL.Host != "api.example.com" || linkURL.Path != "/prod/oidc/test/link" {
+    t.Fatalf("link_url = %q, want https://api.example.com/prod/oidc/test/link?token=...", linkResponse.LinkURL)
+  }
+  linkToken := linkURL.Query().Get("token")
+
+  // the browser opens it, gets the state cookie and is sent to the provider
+  openLink := stageRequest("GET", "/oidc/test/link", map[string]string{"token": linkToken}, nil)
+
+  response, err = api.StartLinkOIDCHandler(openLink)
+  if err != nil || response.StatusCode != http.StatusFound {
+    t.Fatalf("StartLinkOIDCHandler() = %d %q, %v", response.StatusCode, response.Body, err)
+  }
+
+  authorizationURL, err := url.Parse(response.Headers["Location"])
+  if err != nil || !strings.HasPrefix(authorizationURL.String(), provider.server.URL + "/authorize") {
+    t.Fatalf("Location = %q, want the provider's authorization endpoint", response.Headers["Location"])
+  }
+  state := authorizationURL.Query().Get("state")
+  provider.nonce = authorizationURL.Query().Get("nonce")
+
+  cookie := setCookie(response)
+  if cookie == nil {
+    t.Fatalf("Set-Cookie = %q, want the state cookie", response.Headers["Set-Cookie"])
+  }
+
+  if cookie.Name != OIDC_STATE_COOKIE || cookie.Value != types.HashToken(state) || cookie.Path != "/prod/oidc/" || !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+    t.Errorf("state cookie = %+v, want the state's hash, HttpOnly, Secure and Lax on /prod/oidc/", cookie)
+  }
+
+  // the link url works once
+  response, _ = api.StartLinkOIDCHandler(openLink)
+  if response.StatusCode != http.StatusBadRequest {
+    t.Errorf("reused link url = %d, want %d", response.StatusCode, http.StatusBadRequest)
+  }
+
+  callback := func(cookieHeader string) events.APIGatewayProxyResponse {
+    headers := map[string]string{}
+    if cookieHeader != "" {
+      headers["cookie"] = cookieHeader
+    }
+
+    response, _ := api.OIDCCallbackHandler(stageRequest("GET", "/oidc/test/callback", map[string]string{"code": "code", "state": state}, headers))
+    return response
+  }
+
+  // someone else's browser finishing this callback url, without the cookie or with their own
+  for _, cookieHeader := range []string{"", OIDC_STATE_COOKIE + "=" + types.HashToken("their own state")} {
+    response = callback(cookieHeader)
+    if response.StatusCode != http.StatusBadRequest {
+      t.Errorf("callback with cookie %q = %d, want %d", cookieHeader, response.StatusCode, http.StatusBadRequest)
+    }
+
+    if response.Headers["Set-Cookie"] != "" {
+      t.Errorf("callback with cookie %q cleared the state cookie", cookieHeader)
+    }
+  }
+
+  if len(stateStore.states) != 1 {
+    t.Fatalf("forged callbacks used up the state")
+  }
+
+  if len(linkStore.links) != 0 {
+    t.Fatalf("forged callback linked %v", linkStore.links)
+  }
+
+  // the browser that started it finishes it
+  response = callback("other=1; " + OIDC_STATE_COOKIE + "=" + cookie.Value)
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("callback = %d %q, want %d", response.StatusCode, response.Body, http.StatusOK)
+  }
+
+  link, ok := linkStore.links[types.IdentityLinkID("test", "provider-subject")]
+  if !ok || link.Username != "alice" {
+    t.Fatalf("identity link = %+v, want provider-subject linked to alice", link)
+  }
+
+  if cleared := setCookie(response); cleared == nil || cleared.MaxAge >= 0 {
+    t.Errorf("callback didn't clear the state cookie: %q", response.Headers["Set-Cookie"])
+  }
+
+  // and the state can't be used again
+  response = callback(OIDC_STATE_COOKIE + "=" + cookie.Value)
+  if response.StatusCode != http.StatusBadRequest {
+    t.Errorf("replayed callback = %d, want %d", response.StatusCode, http.StatusBadRequest)
+  }
+}
@@ -0,0 +1,402 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lambda-func/database"
+	"lambda-func/hasher"
+	"lambda-func/middleware"
+	"lambda-func/notify"
+	"lambda-func/policy"
+	"lambda-func/types"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+  // how often one account can be sent a reset link
+  PASSWORD_RESET_RESEND_INTERVAL = time.Minute * 1
+  // forgot password never answers sooner than this. Signing, storing and emailing a reset takes
+  // time an unknown username doesn't, padding every answer to the same length hides which is which
+  FORGOT_PASSWORD_RESPONSE_TIME = time.Second * 1
+)
+
+type PasswordHandler struct {
+  userStore database.UserStore
+  passwordResetStore database.PasswordResetStore
+  loginAttemptStore database.LoginAttemptStore
+  tokenHandler TokenHandler
+  passwordPolicy policy.PasswordPolicy
+  passwordHasher hasher.PasswordHasher
+  notifier notify.Notifier
+  // page the emailed link points at, the token is added as ?token=. Empty sends the bare token
+  resetURL string
+}
+
+func NewPasswordHandler(userStore database.UserStore, passwordResetStore database.PasswordResetStore, loginAttemptStore database.LoginAttemptStore, tokenHandler TokenHandler, passwordPolicy policy.PasswordPolicy, passwordHasher hasher.PasswordHasher, notifier notify.Notifier, resetURL string) PasswordHandler {
+  return PasswordHandler{
+    userStore: userStore,
+    passwordResetStore: passwordResetStore,
+    loginAttemptStore: loginAttemptStore,
+    tokenHandler: tokenHandler,
+    passwordPolicy: passwordPolicy,
+    passwordHasher: passwordHasher,
+    notifier: notifier,
+    resetURL: resetURL,
+  }
+}
+
+// always answers 202, after the same delay, so the endpoint can't be used to find out which usernames exist
+func (api PasswordHandler) ForgotPasswordHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  defer padResponse(time.Now(), FORGOT_PASSWORD_RESPONSE_TIME)
+
+  type ForgotRequest struct {
+    Username string `json:"username"`
+  }
+
+  var forgotRequest ForgotRequest
+
+  err := json.Unmarshal([]byte(request.Body), &forgotRequest)
+
+  if err != nil || forgotRequest.Username == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  accepted := events.APIGatewayProxyResponse{
+    Body: "If the account exists and has an email address, a reset link has been sent",
+    StatusCode: http.StatusAccepted,
+  }
+
+  user, err := api.userStore.GetUser(policy.NormalizeUsername(forgotRequest.Username))
+
+  if errors.Is(err, database.ErrUserNotFound) {
+    return accepted, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // an unverified address may not belong to the user, it is never sent a reset link
+  if user.Email == "" || user.IsPendingVerification() {
+    return accepted, nil
+  }
+
+  err = api.userStore.MarkPasswordResetSent(user.Username, time.Now(), PASSWORD_RESET_RESEND_INTERVAL)
+
+  if errors.Is(err, database.ErrPasswordResetSentRecently) {
+    return accepted, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  issuer := api.tokenHandler.tokenIssuer
+
+  token, err := types.CreatePasswordResetToken(user, issuer.keyProvider, issuer.tokenConfig)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.passwordResetStore.InsertPasswordReset(types.NewPasswordReset(token, user.Username, types.PASSWORD_RESET_TOKEN_TTL))
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // a failed send still answers 202, the error is only logged
+  err = api.notifier.Send(notify.Message{
+    To: user.Email,
+    Subject: "Reset your password",
+    Body: fmt.Sprintf("Someone asked to reset the password of %s. If it was you, use this within the next hour:\n\n%s\n\nOtherwise you can ignore this email.", user.Username, api.resetLink(token)),
+  })
+
+  return accepted, err
+}
+
+// the token is single use, and every session is ended since the old password may be known to someone else
+func (api PasswordHandler) ResetPasswordHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  type ResetRequest struct {
+    Token string `json:"token"`
+    Password string `json:"password"`
+  }
+
+  var resetRequest ResetRequest
+
+  err := json.Unmarshal([]byte(request.Body), &resetRequest)
+
+  if err != nil || resetRequest.Token == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  invalidToken := events.APIGatewayProxyResponse{
+    Body: "Invalid or expired reset token",
+    StatusCode: http.StatusBadRequest,
+  }
+
+  issuer := api.tokenHandler.tokenIssuer
+
+  claims, err := types.ParseToken(resetRequest.Token, types.TokenUsePasswordReset, issuer.keyProvider, issuer.tokenConfig)
+  if err != nil {
+    return invalidToken, nil
+  }
+
+  username := claims.Subject
+
+  user, err := api.userStore.GetUser(username)
+
+  if errors.Is(err, database.ErrUserNotFound) {
+    return invalidToken, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // a token sent to an account that was deleted must not reset the password of someone who registered
+  // the name again, and one sent before the password last changed went out for a password that is gone
+  if issuedBefore(claims.IssuedAt.Time, user.CreatedAt) || issuedBefore(claims.IssuedAt.Time, user.PasswordChangedAt) {
+    return invalidToken, nil
+  }
+
+  // checked before the token is spent so a rejected password can be retried
+  violations := api.passwordPolicy.Validate(username, resetRequest.Password)
+  if len(violations) > 0 {
+    return violationsResponse(violations)
+  }
+
+  reset, err := api.passwordResetStore.ConsumePasswordReset(types.HashToken(resetRequest.Token), time.Now())
+
+  if errors.Is(err, database.ErrPasswordResetInvalid) {
+    return invalidToken, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if reset.Username != username {
+    return invalidToken, nil
+  }
+
+  updated, err := types.NewUser(types.RegisterUser{
+    Username: username,
+    Password: resetRequest.Password,
+  }, api.passwordHasher)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.userStore.UpdatePassword(username, updated.PasswordHash, time.Now())
+
+  if errors.Is(err, database.ErrUserNotFound) {
+    return invalidToken, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.tokenHandler.revokeSessions(username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // the owner proved control of the account, a lockout left by someone guessing shouldn't keep them out
+  err = api.loginAttemptStore.ResetLoginAttempts(userLoginAttemptID(username))
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: "Password has been reset",
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// needs the current password as well as the token. Every session, this one included, is ended
+// and the caller gets a fresh pair back so only they stay signed in
+func (api PasswordHandler) ChangePasswordHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  type ChangeRequest struct {
+    CurrentPassword string `json:"current-password"`
+    NewPassword string `json:"new-password"`
+  }
+
+  var changeRequest ChangeRequest
+
+  err := json.Unmarshal([]byte(request.Body), &changeRequest)
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  user, err := api.userStore.GetUser(principal.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // users who signed up through an oidc provider have no password to give, their first one is set
+  // without it. Deleting the account needs one, so this is also how they get there
+  initialPassword := user.PasswordHash == ""
+
+  if !initialPassword {
+    if changeRequest.CurrentPassword == "" {
+      return events.APIGatewayProxyResponse{
+        Body: "Invalid Request",
+        StatusCode: http.StatusBadRequest,
+      }, nil
+    }
+
+    response, err := checkCurrentPassword(api.loginAttemptStore, api.passwordHasher, user, changeRequest.CurrentPassword, "Current password is incorrect")
+    if response != nil {
+      return *response, err
+    }
+  }
+
+  violations := api.passwordPolicy.Validate(user.Username, changeRequest.NewPassword)
+  if len(violations) > 0 {
+    return violationsResponse(violations)
+  }
+
+  updated, err := types.NewUser(types.RegisterUser{
+    Username: user.Username,
+    Password: changeRequest.NewPassword,
+  }, api.passwordHasher)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if initialPassword {
+    err = api.userStore.SetInitialPassword(user.Username, updated.PasswordHash, time.Now())
+  } else {
+    err = api.userStore.UpdatePassword(user.Username, updated.PasswordHash, time.Now())
+  }
+
+  // one was set since GetUser, it has to be given like any other
+  if errors.Is(err, database.ErrPasswordAlreadySet) {
+    return events.APIGatewayProxyResponse{
+      Body: "Current password is incorrect",
+      StatusCode: http.StatusForbidden,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  err = api.tokenHandler.revokeSessions(user.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  tokens, err := api.tokenHandler.tokenIssuer.IssueTokens(user, "")
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  responseBody, err := json.Marshal(tokens)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: string(responseBody),
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// whether a token issued at issuedAt predates the stored timestamp, false when none was stored
+func issuedBefore(issuedAt time.Time, timestamp string) bool {
+  t, err := time.Parse(time.RFC3339, timestamp)
+  return err == nil && issuedAt.Before(t)
+}
+
+func (api PasswordHandler) resetLink(token string) string {
+  if api.resetURL == "" {
+    return token
+  }
+
+  return api.resetURL + "?token=" + url.QueryEscape(token)
+}
+
+// sleeps out whatever is left of duration since start. A request that took longer is logged,
+// its timing can then tell it apart again
+func padResponse(start time.Time, duration time.Duration) {
+  elapsed := time.Since(start)
+  if elapsed > duration {
+    log.Printf("request took %v, longer than the %v it is padded to", elapsed, duration)
+    return
+  }
+
+  time.Sleep(duration - elapsed)
+}
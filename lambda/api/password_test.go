@@ -0,0 +1,195 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"lambda-func/middleware"
+	"lambda-func/types"
+)
+
+// the request the auth middleware hands a handler for username
+func authenticatedRequest(username string, body string) events.APIGatewayProxyRequest {
+  request := events.APIGatewayProxyRequest{Body: body}
+  request.RequestContext.Authorizer = middleware.PrincipalContext(types.Principal{Username: username, TokenID: "token-1"})
+  return request
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+  const oldPassword = "correct horse battery"
+  const newPassword = "another long passphrase"
+
+  tests := []struct {
+    name string
+    // empty for a user who signed up through an oidc provider
+    storedPassword string
+    body string
+    wantStatus int
+    wantChanged bool
+  }{
+    {"with the current password", oldPassword, `{"current-password": "` + oldPassword + `", "new-password": "` + newPassword + `"}`, http.StatusOK, true},
+    {"wrong current password", oldPassword, `{"current-password": "wrong password here", "new-password": "` + newPassword + `"}`, http.StatusForbidden, false},
+    {"current password left out", oldPassword, `{"new-password": "` + newPassword + `"}`, http.StatusBadRequest, false},
+    {"first password of an oidc user", "", `{"new-password": "` + newPassword + `"}`, http.StatusOK, true},
+    {"first password still has to follow the policy", "", `{"new-password": "short"}`, http.StatusUnprocessableEntity, false},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      h := newTestHandlers(t)
+
+      user := types.NewExternalUser("alice", "")
+      if tt.storedPassword != "" {
+        user = testUser(t, h.passwordHasher, "alice", tt.storedPassword)
+      }
+      h.userStore.users["alice"] = user
+
+      api := NewPasswordHandler(h.userStore, nil, h.loginAttemptStore, h.tokenHandler, h.passwordPolicy, h.passwordHasher, nil, "")
+
+      response, err := api.ChangePasswordHandler(authenticatedRequest("alice", tt.body))
+      if err != nil {
+        t.Fatalf("ChangePasswordHandler() error = %v", err)
+      }
+
+      if response.StatusCode != tt.wantStatus {
+        t.Fatalf("ChangePasswordHandler() status = %d %q, want %d", response.StatusCode, response.Body, tt.wantStatus)
+      }
+
+      changed := h.userStore.users["alice"].PasswordHash != user.PasswordHash
+      if changed != tt.wantChanged {
+        t.Fatalf("password changed = %v, want %v", changed, tt.wantChanged)
+      }
+
+      if changed {
+        if !passwordMatches(h.passwordHasher, h.userStore.users["alice"].PasswordHash, newPassword) {
+          t.Errorf("stored hash doesn't match the new password")
+        }
+
+        if _, ok := h.revocationStore.revokedBefore["alice"]; !ok {
+          t.Errorf("sessions weren't revoked")
+        }
+      }
+    })
+  }
+}
+
+func TestDeleteAccountWithoutPassword(t *testing.T) {
+  h := newTestHandlers(t, types.NewExternalUser("alice", ""))
+  api := NewAccountHandler(h.userStore, nil, nil, h.loginAttemptStore, h.tokenHandler, h.passwordHasher)
+
+  response, err := api.DeleteAccountHandler(authenticatedRequest("alice", `{}`))
+  if err != nil {
+    t.Fatalf("DeleteAccountHandler() error = %v", err)
+  }
+
+  // pointed at setting a password rather than told the request is malformed
+  if response.StatusCode != http.StatusForbidden {
+    t.Fatalf("DeleteAccountHandler() status = %d %q, want %d", response.StatusCode, response.Body, http.StatusForbidden)
+  }
+
+  if _, ok := h.userStore.users["alice"]; !ok {
+    t.Errorf("account was deleted")
+  }
+}
+
+func TestResetPasswordHandler(t *testing.T) {
+  const newPassword = "another long passphrase"
+
+  tests := []struct {
+    name string
+    // changes the stored user after the token went out
+    afterIssue func(user *types.User)
+    wantStatus int
+  }{
+    {"fresh token", func(user *types.User) {}, http.StatusOK},
+    {"account deleted and the name registered again", func(user *types.User) {
+      user.CreatedAt = time.Now().Add(time.Second).UTC().Format(time.RFC3339)
+    }, http.StatusBadRequest},
+    {"password changed since", func(user *types.User) {
+      user.PasswordChangedAt = time.Now().UTC().Format(time.RFC3339Nano)
+    }, http.StatusBadRequest},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      h := newTestHandlers(t)
+      user := testUser(t, h.passwordHasher, "alice", "correct horse battery")
+      user.CreatedAt = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+      resetStore := newFakePasswordResetStore()
+      api := NewPasswordHandler(h.userStore, resetStore, h.loginAttemptStore, h.tokenHandler, h.passwordPolicy, h.passwordHasher, nil, "")
+      token := resetToken(t, h, resetStore, user)
+
+      tt.afterIssue(&user)
+      h.userStore.users["alice"] = user
+
+      response, err := api.ResetPasswordHandler(events.APIGatewayProxyRequest{Body: resetBody(token, newPassword)})
+      if err != nil {
+        t.Fatalf("ResetPasswordHandler() error = %v", err)
+      }
+
+      if response.StatusCode != tt.wantStatus {
+        t.Fatalf("ResetPasswordHandler() status = %d %q, want %d", response.StatusCode, response.Body, tt.wantStatus)
+      }
+
+      changed := h.userStore.users["alice"].PasswordHash != user.PasswordHash
+      if changed != (tt.wantStatus == http.StatusOK) {
+        t.Fatalf("password changed = %v", changed)
+      }
+    })
+  }
+}
+
+// every reset link sent before a password change stops working, whichever way it changed
+func TestResetTokensDieWithThePassword(t *testing.T) {
+  h := newTestHandlers(t)
+  user := testUser(t, h.passwordHasher, "alice", "correct horse battery")
+  user.CreatedAt = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+  h.userStore.users["alice"] = user
+
+  resetStore := newFakePasswordResetStore()
+  api := NewPasswordHandler(h.userStore, resetStore, h.loginAttemptStore, h.tokenHandler, h.passwordPolicy, h.passwordHasher, nil, "")
+
+  first := resetToken(t, h, resetStore, user)
+  second := resetToken(t, h, resetStore, user)
+  third := resetToken(t, h, resetStore, user)
+
+  response, _ := api.ResetPasswordHandler(events.APIGatewayProxyRequest{Body: resetBody(first, "another long passphrase")})
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("first reset = %d %q, want %d", response.StatusCode, response.Body, http.StatusOK)
+  }
+
+  response, _ = api.ResetPasswordHandler(events.APIGatewayProxyRequest{Body: resetBody(second, "a third long passphrase")})
+  if response.StatusCode != http.StatusBadRequest {
+    t.Fatalf("reset with a link from before the last reset = %d, want %d", response.StatusCode, http.StatusBadRequest)
+  }
+
+  response, _ = api.ChangePasswordHandler(authenticatedRequest("alice", `{"current-password": "another long passphrase", "new-password": "a third long passphrase"}`))
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("change password = %d %q, want %d", response.StatusCode, response.Body, http.StatusOK)
+  }
+
+  response, _ = api.ResetPasswordHandler(events.APIGatewayProxyRequest{Body: resetBody(third, "a fourth long passphrase")})
+  if response.StatusCode != http.StatusBadRequest {
+    t.Fatalf("reset with a link from before a password change = %d, want %d", response.StatusCode, http.StatusBadRequest)
+  }
+}
+
+// a reset token for user, stored the way ForgotPasswordHandler stores it
+func resetToken(t *testing.T, h testHandlers, resetStore *fakePasswordResetStore, user types.User) string {
+  t.Helper()
+
+  token, err := types.CreatePasswordResetToken(user, h.tokenIssuer.keyProvider, h.tokenIssuer.tokenConfig)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  resetStore.InsertPasswordReset(types.NewPasswordReset(token, user.Username, types.PASSWORD_RESET_TOKEN_TTL))
+  return token
+}
+
+func resetBody(token string, password string) string {
+  return `{"token": "` + token + `", "password": "` + password + `"}`
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"lambda-func/database"
+	"lambda-func/identity"
+	"lambda-func/keys"
+	"lambda-func/middleware"
+	"lambda-func/types"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+const REFRESH_TOKEN_TTL = time.Hour * 24 * 30
+
+// TokenIssuer hands out the access and refresh token pair for a user
+type TokenIssuer struct {
+  refreshTokenStore database.RefreshTokenStore
+  keyProvider keys.KeyProvider
+  tokenConfig types.TokenConfig
+}
+
+func NewTokenIssuer(refreshTokenStore database.RefreshTokenStore, keyProvider keys.KeyProvider, tokenConfig types.TokenConfig) TokenIssuer {
+  return TokenIssuer{
+    refreshTokenStore: refreshTokenStore,
+    keyProvider: keyProvider,
+    tokenConfig: tokenConfig,
+  }
+}
+
+// an empty familyID starts a new family, as on login
+func (i TokenIssuer) IssueTokens(user types.User, familyID string) (types.TokenResponse, error) {
+  accessToken, err := types.CreateToken(user, i.keyProvider, i.tokenConfig)
+  if err != nil {
+    return types.TokenResponse{}, err
+  }
+
+  if familyID == "" {
+    familyID = uuid.NewString()
+  }
+
+  plainRefreshToken, refreshToken, err := types.NewRefreshToken(user.Username, familyID, REFRESH_TOKEN_TTL)
+  if err != nil {
+    return types.TokenResponse{}, err
+  }
+
+  err = i.refreshTokenStore.InsertRefreshToken(refreshToken)
+  if err != nil {
+    return types.TokenResponse{}, err
+  }
+
+  return types.TokenResponse{
+    AccessToken: accessToken,
+    RefreshToken: plainRefreshToken,
+  }, nil
+}
+
+type TokenHandler struct {
+  userStore database.UserStore
+  refreshTokenStore database.RefreshTokenStore
+  revocationStore database.RevocationStore
+  apiKeyStore database.APIKeyStore
+  tokenIssuer TokenIssuer
+}
+
+func NewTokenHandler(userStore database.UserStore, refreshTokenStore database.RefreshTokenStore, revocationStore database.RevocationStore, apiKeyStore database.APIKeyStore, tokenIssuer TokenIssuer) TokenHandler {
+  return TokenHandler{
+    userStore: userStore,
+    refreshTokenStore: refreshTokenStore,
+    revocationStore: revocationStore,
+    apiKeyStore: apiKeyStore,
+    tokenIssuer: tokenIssuer,
+  }
+}
+
+// every refresh token can be used once, using it returns a new pair and retires it.
+// Seeing a used token again means it was stolen or replayed, so the whole family is revoked
+// and both the thief and the real user have to log in again
+func (api TokenHandler) RefreshTokenHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  type RefreshRequest struct {
+    RefreshToken string `json:"refresh-token"`
+  }
+
+  var refreshRequest RefreshRequest
+
+  err := json.Unmarshal([]byte(request.Body), &refreshRequest)
+
+  if err != nil || refreshRequest.RefreshToken == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  tokenHash := types.HashToken(refreshRequest.RefreshToken)
+
+  refreshToken, err := api.refreshTokenStore.GetRefreshToken(tokenHash)
+
+  if errors.Is(err, database.ErrRefreshTokenNotFound) {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid refresh token",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if refreshToken.Revoked || refreshToken.IsExpired() {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid refresh token",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  if refreshToken.UsedAt == "" {
+    err = api.refreshTokenStore.MarkRefreshTokenUsed(tokenHash, time.Now())
+  } else {
+    err = database.ErrRefreshTokenReused
+  }
+
+  if errors.Is(err, database.ErrRefreshTokenReused) {
+    err = api.refreshTokenStore.RevokeRefreshTokenFamily(refreshToken.FamilyID)
+    if err != nil {
+      return events.APIGatewayProxyResponse{
+        Body: "Internal Server Error",
+        StatusCode: http.StatusInternalServerError,
+      }, err
+    }
+
+    return events.APIGatewayProxyResponse{
+      Body: "Refresh token reuse detected",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // the account may have been removed since the token was issued
+  user, err := api.userStore.GetUser(refreshToken.Username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid refresh token",
+      StatusCode: http.StatusUnauthorized,
+    }, err
+  }
+
+  tokens, err := api.tokenIssuer.IssueTokens(user, refreshToken.FamilyID)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  responseBody, err := json.Marshal(tokens)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      StatusCode: http.StatusInternalServerError,
+      Body:       "Failed to serialize response",
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    StatusCode: http.StatusOK,
+    Body:       string(responseBody),
+  }, nil
+}
+
+// revokes the access token the request was made with, and the refresh token family when one is sent
+func (api TokenHandler) LogoutHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, ok := middleware.GetPrincipal(request)
+  if !ok {
+    return events.APIGatewayProxyResponse{
+      Body: "User unauthorized",
+      StatusCode: http.StatusUnauthorized,
+    }, nil
+  }
+
+  type LogoutRequest struct {
+    RefreshToken string `json:"refresh-token"`
+  }
+
+  var logoutRequest LogoutRequest
+
+  // the body is optional
+  if request.Body != "" {
+    err := json.Unmarshal([]byte(request.Body), &logoutRequest)
+    if err != nil {
+      return events.APIGatewayProxyResponse{
+        Body: "Invalid Request",
+        StatusCode: http.StatusBadRequest,
+      }, nil
+    }
+  }
+
+  // the revocation only has to outlive the token
+  err := api.revocationStore.RevokeToken(principal.TokenID, principal.ExpiresAt)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if logoutRequest.RefreshToken != "" {
+    refreshToken, err := api.refreshTokenStore.GetRefreshToken(types.HashToken(logoutRequest.RefreshToken))
+
+    if err != nil && !errors.Is(err, database.ErrRefreshTokenNotFound) {
+      return events.APIGatewayProxyResponse{
+        Body: "Internal Server Error",
+        StatusCode: http.StatusInternalServerError,
+      }, err
+    }
+
+    // never let one user revoke another user's tokens
+    if err == nil && refreshToken.Username == principal.Username {
+      err = api.refreshTokenStore.RevokeRefreshTokenFamily(refreshToken.FamilyID)
+      if err != nil {
+        return events.APIGatewayProxyResponse{
+          Body: "Internal Server Error",
+          StatusCode: http.StatusInternalServerError,
+        }, err
+      }
+    }
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: "Successfully Logged Out",
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// admin only, signs the user out everywhere and deletes their api keys
+func (api TokenHandler) RevokeUserSessionsHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  username := request.PathParameters["username"]
+
+  if username == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  err := api.revokeSessions(username)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: "Successfully Revoked Sessions",
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// every token issued before now is rejected, the marker can go once the newest of them has expired.
+// With cognito that is an id token, which can outlive our own access tokens.
+// Api keys go too, whoever held a stolen token could have created one that outlives every other credential
+func (api TokenHandler) revokeSessions(username string) error {
+  now := time.Now()
+
+  err := api.revocationStore.RevokeUserTokens(username, now, now.Add(identity.MaxTokenTTL(api.tokenIssuer.tokenConfig)))
+  if err != nil {
+    return err
+  }
+
+  err = api.refreshTokenStore.RevokeUserRefreshTokens(username)
+  if err != nil {
+    return err
+  }
+
+  return api.apiKeyStore.DeleteUserAPIKeys(username)
+}
+
+// public keys for verifying our access tokens, retired keys stay listed until they are dropped
+// so tokens signed before a rotation still verify. Caches keep them for 5 minutes, the same
+// window the lambdas take to pick up a rotated key set
+func (api TokenHandler) JWKSHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  keySet, err := api.tokenIssuer.keyProvider.KeySet()
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  jwks, err := keySet.JWKS()
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  responseBody, err := json.Marshal(jwks)
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Failed to serialize response",
+      StatusCode: http.StatusInternalServerError,
+    }, nil
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: string(responseBody),
+    StatusCode: http.StatusOK,
+    Headers: map[string]string{
+      "Content-Type": "application/json",
+      "Cache-Control": "public, max-age=300",
+    },
+  }, nil
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"lambda-func/identity"
+	"lambda-func/types"
+)
+
+// sends refreshToken to /token/refresh, returns the status and the new pair when there is one
+func refresh(t *testing.T, h testHandlers, refreshToken string) (int, types.TokenResponse) {
+  t.Helper()
+
+  response, err := h.tokenHandler.RefreshTokenHandler(events.APIGatewayProxyRequest{Body: `{"refresh-token": "` + refreshToken + `"}`})
+  if err != nil {
+    t.Fatalf("RefreshTokenHandler() error = %v", err)
+  }
+
+  var tokens types.TokenResponse
+  if response.StatusCode == http.StatusOK {
+    json.Unmarshal([]byte(response.Body), &tokens)
+  }
+
+  return response.StatusCode, tokens
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+  h := newTestHandlers(t)
+  alice := testUser(t, h.passwordHasher, "alice", "correct horse battery")
+  h.userStore.users["alice"] = alice
+
+  // two logins, on two devices
+  stolen, err := h.tokenIssuer.IssueTokens(alice, "")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  otherDevice, err := h.tokenIssuer.IssueTokens(alice, "")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  status, rotated := refresh(t, h, stolen.RefreshToken)
+  if status != http.StatusOK || rotated.RefreshToken == "" || rotated.RefreshToken == stolen.RefreshToken {
+    t.Fatalf("first refresh = %d %+v, want %d and a new refresh token", status, rotated, http.StatusOK)
+  }
+
+  family := h.refreshTokenStore.tokens[types.HashToken(stolen.RefreshToken)].FamilyID
+  if h.refreshTokenStore.tokens[types.HashToken(rotated.RefreshToken)].FamilyID != family {
+    t.Fatalf("rotated refresh token left its family")
+  }
+
+  // the retired token comes back, whoever holds it and the new one can't tell which is the thief
+  if status, _ := refresh(t, h, stolen.RefreshToken); status != http.StatusUnauthorized {
+    t.Fatalf("reused refresh token = %d, want %d", status, http.StatusUnauthorized)
+  }
+
+  for _, token := range h.refreshTokenStore.tokens {
+    if token.FamilyID == family && !token.Revoked {
+      t.Errorf("refresh token %s of the reused family is still valid", token.TokenHash)
+    }
+  }
+
+  if status, _ := refresh(t, h, rotated.RefreshToken); status != http.StatusUnauthorized {
+    t.Errorf("refresh token rotated from the reused one = %d, want %d", status, http.StatusUnauthorized)
+  }
+
+  // another login's family is not affected
+  if status, _ := refresh(t, h, otherDevice.RefreshToken); status != http.StatusOK {
+    t.Errorf("refresh on the other device = %d, want %d", status, http.StatusOK)
+  }
+}
+
+func TestRefreshTokenRejected(t *testing.T) {
+  tests := []struct {
+    name string
+    // changes the stored token before it is sent
+    change func(token *types.RefreshToken)
+  }{
+    {"revoked", func(token *types.RefreshToken) { token.Revoked = true }},
+    {"expired", func(token *types.RefreshToken) { token.ExpiresAt = 1 }},
+    {"unknown", nil},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      h := newTestHandlers(t)
+      alice := testUser(t, h.passwordHasher, "alice", "correct horse battery")
+      h.userStore.users["alice"] = alice
+
+      tokens, err := h.tokenIssuer.IssueTokens(alice, "")
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      hash := types.HashToken(tokens.RefreshToken)
+      if tt.change == nil {
+        delete(h.refreshTokenStore.tokens, hash)
+      } else {
+        token := h.refreshTokenStore.tokens[hash]
+        tt.change(&token)
+        h.refreshTokenStore.tokens[hash] = token
+      }
+
+      if status, _ := refresh(t, h, tokens.RefreshToken); status != http.StatusUnauthorized {
+        t.Errorf("refresh = %d, want %d", status, http.StatusUnauthorized)
+      }
+    })
+  }
+}
+
+// the revoke-all has to outlast every token it covers, with cognito those are id tokens of up to a day
+func TestRevokeSessionsLastsAsLongAsTheLongestToken(t *testing.T) {
+  tests := []struct {
+    backend string
+    wantTTL time.Duration
+  }{
+    {identity.BACKEND_LOCAL, types.NewTokenConfig().TTL},
+    {identity.BACKEND_COGNITO, identity.COGNITO_MAX_ID_TOKEN_TTL},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.backend, func(t *testing.T) {
+      t.Setenv("IDENTITY_BACKEND", tt.backend)
+      h := newTestHandlers(t)
+
+      response, err := h.tokenHandler.RevokeUserSessionsHandler(events.APIGatewayProxyRequest{PathParameters: map[string]string{"username": "alice"}})
+      if err != nil || response.StatusCode != http.StatusOK {
+        t.Fatalf("RevokeUserSessionsHandler() = %d, %v", response.StatusCode, err)
+      }
+
+      ttl := h.revocationStore.revokedUntil["alice"].Sub(h.revocationStore.revokedBefore["alice"])
+      if ttl != tt.wantTTL {
+        t.Errorf("revoke-all kept for %v, want %v", ttl, tt.wantTTL)
+      }
+    })
+  }
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lambda-func/database"
+	"lambda-func/notify"
+	"lambda-func/policy"
+	"lambda-func/types"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// how often a pending user can ask for the verification email again
+const VERIFICATION_RESEND_INTERVAL = time.Minute * 1
+
+type EmailVerificationHandler struct {
+  userStore database.UserStore
+  tokenIssuer TokenIssuer
+  notifier notify.Notifier
+  // page the emailed link points at, the token is added as ?token=. Empty sends the bare token
+  verificationURL string
+}
+
+func NewEmailVerificationHandler(userStore database.UserStore, tokenIssuer TokenIssuer, notifier notify.Notifier, verificationURL string) EmailVerificationHandler {
+  return EmailVerificationHandler{
+    userStore: userStore,
+    tokenIssuer: tokenIssuer,
+    notifier: notifier,
+    verificationURL: verificationURL,
+  }
+}
+
+// GET /verify-email?token= is what the emailed link opens, so the token comes in the query string.
+// Using it twice is harmless, the account is just active again
+func (api EmailVerificationHandler) VerifyEmailHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  token := request.QueryStringParameters["token"]
+
+  if token == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  invalidToken := events.APIGatewayProxyResponse{
+    Body: "Invalid or expired verification link",
+    StatusCode: http.StatusBadRequest,
+  }
+
+  claims, err := types.ParseToken(token, types.TokenUseEmailVerify, api.tokenIssuer.keyProvider, api.tokenIssuer.tokenConfig)
+  if err != nil {
+    return invalidToken, nil
+  }
+
+  user, err := api.userStore.GetUser(claims.Subject)
+
+  if errors.Is(err, database.ErrUserNotFound) {
+    return invalidToken, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // a link sent to an account that was deleted must not verify someone who registered the name again
+  createdAt, err := time.Parse(time.RFC3339, user.CreatedAt)
+  if err == nil && claims.IssuedAt.Time.Before(createdAt) {
+    return invalidToken, nil
+  }
+
+  if user.IsPendingVerification() {
+    err = api.userStore.VerifyEmail(user.Username)
+
+    if errors.Is(err, database.ErrUserNotFound) {
+      return invalidToken, nil
+    }
+
+    if err != nil {
+      return events.APIGatewayProxyResponse{
+        Body: "Internal Server Error",
+        StatusCode: http.StatusInternalServerError,
+      }, err
+    }
+  }
+
+  return events.APIGatewayProxyResponse{
+    Body: "Email verified",
+    StatusCode: http.StatusOK,
+  }, nil
+}
+
+// always answers 202 so the endpoint can't be used to find out which usernames exist or are pending
+func (api EmailVerificationHandler) ResendVerificationHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  type ResendRequest struct {
+    Username string `json:"username"`
+  }
+
+  var resendRequest ResendRequest
+
+  err := json.Unmarshal([]byte(request.Body), &resendRequest)
+
+  if err != nil || resendRequest.Username == "" {
+    return events.APIGatewayProxyResponse{
+      Body: "Invalid Request",
+      StatusCode: http.StatusBadRequest,
+    }, nil
+  }
+
+  accepted := events.APIGatewayProxyResponse{
+    Body: "If the account is waiting for verification, a new link has been sent",
+    StatusCode: http.StatusAccepted,
+  }
+
+  user, err := api.userStore.GetUser(policy.NormalizeUsername(resendRequest.Username))
+
+  if errors.Is(err, database.ErrUserNotFound) {
+    return accepted, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  if !user.IsPendingVerification() || user.Email == "" {
+    return accepted, nil
+  }
+
+  // recorded before sending, so two quick requests can't both get through
+  err = api.userStore.MarkVerificationSent(user.Username, time.Now(), VERIFICATION_RESEND_INTERVAL)
+
+  if errors.Is(err, database.ErrVerificationSentRecently) {
+    return accepted, nil
+  }
+
+  if err != nil {
+    return events.APIGatewayProxyResponse{
+      Body: "Internal Server Error",
+      StatusCode: http.StatusInternalServerError,
+    }, err
+  }
+
+  // a failed send still answers 202, the error is only logged
+  return accepted, api.sendVerification(user)
+}
+
+func (api EmailVerificationHandler) sendVerification(user types.User) error {
+  token, err := types.CreateEmailVerificationToken(user, api.tokenIssuer.keyProvider, api.tokenIssuer.tokenConfig)
+  if err != nil {
+    return err
+  }
+
+  return api.notifier.Send(notify.Message{
+    To: user.Email,
+    Subject: "Verify your email address",
+    Body: fmt.Sprintf("Welcome %s. Use this within the next day to verify your email address and finish setting up your account:\n\n%s\n\nIf you didn't register, you can ignore this email.", user.Username, api.verificationLink(token)),
+  })
+}
+
+func (api EmailVerificationHandler) verificationLink(token string) string {
+  if api.verificationURL == "" {
+    return token
+  }
+
+  return api.verificationURL + "?token=" + url.QueryEscape(token)
+}
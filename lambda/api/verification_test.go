@@ -0,0 +1,157 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"lambda-func/types"
+)
+
+// the bare token from a verification email, sent without a verification url
+func emailedToken(t *testing.T, notifier *fakeNotifier) string {
+  t.Helper()
+
+  if len(notifier.messages) == 0 {
+    t.Fatal("no email was sent")
+  }
+
+  parts := strings.Split(notifier.messages[len(notifier.messages) - 1].Body, "\n\n")
+  if len(parts) < 2 {
+    t.Fatalf("no token in %q", notifier.messages[len(notifier.messages) - 1].Body)
+  }
+
+  return parts[1]
+}
+
+func TestRegisterReclaimsStalePendingName(t *testing.T) {
+  stale := time.Now().Add(-types.EMAIL_VERIFICATION_TOKEN_TTL - time.Hour).UTC().Format(time.RFC3339)
+  fresh := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+  tests := []struct {
+    name string
+    // what already holds the name, nil for nobody
+    existing func(user *types.User)
+    wantStatus int
+  }{
+    {"free name", nil, http.StatusOK},
+    {"pending past its first link", func(user *types.User) {
+      user.Status = types.UserStatusPendingVerification
+      user.CreatedAt = stale
+    }, http.StatusOK},
+    {"pending within its first link", func(user *types.User) {
+      user.Status = types.UserStatusPendingVerification
+      user.CreatedAt = fresh
+    }, http.StatusConflict},
+    // an unknown age never counts as stale
+    {"pending without created_at", func(user *types.User) {
+      user.Status = types.UserStatusPendingVerification
+      user.CreatedAt = ""
+    }, http.StatusConflict},
+    {"verified long ago", func(user *types.User) {
+      user.CreatedAt = stale
+    }, http.StatusConflict},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      h := newTestHandlers(t)
+
+      var squatter types.User
+      if tt.existing != nil {
+        squatter = testUser(t, h.passwordHasher, "alice", "squatters passphrase")
+        squatter.Email = "squatter@example.com"
+        tt.existing(&squatter)
+        h.userStore.users["alice"] = squatter
+      }
+
+      notifier := &fakeNotifier{}
+      verification := NewEmailVerificationHandler(h.userStore, h.tokenIssuer, notifier, "")
+      api := NewUserHandler(h.userStore, h.loginAttemptStore, h.tokenIssuer, h.passwordPolicy, h.passwordHasher, verification)
+
+      response, err := api.RegisterUserHandler(events.APIGatewayProxyRequest{Body: `{"username": "alice", "password": "correct horse battery", "email": "alice@example.com"}`})
+      if err != nil {
+        t.Fatalf("RegisterUserHandler() error = %v", err)
+      }
+
+      if response.StatusCode != tt.wantStatus {
+        t.Fatalf("RegisterUserHandler() status = %d %q, want %d", response.StatusCode, response.Body, tt.wantStatus)
+      }
+
+      stored := h.userStore.users["alice"]
+      if tt.wantStatus != http.StatusOK {
+        if stored.Email != squatter.Email || stored.PasswordHash != squatter.PasswordHash || len(notifier.messages) != 0 {
+          t.Errorf("the existing account was touched")
+        }
+        return
+      }
+
+      if stored.Email != "alice@example.com" || !stored.IsPendingVerification() || !passwordMatches(h.passwordHasher, stored.PasswordHash, "correct horse battery") {
+        t.Errorf("stored user = %+v, want alice's new pending account", stored)
+      }
+
+      if len(notifier.messages) != 1 || notifier.messages[0].To != "alice@example.com" {
+        t.Errorf("verification sent to %+v, want alice@example.com", notifier.messages)
+      }
+    })
+  }
+}
+
+func TestVerifyEmailHandler(t *testing.T) {
+  h := newTestHandlers(t)
+  notifier := &fakeNotifier{}
+  verification := NewEmailVerificationHandler(h.userStore, h.tokenIssuer, notifier, "")
+  api := NewUserHandler(h.userStore, h.loginAttemptStore, h.tokenIssuer, h.passwordPolicy, h.passwordHasher, verification)
+
+  verify := func(token string) int {
+    response, err := verification.VerifyEmailHandler(events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{"token": token}})
+    if err != nil {
+      t.Fatalf("VerifyEmailHandler() error = %v", err)
+    }
+
+    return response.StatusCode
+  }
+
+  response, _ := api.RegisterUserHandler(events.APIGatewayProxyRequest{Body: `{"username": "alice", "password": "correct horse battery", "email": "alice@example.com"}`})
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("register = %d %q", response.StatusCode, response.Body)
+  }
+  oldLink := emailedToken(t, notifier)
+
+  // the account goes away and the name is registered again by someone else, created after the
+  // link above was issued. The first owner's link must not verify the new address
+  user := h.userStore.users["alice"]
+  user.Email = "someone-else@example.com"
+  user.CreatedAt = time.Now().Add(time.Second).UTC().Format(time.RFC3339)
+  h.userStore.users["alice"] = user
+
+  if status := verify(oldLink); status != http.StatusBadRequest {
+    t.Fatalf("link issued before the account = %d, want %d", status, http.StatusBadRequest)
+  }
+
+  if !h.userStore.users["alice"].IsPendingVerification() {
+    t.Fatalf("link issued before the account verified it")
+  }
+
+  // the new owner's own link, issued once their account exists
+  user.CreatedAt = time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+  h.userStore.users["alice"] = user
+
+  if err := verification.sendVerification(user); err != nil {
+    t.Fatal(err)
+  }
+
+  if status := verify(emailedToken(t, notifier)); status != http.StatusOK {
+    t.Fatalf("own link = %d, want %d", status, http.StatusOK)
+  }
+
+  if h.userStore.users["alice"].IsPendingVerification() {
+    t.Errorf("account still pending after verifying")
+  }
+
+  if status := verify("not-a-token"); status != http.StatusBadRequest {
+    t.Errorf("garbage token = %d, want %d", status, http.StatusBadRequest)
+  }
+}
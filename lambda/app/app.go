@@ -1,22 +1,82 @@
 package app
 
 import (
+  "log"
+  "os"
   "lambda-func/api"
   "lambda-func/database"
+  "lambda-func/hasher"
+  "lambda-func/identity"
+  "lambda-func/keys"
+  "lambda-func/middleware"
+  "lambda-func/notify"
+  "lambda-func/oidc"
+  "lambda-func/policy"
+  "lambda-func/types"
 )
 
 type App struct {
   UserHandler api.UserHandler
   BlogHandler api.BlogHandler
+  TokenHandler api.TokenHandler
+  PasswordHandler api.PasswordHandler
+  EmailVerificationHandler api.EmailVerificationHandler
+  AccountHandler api.AccountHandler
+  APIKeyHandler api.APIKeyHandler
+  OIDCHandler api.OIDCHandler
+  AuthMiddleware middleware.AuthMiddleware
+  // BACKEND_LOCAL or BACKEND_COGNITO, with cognito the user pool owns accounts and sign in
+  IdentityBackend string
 }
 
 func NewApp() App {
+  passwordPolicy, err := policy.NewPasswordPolicy()
+  if err != nil {
+    log.Fatalf("failed to load password policy: %v", err)
+  }
+
+  passwordHasher, err := hasher.NewPasswordHasher()
+  if err != nil {
+    log.Fatalf("failed to configure password hashing: %v", err)
+  }
+
   db := database.NewDynamoDBClient()
-  userHandler := api.NewUserHandler(db.UserStore())
+  // created once so the cached secret is shared by signing and verifying
+  keyProvider := keys.NewKeyProvider()
+  tokenConfig := types.NewTokenConfig()
+  tokenIssuer := api.NewTokenIssuer(db.RefreshTokenStore(), keyProvider, tokenConfig)
+  emailVerificationHandler := api.NewEmailVerificationHandler(db.UserStore(), tokenIssuer, notify.NewNotifier(), os.Getenv("EMAIL_VERIFICATION_URL"))
+  userHandler := api.NewUserHandler(db.UserStore(), db.LoginAttemptStore(), tokenIssuer, passwordPolicy, passwordHasher, emailVerificationHandler)
   blogHandler := api.NewBlogHandler(db.BlogStore())
+  tokenHandler := api.NewTokenHandler(db.UserStore(), db.RefreshTokenStore(), db.RevocationStore(), db.APIKeyStore(), tokenIssuer)
+  passwordHandler := api.NewPasswordHandler(db.UserStore(), db.PasswordResetStore(), db.LoginAttemptStore(), tokenHandler, passwordPolicy, passwordHasher, notify.NewNotifier(), os.Getenv("PASSWORD_RESET_URL"))
+  accountHandler := api.NewAccountHandler(db.UserStore(), db.BlogStore(), db.IdentityLinkStore(), db.LoginAttemptStore(), tokenHandler, passwordHasher)
+  apiKeyHandler := api.NewAPIKeyHandler(db.APIKeyStore())
+  oidcProviders, err := oidc.NewProviders()
+  if err != nil {
+    log.Fatalf("failed to load oidc providers: %v", err)
+  }
+
+  oidcHandler := api.NewOIDCHandler(oidcProviders, db.OIDCStateStore(), db.IdentityLinkStore(), db.UserStore(), db.RevocationStore(), userHandler)
+  tokenVerifier, err := identity.NewTokenVerifier(keys.ProviderPublicKeys(keyProvider), tokenConfig)
+  if err != nil {
+    log.Fatalf("failed to configure token verification: %v", err)
+  }
+
+  // set by the stack on the function behind the lambda authorizer
+  trustAuthorizer := os.Getenv("TRUST_AUTHORIZER_CONTEXT") == "true"
+  authMiddleware := middleware.NewAuthMiddleware(tokenVerifier, db.RevocationStore(), db.UserStore(), db.APIKeyStore(), trustAuthorizer)
 
   return App {
     UserHandler: userHandler,
     BlogHandler: blogHandler,
+    TokenHandler: tokenHandler,
+    PasswordHandler: passwordHandler,
+    EmailVerificationHandler: emailVerificationHandler,
+    AccountHandler: accountHandler,
+    APIKeyHandler: apiKeyHandler,
+    OIDCHandler: oidcHandler,
+    AuthMiddleware: authMiddleware,
+    IdentityBackend: identity.Backend(),
   }
 }
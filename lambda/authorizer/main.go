@@ -0,0 +1,112 @@
+// the api gateway request authorizer, it runs the same checks as ValidateJWTOrAPIKeyMiddleware so bad
+// tokens are turned away before the main function starts. The principal it finds is passed on in the
+// request context authorizer map, where middleware.GetPrincipal reads it
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"lambda-func/database"
+	"lambda-func/identity"
+	"lambda-func/keys"
+	"lambda-func/middleware"
+	"lambda-func/types"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+type TokenAuthorizer struct {
+  authMiddleware middleware.AuthMiddleware
+  // api keys only exist with the local identity backend
+  allowAPIKey bool
+}
+
+// deployed, JWT_JWKS_URL points at the api's /.well-known/jwks.json and the authorizer never
+// sees the private keys. Without it (local runs) the public halves of JWT_SIGNING_KEYS are used
+func NewTokenAuthorizer() TokenAuthorizer {
+  db := database.NewDynamoDBClient()
+
+  publicKeys := keys.ProviderPublicKeys(keys.NewKeyProvider())
+  if jwksURL := os.Getenv("JWT_JWKS_URL"); jwksURL != "" {
+    publicKeys = keys.NewRemoteJWKS(jwksURL, &http.Client{Timeout: 5 * time.Second})
+  }
+
+  tokenVerifier, err := identity.NewTokenVerifier(publicKeys, types.NewTokenConfig())
+  if err != nil {
+    log.Fatalf("failed to configure token verification: %v", err)
+  }
+
+  return TokenAuthorizer{
+    authMiddleware: middleware.NewAuthMiddleware(tokenVerifier, db.RevocationStore(), db.UserStore(), db.APIKeyStore(), false),
+    allowAPIKey: identity.Backend() == identity.BACKEND_LOCAL,
+  }
+}
+
+// gets the headers of the request, so api keys can come as "Authorization: Bearer gck_..." or
+// X-API-Key like everywhere else. The policy allows the whole api rather than just the method
+// that was called, roles and scopes are still checked by the main function.
+// An "Unauthorized" error is what makes api gateway answer 401, anything else becomes a 500
+func (a TokenAuthorizer) Authorize(request events.APIGatewayCustomAuthorizerRequestTypeRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
+  principal, err := a.authMiddleware.AuthenticateHeaders(request.Headers, a.allowAPIKey)
+  if err != nil {
+    if isCredentialError(err) {
+      log.Printf("rejected %s: %v", request.MethodArn, err)
+      return events.APIGatewayCustomAuthorizerResponse{}, errors.New("Unauthorized")
+    }
+
+    log.Printf("failed to authorize %s: %v", request.MethodArn, err)
+    return events.APIGatewayCustomAuthorizerResponse{}, err
+  }
+
+  return events.APIGatewayCustomAuthorizerResponse{
+    PrincipalID: principal.Username,
+    PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+      Version: "2012-10-17",
+      Statement: []events.IAMPolicyStatement{
+        {
+          Action: []string{"execute-api:Invoke"},
+          Effect: "Allow",
+          Resource: []string{apiResource(request.MethodArn)},
+        },
+      },
+    },
+    Context: middleware.PrincipalContext(principal),
+  }, nil
+}
+
+func isCredentialError(err error) bool {
+  for _, credentialErr := range []error{
+    middleware.ErrMissingToken,
+    middleware.ErrTokenExpired,
+    middleware.ErrTokenRevoked,
+    middleware.ErrInvalidToken,
+    middleware.ErrInvalidAPIKey,
+    middleware.ErrAPIKeyExpired,
+  } {
+    if errors.Is(err, credentialErr) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// arn:aws:execute-api:region:account:api-id/stage/METHOD/path becomes arn:...:api-id/stage/*
+func apiResource(methodArn string) string {
+  parts := strings.SplitN(methodArn, "/", 3)
+  if len(parts) < 2 {
+    return methodArn
+  }
+
+  return parts[0] + "/" + parts[1] + "/*"
+}
+
+func main() {
+  lambda.Start(NewTokenAuthorizer().Authorize)
+}
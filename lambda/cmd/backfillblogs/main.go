@@ -0,0 +1,140 @@
+// backfillblogs puts blogs written before the created_at index into it. Those rows have no
+// listing partition and a created_at in the old "Mar 7, 7009" format, which lost the year.
+//
+//   go run ./cmd/backfillblogs -legacy-year 2024          (prints what would change)
+//   go run ./cmd/backfillblogs -legacy-year 2024 -apply
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"lambda-func/database"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+// the old layout was "Jan 2, 2009", which writes the day again followed by a literal 009
+var legacyCreatedAt = regexp.MustCompile(`^([A-Z][a-z]{2}) ([0-9]{1,2}), [0-9]{1,2}009$`)
+
+func main() {
+  legacyYear := flag.Int("legacy-year", 0, "year the old posts were written in, their stored date doesn't have it")
+  apply := flag.Bool("apply", false, "write the changes, without it they are only printed")
+  flag.Parse()
+
+  db := dynamodb.New(session.Must(session.NewSession()))
+
+  // only rows missing from the index, so running it again is a no op
+  expr, err := expression.NewBuilder().
+    WithFilter(expression.AttributeNotExists(expression.Name("listing"))).
+    Build()
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  updated, skipped := 0, 0
+
+  err = db.ScanPages(&dynamodb.ScanInput{
+    TableName: aws.String(database.BLOGS_TABLE),
+    FilterExpression: expr.Filter(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  }, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+    for _, item := range page.Items {
+      slug := aws.StringValue(item["slug"].S)
+      stored := ""
+      if item["created_at"] != nil {
+        stored = aws.StringValue(item["created_at"].S)
+      }
+
+      createdAt, err := backfillCreatedAt(stored, *legacyYear)
+      if err != nil {
+        log.Printf("skipping %s: %v", slug, err)
+        skipped++
+        continue
+      }
+
+      fmt.Printf("%s: created_at %q -> %q\n", slug, stored, createdAt)
+
+      if *apply {
+        err = backfill(db, slug, createdAt)
+        if err != nil {
+          log.Fatalf("failed to backfill %s: %v", slug, err)
+        }
+      }
+
+      updated++
+    }
+
+    return true
+  })
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  if !*apply {
+    fmt.Printf("%d blogs would be backfilled, %d skipped. Run again with -apply to write them\n", updated, skipped)
+    return
+  }
+
+  fmt.Printf("%d blogs backfilled, %d skipped\n", updated, skipped)
+}
+
+// rows already holding an RFC3339 time keep it, old dates get the month and day they kept plus -legacy-year
+func backfillCreatedAt(stored string, legacyYear int) (string, error) {
+  if _, err := time.Parse(time.RFC3339, stored); err == nil {
+    return stored, nil
+  }
+
+  match := legacyCreatedAt.FindStringSubmatch(stored)
+  if match == nil {
+    return "", fmt.Errorf("unknown created_at %q", stored)
+  }
+
+  if legacyYear == 0 {
+    return "", fmt.Errorf("created_at %q has no year, set -legacy-year", stored)
+  }
+
+  day, _ := strconv.Atoi(match[2])
+
+  date, err := time.Parse("Jan 2 2006", fmt.Sprintf("%s %d %d", match[1], day, legacyYear))
+  if err != nil {
+    return "", fmt.Errorf("unknown created_at %q", stored)
+  }
+
+  return date.UTC().Format(time.RFC3339), nil
+}
+
+func backfill(db *dynamodb.DynamoDB, slug string, createdAt string) error {
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.
+      Set(expression.Name("listing"), expression.Value(database.BLOGS_LISTING_PARTITION)).
+      Set(expression.Name("created_at"), expression.Value(createdAt))).
+    WithCondition(expression.AttributeExists(expression.Name("slug"))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(database.BLOGS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue{
+      "slug": {
+        S: aws.String(slug),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  return err
+}
@@ -0,0 +1,52 @@
+// grantadmin gives an existing local account the admin role, to set up the first admin. Later
+// admins are granted with PUT /users/{username}/roles. The role is stored on the user, so it
+// shows up in tokens from their next login
+//
+//   go run ./cmd/grantadmin -username alice
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"lambda-func/database"
+	"lambda-func/types"
+)
+
+func main() {
+  username := flag.String("username", "", "account to make an admin")
+  flag.Parse()
+
+  if *username == "" {
+    log.Fatal("set -username")
+  }
+
+  db := database.NewDynamoDBClient()
+  userStore := db.UserStore()
+
+  user, err := userStore.GetUser(*username)
+  if err != nil {
+    log.Fatalf("failed to find %s: %v", *username, err)
+  }
+
+  // whoever registered the name may not own the address yet, or ever
+  if user.IsPendingVerification() {
+    log.Fatalf("%s hasn't verified their email address yet", *username)
+  }
+
+  roles := user.UserRoles()
+  for _, role := range roles {
+    if role == types.RoleAdmin {
+      fmt.Printf("%s is already an admin\n", *username)
+      return
+    }
+  }
+
+  err = userStore.UpdateUserRoles(*username, append(roles, types.RoleAdmin))
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  fmt.Printf("%s is now an admin, they need to log in again to use it\n", *username)
+}
@@ -0,0 +1,227 @@
+// oidcstub is a tiny oidc provider for trying /oidc/{provider}/start and /callback locally.
+// It signs in everyone who reaches /authorize straight away, as -sub or as ?login_hint=, and
+// checks the pkce verifier, client and redirect uri on /token like a real provider would.
+//
+//   go run ./cmd/oidcstub -addr :9999
+//   OIDC_PROVIDERS='{"stub": {"issuer": "http://localhost:9999", "client_id": "stub-client",
+//     "redirect_url": "http://localhost:3000/oidc/stub/callback"}}'
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"lambda-func/keys"
+	"lambda-func/oidc"
+)
+
+const CODE_TTL = time.Minute
+
+type authorization struct {
+  subject string
+  clientID string
+  redirectURI string
+  codeChallenge string
+  nonce string
+  expiresAt time.Time
+}
+
+type stub struct {
+  issuer string
+  clientID string
+  clientSecret string
+  subject string
+  email string
+  username string
+  key keys.Key
+  jwks keys.JWKS
+
+  mu sync.Mutex
+  codes map[string]authorization
+}
+
+func main() {
+  addr := flag.String("addr", ":9999", "address to listen on")
+  issuer := flag.String("issuer", "http://localhost:9999", "issuer url, has to match the provider's issuer in OIDC_PROVIDERS")
+  clientID := flag.String("client-id", "stub-client", "the only client id accepted")
+  clientSecret := flag.String("client-secret", "", "client secret required on /token, none when empty")
+  subject := flag.String("sub", "stub-user", "subject signed in when the request has no login_hint")
+  email := flag.String("email", "stub-user@example.com", "verified email put in id tokens")
+  username := flag.String("username", "stubuser", "preferred_username put in id tokens")
+  flag.Parse()
+
+  key, err := keys.GenerateKey(keys.ALG_ES256, time.Now())
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  jwks, err := keys.KeySet{Active: key.ID, Keys: []keys.Key{key}}.JWKS()
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  s := &stub{
+    issuer: *issuer,
+    clientID: *clientID,
+    clientSecret: *clientSecret,
+    subject: *subject,
+    email: *email,
+    username: *username,
+    key: key,
+    jwks: jwks,
+    codes: map[string]authorization{},
+  }
+
+  http.HandleFunc("/.well-known/openid-configuration", s.discovery)
+  http.HandleFunc("/authorize", s.authorize)
+  http.HandleFunc("/token", s.token)
+  http.HandleFunc("/jwks", s.publicKeys)
+
+  log.Printf("stub oidc provider for %s listening on %s", *issuer, *addr)
+  log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func (s *stub) discovery(w http.ResponseWriter, r *http.Request) {
+  writeJSON(w, http.StatusOK, map[string]interface{}{
+    "issuer": s.issuer,
+    "authorization_endpoint": s.issuer + "/authorize",
+    "token_endpoint": s.issuer + "/token",
+    "jwks_uri": s.issuer + "/jwks",
+    "response_types_supported": []string{"code"},
+    "subject_types_supported": []string{"public"},
+    "id_token_signing_alg_values_supported": []string{keys.ALG_ES256},
+    "code_challenge_methods_supported": []string{"S256"},
+  })
+}
+
+func (s *stub) publicKeys(w http.ResponseWriter, r *http.Request) {
+  writeJSON(w, http.StatusOK, s.jwks)
+}
+
+func (s *stub) authorize(w http.ResponseWriter, r *http.Request) {
+  query := r.URL.Query()
+
+  if query.Get("response_type") != "code" || query.Get("client_id") != s.clientID || query.Get("redirect_uri") == "" {
+    http.Error(w, "response_type=code, a known client_id and redirect_uri are required", http.StatusBadRequest)
+    return
+  }
+
+  if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+    http.Error(w, "pkce with S256 is required", http.StatusBadRequest)
+    return
+  }
+
+  redirectURI, err := url.Parse(query.Get("redirect_uri"))
+  if err != nil {
+    http.Error(w, "malformed redirect_uri", http.StatusBadRequest)
+    return
+  }
+
+  subject := s.subject
+  if hint := query.Get("login_hint"); hint != "" {
+    subject = hint
+  }
+
+  code, err := oidc.RandomString()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+
+  s.mu.Lock()
+  s.codes[code] = authorization{
+    subject: subject,
+    clientID: query.Get("client_id"),
+    redirectURI: query.Get("redirect_uri"),
+    codeChallenge: query.Get("code_challenge"),
+    nonce: query.Get("nonce"),
+    expiresAt: time.Now().Add(CODE_TTL),
+  }
+  s.mu.Unlock()
+
+  callback := redirectURI.Query()
+  callback.Set("code", code)
+  callback.Set("state", query.Get("state"))
+  redirectURI.RawQuery = callback.Encode()
+
+  http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *stub) token(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+    writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+    return
+  }
+
+  clientID, clientSecret, ok := r.BasicAuth()
+  if ok {
+    clientID, _ = url.QueryUnescape(clientID)
+    clientSecret, _ = url.QueryUnescape(clientSecret)
+  } else {
+    clientID = r.PostForm.Get("client_id")
+  }
+
+  if clientID != s.clientID || (s.clientSecret != "" && clientSecret != s.clientSecret) {
+    writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+    return
+  }
+
+  // codes are single use
+  s.mu.Lock()
+  auth, found := s.codes[r.PostForm.Get("code")]
+  delete(s.codes, r.PostForm.Get("code"))
+  s.mu.Unlock()
+
+  if !found || time.Now().After(auth.expiresAt) || auth.clientID != clientID || auth.redirectURI != r.PostForm.Get("redirect_uri") {
+    writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+    return
+  }
+
+  sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+  if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(auth.codeChallenge)) != 1 {
+    writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "code_verifier does not match"})
+    return
+  }
+
+  now := time.Now()
+  idToken := jwt.NewWithClaims(jwt.GetSigningMethod(s.key.Algorithm), jwt.MapClaims{
+    "iss": s.issuer,
+    "sub": auth.subject,
+    "aud": clientID,
+    "iat": now.Unix(),
+    "exp": now.Add(time.Hour).Unix(),
+    "nonce": auth.nonce,
+    "email": s.email,
+    "email_verified": true,
+    "preferred_username": s.username,
+  })
+  idToken.Header["kid"] = s.key.ID
+
+  signed, err := idToken.SignedString(s.key.PrivateKey())
+  if err != nil {
+    writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+    return
+  }
+
+  writeJSON(w, http.StatusOK, map[string]interface{}{
+    "access_token": "stub-access-token",
+    "token_type": "Bearer",
+    "expires_in": 3600,
+    "id_token": signed,
+  })
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(body)
+}
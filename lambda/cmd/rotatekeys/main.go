@@ -0,0 +1,121 @@
+// rotatekeys adds a new jwt signing key to the key set and makes it the active one.
+// The previous keys keep verifying tokens until they have been retired for longer than -retain.
+//
+//   go run ./cmd/rotatekeys -secret-id <jwt secret arn>
+//   go run ./cmd/rotatekeys -file keys.json   (then export JWT_SIGNING_KEYS="$(cat keys.json)")
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	"lambda-func/keys"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// what the stack generates into the secret before the first rotation, see go-cdk.go
+var placeholderSecret = regexp.MustCompile(`^[A-Za-z0-9]{64}$`)
+
+func main() {
+  secretId := flag.String("secret-id", "", "secrets manager secret holding the key set")
+  file := flag.String("file", "", "file holding the key set, for local runs")
+  algorithm := flag.String("alg", keys.ALG_ES256, "algorithm of the new key, ES256 or RS256")
+  // has to outlive the longest lived token signed with a retired key
+  retain := flag.Duration("retain", 24 * time.Hour, "how long retired keys keep verifying")
+  flag.Parse()
+
+  if (*secretId == "") == (*file == "") {
+    log.Fatal("set exactly one of -secret-id or -file")
+  }
+
+  var client *secretsmanager.SecretsManager
+  if *secretId != "" {
+    client = secretsmanager.New(session.Must(session.NewSession()))
+  }
+
+  current, err := readKeySet(client, *secretId, *file)
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  now := time.Now()
+
+  newKey, err := keys.GenerateKey(*algorithm, now)
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  rotated := current.Rotate(newKey, now, *retain)
+
+  data, err := rotated.Marshal()
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  if client != nil {
+    _, err = client.PutSecretValue(&secretsmanager.PutSecretValueInput{
+      SecretId: aws.String(*secretId),
+      SecretString: aws.String(string(data)),
+    })
+  } else {
+    err = os.WriteFile(*file, data, 0600)
+  }
+
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  fmt.Printf("active key %s (%s), %d keys in the set\n", newKey.ID, newKey.Algorithm, len(rotated.Keys))
+}
+
+// a missing file, or a secret still holding the generated placeholder, starts a new key set. Anything
+// else that doesn't parse is an error, writing over it would drop every key tokens are verified with
+func readKeySet(client *secretsmanager.SecretsManager, secretId string, file string) (keys.KeySet, error) {
+  var data []byte
+
+  if client != nil {
+    result, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+      SecretId: aws.String(secretId),
+    })
+    if err != nil {
+      return keys.KeySet{}, fmt.Errorf("failed to read secret: %w", err)
+    }
+
+    data = []byte(aws.StringValue(result.SecretString))
+  } else {
+    contents, err := os.ReadFile(file)
+    if os.IsNotExist(err) {
+      log.Printf("%s doesn't exist, starting a new key set", file)
+      return keys.KeySet{}, nil
+    }
+
+    if err != nil {
+      return keys.KeySet{}, err
+    }
+
+    data = contents
+  }
+
+  return parseStoredKeySet(data)
+}
+
+func parseStoredKeySet(data []byte) (keys.KeySet, error) {
+  if placeholderSecret.Match(data) {
+    log.Printf("secret still holds the deploy time placeholder, starting a new key set")
+    return keys.KeySet{}, nil
+  }
+
+  keySet, err := keys.ParseKeySet(data)
+  if err != nil {
+    return keys.KeySet{}, fmt.Errorf("stored key set is unusable, fix or remove it by hand: %w", err)
+  }
+
+  return keySet, nil
+}
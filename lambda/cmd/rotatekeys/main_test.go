@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lambda-func/keys"
+)
+
+func TestReadKeySetFromFile(t *testing.T) {
+  dir := t.TempDir()
+
+  key, err := keys.GenerateKey(keys.ALG_ES256, time.Now())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  stored, err := keys.KeySet{}.Rotate(key, time.Now(), time.Hour).Marshal()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  write := func(name string, data string) string {
+    path := filepath.Join(dir, name)
+    if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+      t.Fatal(err)
+    }
+    return path
+  }
+
+  tests := []struct {
+    name string
+    file string
+    wantKeys int
+    wantErr bool
+  }{
+    {"missing file starts a new set", filepath.Join(dir, "missing.json"), 0, false},
+    {"existing set", write("keys.json", string(stored)), 1, false},
+    {"placeholder starts a new set", write("placeholder", "Ab3dEfGh1jKlMn0pQrStUvWxYz0123456789AbCdEfGhIjKlMnOpQrStUvWxYz01"), 0, false},
+    {"corrupt set", write("corrupt.json", string(stored[:len(stored) / 2])), 0, true},
+    {"hand edited set without its active key", write("edited.json", `{"active": "gone", "keys": []}`), 0, true},
+    {"empty file", write("empty.json", ""), 0, true},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      keySet, err := readKeySet(nil, "", tt.file)
+      if (err != nil) != tt.wantErr {
+        t.Fatalf("readKeySet() error = %v, wantErr %v", err, tt.wantErr)
+      }
+
+      if len(keySet.Keys) != tt.wantKeys {
+        t.Errorf("readKeySet() has %d keys, want %d", len(keySet.Keys), tt.wantKeys)
+      }
+    })
+  }
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"lambda-func/types"
+)
+
+const (
+  API_KEYS_TABLE="apiKeysTable"
+  API_KEYS_USERNAME_INDEX="usernameIndex"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+type APIKeyStore interface {
+  InsertAPIKey(apiKey types.APIKey) error
+  GetAPIKey(id string) (types.APIKey, error)
+  ListAPIKeys(username string) ([]types.APIKey, error)
+  DeleteAPIKey(username string, id string) error
+  DeleteUserAPIKeys(username string) error
+  TouchAPIKey(id string, usedAt time.Time) error
+}
+
+type DynamoAPIKeyStore struct {
+  databaseStore *dynamodb.DynamoDB
+}
+
+func (u DynamoAPIKeyStore) InsertAPIKey(apiKey types.APIKey) error {
+  item, err := dynamodbattribute.MarshalMap(apiKey)
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.PutItem(&dynamodb.PutItemInput{
+    TableName: aws.String(API_KEYS_TABLE),
+    Item: item,
+    ConditionExpression: aws.String("attribute_not_exists(id)"),
+  })
+  if err != nil {
+    return fmt.Errorf("failed to insert api key: %w", err)
+  }
+
+  return nil
+}
+
+func (u DynamoAPIKeyStore) GetAPIKey(id string) (types.APIKey, error) {
+  var apiKey types.APIKey
+
+  result, err := u.databaseStore.GetItem(&dynamodb.GetItemInput{
+    TableName: aws.String(API_KEYS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "id": {
+        S: aws.String(id),
+      },
+    },
+  })
+
+  if err != nil {
+    return apiKey, fmt.Errorf("failed to get api key: %w", err)
+  }
+
+  if result.Item == nil {
+    return apiKey, ErrAPIKeyNotFound
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Item, &apiKey)
+  if err != nil {
+    return apiKey, err
+  }
+
+  return apiKey, nil
+}
+
+// every key of the user, expired ones included until ttl removes them
+func (u DynamoAPIKeyStore) ListAPIKeys(username string) ([]types.APIKey, error) {
+  apiKeys := []types.APIKey{}
+
+  expr, err := expression.NewBuilder().
+    WithKeyCondition(expression.Key("username").Equal(expression.Value(username))).
+    Build()
+  if err != nil {
+    return apiKeys, err
+  }
+
+  var items []map[string]*dynamodb.AttributeValue
+
+  err = u.databaseStore.QueryPages(&dynamodb.QueryInput{
+    TableName: aws.String(API_KEYS_TABLE),
+    IndexName: aws.String(API_KEYS_USERNAME_INDEX),
+    KeyConditionExpression: expr.KeyCondition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  }, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+    items = append(items, page.Items...)
+    return true
+  })
+  if err != nil {
+    return apiKeys, fmt.Errorf("failed to query api keys: %w", err)
+  }
+
+  err = dynamodbattribute.UnmarshalListOfMaps(items, &apiKeys)
+  if err != nil {
+    return apiKeys, fmt.Errorf("failed to unmarshal api keys: %w", err)
+  }
+
+  return apiKeys, nil
+}
+
+// only the owner's keys, someone else's id answers the same as a missing one
+func (u DynamoAPIKeyStore) DeleteAPIKey(username string, id string) error {
+  _, err := u.databaseStore.DeleteItem(&dynamodb.DeleteItemInput{
+    TableName: aws.String(API_KEYS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "id": {
+        S: aws.String(id),
+      },
+    },
+    ConditionExpression: aws.String("username = :username"),
+    ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+      ":username": {
+        S: aws.String(username),
+      },
+    },
+  })
+
+  if isConditionFailed(err) {
+    return ErrAPIKeyNotFound
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to delete api key: %w", err)
+  }
+
+  return nil
+}
+
+func (u DynamoAPIKeyStore) DeleteUserAPIKeys(username string) error {
+  apiKeys, err := u.ListAPIKeys(username)
+  if err != nil {
+    return err
+  }
+
+  for _, apiKey := range apiKeys {
+    err = u.DeleteAPIKey(username, apiKey.ID)
+    if err != nil && !errors.Is(err, ErrAPIKeyNotFound) {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func (u DynamoAPIKeyStore) TouchAPIKey(id string, usedAt time.Time) error {
+  _, err := u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(API_KEYS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "id": {
+        S: aws.String(id),
+      },
+    },
+    UpdateExpression: aws.String("SET last_used_at = :used_at"),
+    ConditionExpression: aws.String("attribute_exists(id)"),
+    ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+      ":used_at": {
+        S: aws.String(usedAt.UTC().Format(time.RFC3339)),
+      },
+    },
+  })
+
+  if isConditionFailed(err) {
+    return ErrAPIKeyNotFound
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to update api key last use: %w", err)
+  }
+
+  return nil
+}
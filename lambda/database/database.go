@@ -2,33 +2,85 @@ package database
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
   "lambda-func/types"
+  "errors"
   "fmt"
+  "strconv"
+  "time"
 )
 
 const (
   USERS_TABLE="userTable"
   BLOGS_TABLE="blogsTable"
+
+  // every blog shares one partition in this index so it can be queried sorted by created_at
+  BLOGS_CREATED_AT_INDEX="createdAtIndex"
+  BLOGS_LISTING_PARTITION="blogs"
+
+  BLOGS_AUTHOR_INDEX="authorIndex"
+)
+
+var (
+  ErrBlogNotFound = errors.New("blog not found")
+  ErrBlogExists = errors.New("blog already exists")
+  ErrUserNotFound = errors.New("user not found")
+  ErrUserExists = errors.New("user already exists")
+  ErrMFACodeReused = errors.New("mfa code already used")
+  ErrRecoveryCodeInvalid = errors.New("recovery code invalid")
+  ErrVerificationSentRecently = errors.New("verification email sent recently")
+  ErrPasswordResetSentRecently = errors.New("password reset email sent recently")
+  ErrPasswordAlreadySet = errors.New("password already set")
+  ErrPasswordChanged = errors.New("password changed")
 )
 
 type UserStore interface {
   DoesUserExist(username string) (bool, error)
   InsertUser(user types.User) error
+  ReclaimPendingUser(user types.User, createdBefore time.Time) error
   GetUser(username string) (types.User, error)
+  UpdateUserRoles(username string, roles []string) error
+  UpdatePassword(username string, passwordHash string, changedAt time.Time) error
+  SetInitialPassword(username string, passwordHash string, changedAt time.Time) error
+  RehashPassword(username string, oldHash string, newHash string) error
+  DeleteUser(username string) error
+  UpdateProfile(username string, update types.UpdateProfile) (types.User, error)
+  SetPendingMFASecret(username string, secret string) error
+  EnableMFA(username string, secret string, recoveryCodeHashes []string, step int64) error
+  RecordMFAStep(username string, step int64) error
+  UseRecoveryCode(username string, codeHash string) error
+  VerifyEmail(username string) error
+  MarkVerificationSent(username string, sentAt time.Time, minInterval time.Duration) error
+  MarkPasswordResetSent(username string, sentAt time.Time, minInterval time.Duration) error
 }
 
 type BlogStore interface {
   GetBlog(BlogSlug string) (types.Blog, error)
   InsertBlog(blog types.Blog)  error
-  GetAllBlogs() ([]types.Blog, error)
+  GetAllBlogs(limit int64, cursor string) (types.BlogPage, error)
+  ListBlogsByCreatedAt(newestFirst bool, limit int64, cursor string) (types.BlogPage, error)
+  ListBlogsByAuthor(author string, limit int64, cursor string) (types.BlogPage, error)
+  UpdateBlog(slug string, update types.UpdateBlog, updatedAt string) (types.Blog, error)
+  DeleteBlog(slug string, deletedAt string) error
+  RestoreBlog(slug string) (types.Blog, error)
+  PurgeBlog(slug string) error
+  ReassignBlogs(fromAuthor string, toAuthor string) error
 }
 
 type DynamoDBClient struct {
   userStore UserStore
   blogStore BlogStore
+  refreshTokenStore RefreshTokenStore
+  revocationStore RevocationStore
+  loginAttemptStore LoginAttemptStore
+  passwordResetStore PasswordResetStore
+  apiKeyStore APIKeyStore
+  oidcStateStore OIDCStateStore
+  identityLinkStore IdentityLinkStore
 }
 
 func (d *DynamoDBClient) UserStore() UserStore {
@@ -39,6 +91,34 @@ func (d *DynamoDBClient) BlogStore() BlogStore {
     return d.blogStore
 }
 
+func (d *DynamoDBClient) RefreshTokenStore() RefreshTokenStore {
+    return d.refreshTokenStore
+}
+
+func (d *DynamoDBClient) RevocationStore() RevocationStore {
+    return d.revocationStore
+}
+
+func (d *DynamoDBClient) LoginAttemptStore() LoginAttemptStore {
+    return d.loginAttemptStore
+}
+
+func (d *DynamoDBClient) PasswordResetStore() PasswordResetStore {
+    return d.passwordResetStore
+}
+
+func (d *DynamoDBClient) APIKeyStore() APIKeyStore {
+    return d.apiKeyStore
+}
+
+func (d *DynamoDBClient) OIDCStateStore() OIDCStateStore {
+    return d.oidcStateStore
+}
+
+func (d *DynamoDBClient) IdentityLinkStore() IdentityLinkStore {
+    return d.identityLinkStore
+}
+
 type DynamoUserStore struct {
   databaseStore *dynamodb.DynamoDB
 }
@@ -54,6 +134,13 @@ func NewDynamoDBClient() DynamoDBClient {
   return DynamoDBClient{
     userStore: &DynamoUserStore{databaseStore: db},
     blogStore: &DynamoBlogStore{databaseStore: db},
+    refreshTokenStore: &DynamoRefreshTokenStore{databaseStore: db},
+    revocationStore: &DynamoRevocationStore{databaseStore: db},
+    loginAttemptStore: &DynamoLoginAttemptStore{databaseStore: db},
+    passwordResetStore: &DynamoPasswordResetStore{databaseStore: db},
+    apiKeyStore: &DynamoAPIKeyStore{databaseStore: db},
+    oidcStateStore: &DynamoOIDCStateStore{databaseStore: db},
+    identityLinkStore: &DynamoIdentityLinkStore{databaseStore: db},
   }
 }
 
@@ -73,7 +160,7 @@ func (u DynamoBlogStore) GetBlog(slug string) (types.Blog, error) {
   }
 
   if result.Item == nil {
-    return blog, fmt.Errorf("no blog")
+    return blog, ErrBlogNotFound
   }
 
   err = dynamodbattribute.UnmarshalMap(result.Item, &blog)
@@ -81,26 +168,137 @@ func (u DynamoBlogStore) GetBlog(slug string) (types.Blog, error) {
     return blog, err
   }
 
+  // soft deleted blogs stay in the table until purged but are hidden from readers
+  if blog.DeletedAt != "" {
+    return types.Blog{}, ErrBlogNotFound
+  }
+
   return blog, nil
 }
 
-func (u DynamoBlogStore) GetAllBlogs() ([]types.Blog, error) {
-  input := &dynamodb.ScanInput{
-    TableName: aws.String(BLOGS_TABLE),
+func (u DynamoBlogStore) GetAllBlogs(limit int64, cursor string) (types.BlogPage, error) {
+  page := types.BlogPage{Items: []types.Blog{}}
+
+  expr, err := expression.NewBuilder().
+    WithFilter(expression.AttributeNotExists(expression.Name("deleted_at"))).
+    Build()
+  if err != nil {
+    return page, err
+  }
+
+  items, nextCursor, err := paginate(cursor, blogsTableKey, limit, func(startKey map[string]*dynamodb.AttributeValue, limit int64) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
+    result, err := u.databaseStore.Scan(&dynamodb.ScanInput{
+      TableName: aws.String(BLOGS_TABLE),
+      FilterExpression: expr.Filter(),
+      ExpressionAttributeNames: expr.Names(),
+      ExclusiveStartKey: startKey,
+      Limit: aws.Int64(limit),
+    })
+    if err != nil {
+      return nil, nil, fmt.Errorf("failed to scan blogs: %w", err)
+    }
+
+    return result.Items, result.LastEvaluatedKey, nil
+  })
+  if err != nil {
+    return page, err
   }
 
-  result, err := u.databaseStore.Scan(input)
+  err = dynamodbattribute.UnmarshalListOfMaps(items, &page.Items)
   if err != nil {
-  return nil, fmt.Errorf("failed to scan blogs: %w", err)
+      return page, fmt.Errorf("failed to unmarshal blogs: %w", err)
   }
-  
-  var blogs []types.Blog
-  err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &blogs)
+
+  page.NextCursor = nextCursor
+
+  return page, nil
+}
+
+func (u DynamoBlogStore) ListBlogsByCreatedAt(newestFirst bool, limit int64, cursor string) (types.BlogPage, error) {
+  page := types.BlogPage{Items: []types.Blog{}}
+
+  expr, err := expression.NewBuilder().
+    WithKeyCondition(expression.Key("listing").Equal(expression.Value(BLOGS_LISTING_PARTITION))).
+    WithFilter(expression.AttributeNotExists(expression.Name("deleted_at"))).
+    Build()
+  if err != nil {
+    return page, err
+  }
+
+  items, nextCursor, err := paginate(cursor, blogsCreatedAtIndexKey, limit, func(startKey map[string]*dynamodb.AttributeValue, limit int64) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
+    result, err := u.databaseStore.Query(&dynamodb.QueryInput{
+      TableName: aws.String(BLOGS_TABLE),
+      IndexName: aws.String(BLOGS_CREATED_AT_INDEX),
+      KeyConditionExpression: expr.KeyCondition(),
+      FilterExpression: expr.Filter(),
+      ExpressionAttributeNames: expr.Names(),
+      ExpressionAttributeValues: expr.Values(),
+      ScanIndexForward: aws.Bool(!newestFirst),
+      ExclusiveStartKey: startKey,
+      Limit: aws.Int64(limit),
+    })
+    if err != nil {
+      return nil, nil, fmt.Errorf("failed to query blogs: %w", err)
+    }
+
+    return result.Items, result.LastEvaluatedKey, nil
+  })
+  if err != nil {
+    return page, err
+  }
+
+  err = dynamodbattribute.UnmarshalListOfMaps(items, &page.Items)
+  if err != nil {
+    return page, fmt.Errorf("failed to unmarshal blogs: %w", err)
+  }
+
+  page.NextCursor = nextCursor
+
+  return page, nil
+}
+
+// newest first
+func (u DynamoBlogStore) ListBlogsByAuthor(author string, limit int64, cursor string) (types.BlogPage, error) {
+  page := types.BlogPage{Items: []types.Blog{}}
+
+  expr, err := expression.NewBuilder().
+    WithKeyCondition(expression.Key("author").Equal(expression.Value(author))).
+    WithFilter(expression.AttributeNotExists(expression.Name("deleted_at"))).
+    Build()
+  if err != nil {
+    return page, err
+  }
+
+  items, nextCursor, err := paginate(cursor, blogsAuthorIndexKey(author), limit, func(startKey map[string]*dynamodb.AttributeValue, limit int64) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
+    result, err := u.databaseStore.Query(&dynamodb.QueryInput{
+      TableName: aws.String(BLOGS_TABLE),
+      IndexName: aws.String(BLOGS_AUTHOR_INDEX),
+      KeyConditionExpression: expr.KeyCondition(),
+      FilterExpression: expr.Filter(),
+      ExpressionAttributeNames: expr.Names(),
+      ExpressionAttributeValues: expr.Values(),
+      ScanIndexForward: aws.Bool(false),
+      ExclusiveStartKey: startKey,
+      Limit: aws.Int64(limit),
+    })
+    if err != nil {
+      return nil, nil, fmt.Errorf("failed to query blogs by author: %w", err)
+    }
+
+    return result.Items, result.LastEvaluatedKey, nil
+  })
+  if err != nil {
+    return page, err
+  }
+
+  err = dynamodbattribute.UnmarshalListOfMaps(items, &page.Items)
   if err != nil {
-      return nil, fmt.Errorf("failed to unmarshal blogs: %w", err)
+    return page, fmt.Errorf("failed to unmarshal blogs: %w", err)
   }
 
-  return blogs, nil
+  page.NextCursor = nextCursor
+
+  return page, nil
 }
 
 func (u DynamoBlogStore) InsertBlog(blog types.Blog) error {
@@ -123,17 +321,261 @@ func (u DynamoBlogStore) InsertBlog(blog types.Blog) error {
       "created_at": {
         S: aws.String(blog.CreatedAt),
       },
+      "author": {
+        S: aws.String(blog.Author),
+      },
+      "listing": {
+        S: aws.String(BLOGS_LISTING_PARTITION),
+      },
     },
+    // a title that slugifies to an existing post must not overwrite someone else's blog
+    ConditionExpression: aws.String("attribute_not_exists(slug)"),
   }
 
   _, err := u.databaseStore.PutItem(item)
+
+  if isConditionFailed(err) {
+    return ErrBlogExists
+  }
+
+  if err != nil {
+    return err
+  }
+
+  return nil
+}
+
+func (u DynamoBlogStore) UpdateBlog(slug string, update types.UpdateBlog, updatedAt string) (types.Blog, error) {
+  var blog types.Blog
+
+  set := expression.Set(expression.Name("updated_at"), expression.Value(updatedAt))
+  if update.Title != nil {
+    set = set.Set(expression.Name("title"), expression.Value(*update.Title))
+  }
+  if update.Description != nil {
+    set = set.Set(expression.Name("description"), expression.Value(*update.Description))
+  }
+  if update.Content != nil {
+    set = set.Set(expression.Name("content"), expression.Value(*update.Content))
+  }
+
+  // only update an existing blog, otherwise UpdateItem would create a new one
+  expr, err := expression.NewBuilder().
+    WithUpdate(set).
+    WithCondition(blogIsLive()).
+    Build()
+  if err != nil {
+    return blog, err
+  }
+
+  result, err := u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(BLOGS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "slug": {
+        S: aws.String(slug),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+    ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+  })
+
+  if isConditionFailed(err) {
+    return blog, ErrBlogNotFound
+  }
+
+  if err != nil {
+    return blog, fmt.Errorf("failed to update blog: %w", err)
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Attributes, &blog)
+  if err != nil {
+    return blog, err
+  }
+
+  return blog, nil
+}
+
+func (u DynamoBlogStore) DeleteBlog(slug string, deletedAt string) error {
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.Set(expression.Name("deleted_at"), expression.Value(deletedAt))).
+    WithCondition(blogIsLive()).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(BLOGS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "slug": {
+        S: aws.String(slug),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrBlogNotFound
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to delete blog: %w", err)
+  }
+
+  return nil
+}
+
+func (u DynamoBlogStore) RestoreBlog(slug string) (types.Blog, error) {
+  var blog types.Blog
+
+  // only blogs that are currently soft deleted can be restored
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.Remove(expression.Name("deleted_at"))).
+    WithCondition(expression.AttributeExists(expression.Name("deleted_at"))).
+    Build()
+  if err != nil {
+    return blog, err
+  }
+
+  result, err := u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(BLOGS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "slug": {
+        S: aws.String(slug),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+  })
+
+  if isConditionFailed(err) {
+    return blog, ErrBlogNotFound
+  }
+
+  if err != nil {
+    return blog, fmt.Errorf("failed to restore blog: %w", err)
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Attributes, &blog)
+  if err != nil {
+    return blog, err
+  }
+
+  return blog, nil
+}
+
+// purging removes the item for good, deleted or not
+func (u DynamoBlogStore) PurgeBlog(slug string) error {
+  expr, err := expression.NewBuilder().
+    WithCondition(expression.AttributeExists(expression.Name("slug"))).
+    Build()
   if err != nil {
     return err
   }
 
+  _, err = u.databaseStore.DeleteItem(&dynamodb.DeleteItemInput{
+    TableName: aws.String(BLOGS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "slug": {
+        S: aws.String(slug),
+      },
+    },
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrBlogNotFound
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to purge blog: %w", err)
+  }
+
+  return nil
+}
+
+// moves every blog of fromAuthor, soft deleted ones included, over to toAuthor.
+// Each write is conditional on the old author so running it twice is harmless
+func (u DynamoBlogStore) ReassignBlogs(fromAuthor string, toAuthor string) error {
+  slugs := []string{}
+
+  err := u.databaseStore.QueryPages(&dynamodb.QueryInput{
+    TableName: aws.String(BLOGS_TABLE),
+    IndexName: aws.String(BLOGS_AUTHOR_INDEX),
+    KeyConditionExpression: aws.String("author = :author"),
+    ProjectionExpression: aws.String("slug"),
+    ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+      ":author": {
+        S: aws.String(fromAuthor),
+      },
+    },
+  }, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+    for _, item := range page.Items {
+      if slug, ok := item["slug"]; ok && slug.S != nil {
+        slugs = append(slugs, *slug.S)
+      }
+    }
+    return true
+  })
+  if err != nil {
+    return fmt.Errorf("failed to query blogs by author: %w", err)
+  }
+
+  for _, slug := range slugs {
+    _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+      TableName: aws.String(BLOGS_TABLE),
+      Key: map[string]*dynamodb.AttributeValue {
+        "slug": {
+          S: aws.String(slug),
+        },
+      },
+      UpdateExpression: aws.String("SET author = :to"),
+      ConditionExpression: aws.String("author = :from"),
+      ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+        ":to": {
+          S: aws.String(toAuthor),
+        },
+        ":from": {
+          S: aws.String(fromAuthor),
+        },
+      },
+    })
+
+    // purged or already moved since the query
+    if isConditionFailed(err) {
+      continue
+    }
+
+    if err != nil {
+      return fmt.Errorf("failed to reassign blog %s: %w", slug, err)
+    }
+  }
+
   return nil
 }
 
+// blog exists and has not been soft deleted
+func blogIsLive() expression.ConditionBuilder {
+  return expression.And(
+    expression.AttributeExists(expression.Name("slug")),
+    expression.AttributeNotExists(expression.Name("deleted_at")),
+  )
+}
+
+func isConditionFailed(err error) bool {
+  var awsErr awserr.Error
+  return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
 func (u DynamoUserStore) DoesUserExist(username string) (bool, error) {
   // aws force to pass in reference here, also passing reference is faster than passing copy
   result, err := u.databaseStore.GetItem(&dynamodb.GetItemInput{
@@ -162,6 +604,66 @@ func (u DynamoUserStore) DoesUserExist(username string) (bool, error) {
 }
 
 func (u DynamoUserStore) InsertUser(user types.User) error {
+  item, err := userItem(user)
+  if err != nil {
+    return err
+  }
+
+  item.ConditionExpression = aws.String("attribute_not_exists(username)")
+
+  _, err = u.databaseStore.PutItem(item)
+
+  if isConditionFailed(err) {
+    return ErrUserExists
+  }
+
+  if err != nil {
+    return err
+  }
+
+  return nil
+}
+
+// puts user in place of an account of the same name that never verified its email and was created
+// before createdBefore. ErrUserExists when the name is held by anything else
+func (u DynamoUserStore) ReclaimPendingUser(user types.User, createdBefore time.Time) error {
+  item, err := userItem(user)
+  if err != nil {
+    return err
+  }
+
+  // status is a reserved word, the builder aliases it
+  expr, err := expression.NewBuilder().
+    WithCondition(expression.Name("status").Equal(expression.Value(types.UserStatusPendingVerification)).
+      And(expression.Name("created_at").LessThan(expression.Value(createdBefore.UTC().Format(time.RFC3339))))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  item.ConditionExpression = expr.Condition()
+  item.ExpressionAttributeNames = expr.Names()
+  item.ExpressionAttributeValues = expr.Values()
+
+  _, err = u.databaseStore.PutItem(item)
+
+  if isConditionFailed(err) {
+    return ErrUserExists
+  }
+
+  if err != nil {
+    return err
+  }
+
+  return nil
+}
+
+func userItem(user types.User) (*dynamodb.PutItemInput, error) {
+  roles, err := dynamodbattribute.Marshal(user.UserRoles())
+  if err != nil {
+    return nil, err
+  }
+
   // assemble the type that dynamodb understand first
   item := &dynamodb.PutItemInput{
     TableName: aws.String(USERS_TABLE),
@@ -169,19 +671,43 @@ func (u DynamoUserStore) InsertUser(user types.User) error {
       "username": {
         S: aws.String(user.Username),
       },
-      "password": {
-        // this at this point is plain text password
-        S: aws.String(user.PasswordHash),
-      },
+      "roles": roles,
     },
   }
 
-  _, err := u.databaseStore.PutItem(item)
-  if err != nil {
-    return err
+  // users who signed up through an oidc provider have no password
+  if user.PasswordHash != "" {
+    item.Item["password"] = &dynamodb.AttributeValue{
+      S: aws.String(user.PasswordHash),
+    }
   }
 
-  return nil
+  // optional, an empty string can't be stored
+  if user.Email != "" {
+    item.Item["email"] = &dynamodb.AttributeValue{
+      S: aws.String(user.Email),
+    }
+  }
+
+  if user.CreatedAt != "" {
+    item.Item["created_at"] = &dynamodb.AttributeValue{
+      S: aws.String(user.CreatedAt),
+    }
+  }
+
+  if user.Status != "" {
+    item.Item["status"] = &dynamodb.AttributeValue{
+      S: aws.String(user.Status),
+    }
+  }
+
+  if user.VerificationSentAt != "" {
+    item.Item["verification_sent_at"] = &dynamodb.AttributeValue{
+      S: aws.String(user.VerificationSentAt),
+    }
+  }
+
+  return item, nil
 }
 
 func (u DynamoUserStore) GetUser(username string) (types.User, error) {
@@ -200,7 +726,7 @@ func (u DynamoUserStore) GetUser(username string) (types.User, error) {
   }
 
   if result.Item == nil {
-    return user, fmt.Errorf("user not found")
+    return user, ErrUserNotFound
   }
 
   // map result to user struct
@@ -211,3 +737,418 @@ func (u DynamoUserStore) GetUser(username string) (types.User, error) {
 
   return user, nil
 }
+
+func (u DynamoUserStore) UpdateUserRoles(username string, roles []string) error {
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.Set(expression.Name("roles"), expression.Value(roles))).
+    WithCondition(expression.AttributeExists(expression.Name("username"))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrUserNotFound
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to update user roles: %w", err)
+  }
+
+  return nil
+}
+
+// changedAt is kept as password_changed_at, reset tokens issued before it are refused. Nanoseconds
+// since a token issued in the same second as the change has to be told apart
+func (u DynamoUserStore) UpdatePassword(username string, passwordHash string, changedAt time.Time) error {
+  // password is a reserved word, the builder aliases it
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.
+      Set(expression.Name("password"), expression.Value(passwordHash)).
+      Set(expression.Name("password_changed_at"), expression.Value(changedAt.UTC().Format(time.RFC3339Nano)))).
+    WithCondition(expression.AttributeExists(expression.Name("username"))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrUserNotFound
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to update password: %w", err)
+  }
+
+  return nil
+}
+
+// for accounts created through an oidc provider, only succeeds while the user has no password,
+// so a password set in the meantime can't be replaced without knowing it
+func (u DynamoUserStore) SetInitialPassword(username string, passwordHash string, changedAt time.Time) error {
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.
+      Set(expression.Name("password"), expression.Value(passwordHash)).
+      Set(expression.Name("password_changed_at"), expression.Value(changedAt.UTC().Format(time.RFC3339Nano)))).
+    WithCondition(expression.AttributeExists(expression.Name("username")).
+      And(expression.AttributeNotExists(expression.Name("password")))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrPasswordAlreadySet
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to set password: %w", err)
+  }
+
+  return nil
+}
+
+// the same password under a new hash, so password_changed_at stays. Only replaces oldHash, a password
+// changed since it was read is left alone
+func (u DynamoUserStore) RehashPassword(username string, oldHash string, newHash string) error {
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.Set(expression.Name("password"), expression.Value(newHash))).
+    WithCondition(expression.Name("password").Equal(expression.Value(oldHash))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrPasswordChanged
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to rehash password: %w", err)
+  }
+
+  return nil
+}
+
+// status is a reserved word, the builder aliases it
+func (u DynamoUserStore) VerifyEmail(username string) error {
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.
+      Set(expression.Name("status"), expression.Value(types.UserStatusActive)).
+      Remove(expression.Name("verification_sent_at"))).
+    WithCondition(expression.AttributeExists(expression.Name("username"))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrUserNotFound
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to verify email: %w", err)
+  }
+
+  return nil
+}
+
+// checks and records the send in one write, so resends can't be fired faster than minInterval.
+// Only pending accounts get verification emails
+func (u DynamoUserStore) MarkVerificationSent(username string, sentAt time.Time, minInterval time.Duration) error {
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.Set(expression.Name("verification_sent_at"), expression.Value(sentAt.UTC().Format(time.RFC3339)))).
+    WithCondition(expression.Name("status").Equal(expression.Value(types.UserStatusPendingVerification)).
+      And(expression.Or(
+        expression.AttributeNotExists(expression.Name("verification_sent_at")),
+        expression.Name("verification_sent_at").LessThan(expression.Value(sentAt.Add(-minInterval).UTC().Format(time.RFC3339))),
+      ))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrVerificationSentRecently
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to record verification email: %w", err)
+  }
+
+  return nil
+}
+
+// same as MarkVerificationSent for reset emails, so one account's inbox can't be flooded
+func (u DynamoUserStore) MarkPasswordResetSent(username string, sentAt time.Time, minInterval time.Duration) error {
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.Set(expression.Name("password_reset_sent_at"), expression.Value(sentAt.UTC().Format(time.RFC3339)))).
+    WithCondition(expression.AttributeExists(expression.Name("username")).
+      And(expression.Or(
+        expression.AttributeNotExists(expression.Name("password_reset_sent_at")),
+        expression.Name("password_reset_sent_at").LessThan(expression.Value(sentAt.Add(-minInterval).UTC().Format(time.RFC3339))),
+      ))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrPasswordResetSentRecently
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to record password reset email: %w", err)
+  }
+
+  return nil
+}
+
+func (u DynamoUserStore) UpdateProfile(username string, update types.UpdateProfile) (types.User, error) {
+  var user types.User
+
+  fields := []struct {
+    name string
+    value *string
+  }{
+    {"display_name", update.DisplayName},
+    {"bio", update.Bio},
+    {"avatar_url", update.AvatarURL},
+  }
+
+  // empty strings clear the attribute rather than storing ""
+  var updateBuilder expression.UpdateBuilder
+  for _, field := range fields {
+    if field.value == nil {
+      continue
+    }
+
+    if *field.value == "" {
+      updateBuilder = updateBuilder.Remove(expression.Name(field.name))
+    } else {
+      updateBuilder = updateBuilder.Set(expression.Name(field.name), expression.Value(*field.value))
+    }
+  }
+
+  expr, err := expression.NewBuilder().
+    WithUpdate(updateBuilder).
+    WithCondition(expression.AttributeExists(expression.Name("username"))).
+    Build()
+  if err != nil {
+    return user, err
+  }
+
+  result, err := u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+    ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+  })
+
+  if isConditionFailed(err) {
+    return user, ErrUserNotFound
+  }
+
+  if err != nil {
+    return user, fmt.Errorf("failed to update profile: %w", err)
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Attributes, &user)
+  if err != nil {
+    return user, err
+  }
+
+  return user, nil
+}
+
+func (u DynamoUserStore) DeleteUser(username string) error {
+  _, err := u.databaseStore.DeleteItem(&dynamodb.DeleteItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    ConditionExpression: aws.String("attribute_exists(username)"),
+  })
+
+  if isConditionFailed(err) {
+    return ErrUserNotFound
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to delete user: %w", err)
+  }
+
+  return nil
+}
+
+func (u DynamoUserStore) SetPendingMFASecret(username string, secret string) error {
+  return u.updateUser(username, "SET mfa_pending_secret = :secret", map[string]*dynamodb.AttributeValue{
+    ":secret": {
+      S: aws.String(secret),
+    },
+  }, "attribute_exists(username)", ErrUserNotFound)
+}
+
+// moves the pending secret into place and replaces any previous recovery codes
+func (u DynamoUserStore) EnableMFA(username string, secret string, recoveryCodeHashes []string, step int64) error {
+  return u.updateUser(username, "SET mfa_secret = :secret, mfa_enabled = :enabled, mfa_last_step = :step, recovery_codes = :codes REMOVE mfa_pending_secret", map[string]*dynamodb.AttributeValue{
+    ":secret": {
+      S: aws.String(secret),
+    },
+    ":enabled": {
+      BOOL: aws.Bool(true),
+    },
+    ":step": {
+      N: aws.String(strconv.FormatInt(step, 10)),
+    },
+    ":codes": {
+      SS: aws.StringSlice(recoveryCodeHashes),
+    },
+  }, "attribute_exists(username)", ErrUserNotFound)
+}
+
+// conditional so the same code can't log in twice, even from two concurrent requests
+func (u DynamoUserStore) RecordMFAStep(username string, step int64) error {
+  return u.updateUser(username, "SET mfa_last_step = :step", map[string]*dynamodb.AttributeValue{
+    ":step": {
+      N: aws.String(strconv.FormatInt(step, 10)),
+    },
+  }, "attribute_not_exists(mfa_last_step) OR mfa_last_step < :step", ErrMFACodeReused)
+}
+
+// removes the code from the set, it only works once
+func (u DynamoUserStore) UseRecoveryCode(username string, codeHash string) error {
+  return u.updateUser(username, "DELETE recovery_codes :code", map[string]*dynamodb.AttributeValue{
+    ":code": {
+      SS: aws.StringSlice([]string{codeHash}),
+    },
+    ":hash": {
+      S: aws.String(codeHash),
+    },
+  }, "contains(recovery_codes, :hash)", ErrRecoveryCodeInvalid)
+}
+
+// update with a condition, conditionErr is returned when the condition fails
+func (u DynamoUserStore) updateUser(username string, updateExpression string, values map[string]*dynamodb.AttributeValue, condition string, conditionErr error) error {
+  _, err := u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(USERS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "username": {
+        S: aws.String(username),
+      },
+    },
+    UpdateExpression: aws.String(updateExpression),
+    ConditionExpression: aws.String(condition),
+    ExpressionAttributeValues: values,
+  })
+
+  if isConditionFailed(err) {
+    return conditionErr
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to update user: %w", err)
+  }
+
+  return nil
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a client talking to an in-process endpoint. serve gets the operation, like "UpdateItem", and the
+// json request body, and returns the output to send back, or true to fail the condition check
+func fakeDynamoDB(t *testing.T, serve func(operation string, body []byte) (interface{}, bool)) *dynamodb.DynamoDB {
+  t.Helper()
+
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+
+    output, conditionFailed := serve(strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810."), body)
+
+    if conditionFailed {
+      w.WriteHeader(http.StatusBadRequest)
+      w.Write([]byte(`{"__type": "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException", "message": "The conditional request failed"}`))
+      return
+    }
+
+    if output == nil {
+      w.WriteHeader(http.StatusBadRequest)
+      w.Write([]byte(`{"__type": "com.amazonaws.dynamodb.v20120810#ValidationException", "message": "unexpected request"}`))
+      return
+    }
+
+    json.NewEncoder(w).Encode(output)
+  }))
+  t.Cleanup(server.Close)
+
+  return dynamodb.New(session.Must(session.NewSession(&aws.Config{
+    Endpoint: aws.String(server.URL),
+    Region: aws.String("us-east-1"),
+    Credentials: credentials.NewStaticCredentials("test", "test", ""),
+    MaxRetries: aws.Int(0),
+  })))
+}
+
+func number(value *dynamodb.AttributeValue) int64 {
+  if value == nil {
+    return 0
+  }
+
+  n, _ := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+  return n
+}
+
+func numberValue(n int64) *dynamodb.AttributeValue {
+  return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}
+}
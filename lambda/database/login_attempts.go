@@ -0,0 +1,162 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"lambda-func/types"
+)
+
+const LOGIN_ATTEMPTS_TABLE="loginAttemptsTable"
+
+// failed login counters keyed by "user#<username>" or "ip#<source ip>"
+type LoginAttemptStore interface {
+  GetLoginAttempts(id string) (types.LoginAttempts, error)
+  RecordFailedLogin(id string, expiresAt time.Time) (types.LoginAttempts, error)
+  LockLogin(id string, lockedUntil time.Time) error
+  ResetLoginAttempts(id string) error
+}
+
+type DynamoLoginAttemptStore struct {
+  databaseStore *dynamodb.DynamoDB
+}
+
+// no item means no failures, the zero value is returned
+func (u DynamoLoginAttemptStore) GetLoginAttempts(id string) (types.LoginAttempts, error) {
+  attempts := types.LoginAttempts{ID: id}
+
+  result, err := u.databaseStore.GetItem(&dynamodb.GetItemInput{
+    TableName: aws.String(LOGIN_ATTEMPTS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "id": {
+        S: aws.String(id),
+      },
+    },
+  })
+
+  if err != nil {
+    return attempts, fmt.Errorf("failed to get login attempts: %w", err)
+  }
+
+  if result.Item == nil {
+    return attempts, nil
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Item, &attempts)
+  if err != nil {
+    return attempts, err
+  }
+
+  // ttl deletion is lazy
+  if attempts.ExpiresAt != 0 && attempts.ExpiresAt <= time.Now().Unix() {
+    return types.LoginAttempts{ID: id}, nil
+  }
+
+  return attempts, nil
+}
+
+// atomic increment so concurrent guesses are all counted, the counter is forgotten at expiresAt.
+// ttl deletion is lazy, a counter that expired but is still stored starts over at one rather than
+// carrying its old count, and lockout, into the next window
+func (u DynamoLoginAttemptStore) RecordFailedLogin(id string, expiresAt time.Time) (types.LoginAttempts, error) {
+  now := time.Now()
+
+  result, err := u.updateLoginAttempts(id, &dynamodb.UpdateItemInput{
+    UpdateExpression: aws.String("ADD failed_count :one SET expires_at = :expires_at"),
+    ConditionExpression: aws.String("attribute_not_exists(id) OR expires_at > :now"),
+    ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+      ":one": {
+        N: aws.String("1"),
+      },
+      ":expires_at": {
+        N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10)),
+      },
+      ":now": {
+        N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+      },
+    },
+  })
+
+  if isConditionFailed(err) {
+    result, err = u.updateLoginAttempts(id, &dynamodb.UpdateItemInput{
+      UpdateExpression: aws.String("SET failed_count = :one, expires_at = :expires_at REMOVE locked_until"),
+      ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+        ":one": {
+          N: aws.String("1"),
+        },
+        ":expires_at": {
+          N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10)),
+        },
+      },
+    })
+  }
+
+  var attempts types.LoginAttempts
+
+  if err != nil {
+    return attempts, fmt.Errorf("failed to record failed login: %w", err)
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Attributes, &attempts)
+  if err != nil {
+    return attempts, err
+  }
+
+  return attempts, nil
+}
+
+func (u DynamoLoginAttemptStore) updateLoginAttempts(id string, input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+  input.TableName = aws.String(LOGIN_ATTEMPTS_TABLE)
+  input.Key = map[string]*dynamodb.AttributeValue {
+    "id": {
+      S: aws.String(id),
+    },
+  }
+  input.ReturnValues = aws.String(dynamodb.ReturnValueAllNew)
+
+  return u.databaseStore.UpdateItem(input)
+}
+
+func (u DynamoLoginAttemptStore) LockLogin(id string, lockedUntil time.Time) error {
+  _, err := u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(LOGIN_ATTEMPTS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "id": {
+        S: aws.String(id),
+      },
+    },
+    UpdateExpression: aws.String("SET locked_until = :locked_until"),
+    ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+      ":locked_until": {
+        N: aws.String(strconv.FormatInt(lockedUntil.Unix(), 10)),
+      },
+    },
+  })
+
+  if err != nil {
+    return fmt.Errorf("failed to lock login: %w", err)
+  }
+
+  return nil
+}
+
+func (u DynamoLoginAttemptStore) ResetLoginAttempts(id string) error {
+  _, err := u.databaseStore.DeleteItem(&dynamodb.DeleteItemInput{
+    TableName: aws.String(LOGIN_ATTEMPTS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "id": {
+        S: aws.String(id),
+      },
+    },
+  })
+
+  if err != nil {
+    return fmt.Errorf("failed to reset login attempts: %w", err)
+  }
+
+  return nil
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// stands in for the login attempts table, it understands the two updates RecordFailedLogin sends
+// and nothing else, so a changed expression fails the test instead of being guessed at
+func fakeLoginAttemptsTable(t *testing.T, items map[string]map[string]*dynamodb.AttributeValue) *dynamodb.DynamoDB {
+  return fakeDynamoDB(t, func(operation string, body []byte) (interface{}, bool) {
+    var input dynamodb.UpdateItemInput
+    if operation != "UpdateItem" || json.Unmarshal(body, &input) != nil {
+      t.Errorf("unexpected %s request", operation)
+      return nil, false
+    }
+
+    id := *input.Key["id"].S
+    item := items[id]
+    values := input.ExpressionAttributeValues
+
+    switch aws.StringValue(input.UpdateExpression) + " IF " + aws.StringValue(input.ConditionExpression) {
+      case "ADD failed_count :one SET expires_at = :expires_at IF attribute_not_exists(id) OR expires_at > :now":
+        if item != nil && number(item["expires_at"]) <= number(values[":now"]) {
+          return nil, true
+        }
+
+        if item == nil {
+          item = map[string]*dynamodb.AttributeValue{"id": input.Key["id"]}
+        }
+        item["failed_count"] = numberValue(number(item["failed_count"]) + number(values[":one"]))
+        item["expires_at"] = values[":expires_at"]
+
+      case "SET failed_count = :one, expires_at = :expires_at REMOVE locked_until IF ":
+        if item == nil {
+          item = map[string]*dynamodb.AttributeValue{"id": input.Key["id"]}
+        }
+        item["failed_count"] = values[":one"]
+        item["expires_at"] = values[":expires_at"]
+        delete(item, "locked_until")
+
+      default:
+        t.Errorf("unexpected update %q if %q", aws.StringValue(input.UpdateExpression), aws.StringValue(input.ConditionExpression))
+        return nil, false
+    }
+
+    items[id] = item
+    return dynamodb.UpdateItemOutput{Attributes: item}, false
+  })
+}
+
+func TestRecordFailedLogin(t *testing.T) {
+  now := time.Now()
+  expiresAt := now.Add(time.Minute * 15)
+
+  tests := []struct {
+    name string
+    stored map[string]*dynamodb.AttributeValue
+    wantCount int
+  }{
+    {name: "first failure", stored: nil, wantCount: 1},
+    {name: "within the window", stored: map[string]*dynamodb.AttributeValue{
+      "failed_count": numberValue(3),
+      "expires_at": numberValue(now.Add(time.Minute).Unix()),
+    }, wantCount: 4},
+    // GetLoginAttempts already reports this one as no failures, the next typo must not pick up where it left off
+    {name: "expired but not yet deleted by ttl", stored: map[string]*dynamodb.AttributeValue{
+      "failed_count": numberValue(9),
+      "locked_until": numberValue(now.Add(-time.Minute).Unix()),
+      "expires_at": numberValue(now.Add(-time.Second).Unix()),
+    }, wantCount: 1},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      items := map[string]map[string]*dynamodb.AttributeValue{}
+      if tt.stored != nil {
+        tt.stored["id"] = &dynamodb.AttributeValue{S: aws.String("user#alice")}
+        items["user#alice"] = tt.stored
+      }
+
+      store := DynamoLoginAttemptStore{databaseStore: fakeLoginAttemptsTable(t, items)}
+
+      attempts, err := store.RecordFailedLogin("user#alice", expiresAt)
+      if err != nil {
+        t.Fatalf("RecordFailedLogin() error = %v", err)
+      }
+
+      if attempts.FailedCount != tt.wantCount || attempts.ExpiresAt != expiresAt.Unix() || attempts.LockedUntil != 0 {
+        t.Errorf("RecordFailedLogin() = %+v, want %d failures expiring at %d and no lock", attempts, tt.wantCount, expiresAt.Unix())
+      }
+    })
+  }
+}
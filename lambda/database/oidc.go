@@ -0,0 +1,200 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"lambda-func/types"
+)
+
+const (
+  OIDC_STATE_TABLE="oidcStateTable"
+  IDENTITY_LINKS_TABLE="identityLinksTable"
+  IDENTITY_LINKS_USERNAME_INDEX="usernameIndex"
+)
+
+var (
+  // unknown, expired and already used states all look the same to the caller
+  ErrOIDCStateInvalid = errors.New("oidc state is invalid")
+  ErrIdentityLinkNotFound = errors.New("identity link not found")
+  ErrIdentityLinkExists = errors.New("identity link already exists")
+)
+
+type OIDCStateStore interface {
+  InsertOIDCState(state types.OIDCState) error
+  ConsumeOIDCState(stateHash string, now time.Time) (types.OIDCState, error)
+}
+
+type IdentityLinkStore interface {
+  InsertIdentityLink(link types.IdentityLink) error
+  GetIdentityLink(provider string, subject string) (types.IdentityLink, error)
+  DeleteUserIdentityLinks(username string) error
+}
+
+type DynamoOIDCStateStore struct {
+  databaseStore *dynamodb.DynamoDB
+}
+
+type DynamoIdentityLinkStore struct {
+  databaseStore *dynamodb.DynamoDB
+}
+
+func (u DynamoOIDCStateStore) InsertOIDCState(state types.OIDCState) error {
+  item, err := dynamodbattribute.MarshalMap(state)
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.PutItem(&dynamodb.PutItemInput{
+    TableName: aws.String(OIDC_STATE_TABLE),
+    Item: item,
+  })
+  if err != nil {
+    return fmt.Errorf("failed to insert oidc state: %w", err)
+  }
+
+  return nil
+}
+
+// deleted in the same write that checks it, so a callback can't be replayed.
+// ttl deletion is lazy so expiry is checked here as well
+func (u DynamoOIDCStateStore) ConsumeOIDCState(stateHash string, now time.Time) (types.OIDCState, error) {
+  var state types.OIDCState
+
+  result, err := u.databaseStore.DeleteItem(&dynamodb.DeleteItemInput{
+    TableName: aws.String(OIDC_STATE_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "state_hash": {
+        S: aws.String(stateHash),
+      },
+    },
+    ConditionExpression: aws.String("attribute_exists(state_hash) AND expires_at > :now"),
+    ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+      ":now": {
+        N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+      },
+    },
+    ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+  })
+
+  if isConditionFailed(err) {
+    return state, ErrOIDCStateInvalid
+  }
+
+  if err != nil {
+    return state, fmt.Errorf("failed to consume oidc state: %w", err)
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Attributes, &state)
+  if err != nil {
+    return state, err
+  }
+
+  return state, nil
+}
+
+// an external account links to one user only
+func (u DynamoIdentityLinkStore) InsertIdentityLink(link types.IdentityLink) error {
+  item, err := dynamodbattribute.MarshalMap(link)
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.PutItem(&dynamodb.PutItemInput{
+    TableName: aws.String(IDENTITY_LINKS_TABLE),
+    Item: item,
+    ConditionExpression: aws.String("attribute_not_exists(id)"),
+  })
+
+  if isConditionFailed(err) {
+    return ErrIdentityLinkExists
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to insert identity link: %w", err)
+  }
+
+  return nil
+}
+
+func (u DynamoIdentityLinkStore) GetIdentityLink(provider string, subject string) (types.IdentityLink, error) {
+  var link types.IdentityLink
+
+  result, err := u.databaseStore.GetItem(&dynamodb.GetItemInput{
+    TableName: aws.String(IDENTITY_LINKS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "id": {
+        S: aws.String(types.IdentityLinkID(provider, subject)),
+      },
+    },
+  })
+
+  if err != nil {
+    return link, fmt.Errorf("failed to get identity link: %w", err)
+  }
+
+  if result.Item == nil {
+    return link, ErrIdentityLinkNotFound
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Item, &link)
+  if err != nil {
+    return link, err
+  }
+
+  return link, nil
+}
+
+// run when the account is deleted, otherwise the provider account would sign in as whoever takes the name next
+func (u DynamoIdentityLinkStore) DeleteUserIdentityLinks(username string) error {
+  expr, err := expression.NewBuilder().
+    WithKeyCondition(expression.Key("username").Equal(expression.Value(username))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  var items []map[string]*dynamodb.AttributeValue
+
+  err = u.databaseStore.QueryPages(&dynamodb.QueryInput{
+    TableName: aws.String(IDENTITY_LINKS_TABLE),
+    IndexName: aws.String(IDENTITY_LINKS_USERNAME_INDEX),
+    KeyConditionExpression: expr.KeyCondition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  }, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+    items = append(items, page.Items...)
+    return true
+  })
+  if err != nil {
+    return fmt.Errorf("failed to query identity links: %w", err)
+  }
+
+  links := []types.IdentityLink{}
+  err = dynamodbattribute.UnmarshalListOfMaps(items, &links)
+  if err != nil {
+    return fmt.Errorf("failed to unmarshal identity links: %w", err)
+  }
+
+  for _, link := range links {
+    _, err = u.databaseStore.DeleteItem(&dynamodb.DeleteItemInput{
+      TableName: aws.String(IDENTITY_LINKS_TABLE),
+      Key: map[string]*dynamodb.AttributeValue {
+        "id": {
+          S: aws.String(link.ID),
+        },
+      },
+    })
+    if err != nil {
+      return fmt.Errorf("failed to delete identity link: %w", err)
+    }
+  }
+
+  return nil
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// the key attributes a cursor must carry for the table or index being read, every key here is a
+// string. A non empty value pins the attribute, used for the partition the query is limited to
+type keySchema map[string]string
+
+var (
+  blogsTableKey = keySchema{"slug": ""}
+  blogsCreatedAtIndexKey = keySchema{"slug": "", "listing": BLOGS_LISTING_PARTITION, "created_at": ""}
+)
+
+func blogsAuthorIndexKey(author string) keySchema {
+  return keySchema{"slug": "", "author": author, "created_at": ""}
+}
+
+// fetches one dynamodb page starting after startKey, returns the raw items and the LastEvaluatedKey
+type pageFetcher func(startKey map[string]*dynamodb.AttributeValue, limit int64) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error)
+
+// keeps reading until limit items are collected or the table runs out. Filtered out items and
+// the 1 MB page cap both make dynamodb return short pages, so one call is not enough.
+// Asking for the remaining count each round means we never read past the returned items,
+// so the last LastEvaluatedKey is a correct place to resume from
+func paginate(cursor string, schema keySchema, limit int64, fetch pageFetcher) ([]map[string]*dynamodb.AttributeValue, string, error) {
+  startKey, err := decodeCursor(cursor, schema)
+  if err != nil {
+    return nil, "", err
+  }
+
+  items := []map[string]*dynamodb.AttributeValue{}
+
+  for {
+    page, lastKey, err := fetch(startKey, limit-int64(len(items)))
+    if err != nil {
+      return nil, "", err
+    }
+
+    items = append(items, page...)
+    startKey = lastKey
+
+    if len(startKey) == 0 || int64(len(items)) >= limit {
+      break
+    }
+  }
+
+  nextCursor, err := encodeCursor(startKey)
+  if err != nil {
+    return nil, "", err
+  }
+
+  return items, nextCursor, nil
+}
+
+// the cursor is the LastEvaluatedKey as base64 json, opaque to clients
+func encodeCursor(key map[string]*dynamodb.AttributeValue) (string, error) {
+  if len(key) == 0 {
+    return "", nil
+  }
+
+  var plain map[string]interface{}
+  err := dynamodbattribute.UnmarshalMap(key, &plain)
+  if err != nil {
+    return "", err
+  }
+
+  raw, err := json.Marshal(plain)
+  if err != nil {
+    return "", err
+  }
+
+  return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// anything that isn't a key of the schema is refused here, dynamodb would reject it with a
+// ValidationException that looks like a server error
+func decodeCursor(cursor string, schema keySchema) (map[string]*dynamodb.AttributeValue, error) {
+  if cursor == "" {
+    return nil, nil
+  }
+
+  raw, err := base64.RawURLEncoding.DecodeString(cursor)
+  if err != nil {
+    return nil, ErrInvalidCursor
+  }
+
+  var plain map[string]interface{}
+  err = json.Unmarshal(raw, &plain)
+  if err != nil || len(plain) == 0 {
+    return nil, ErrInvalidCursor
+  }
+
+  key, err := dynamodbattribute.MarshalMap(plain)
+  if err != nil || len(key) != len(schema) {
+    return nil, ErrInvalidCursor
+  }
+
+  for name, value := range key {
+    pinned, ok := schema[name]
+    if !ok || value.S == nil || *value.S == "" {
+      return nil, ErrInvalidCursor
+    }
+
+    if pinned != "" && *value.S != pinned {
+      return nil, ErrInvalidCursor
+    }
+  }
+
+  return key, nil
+}
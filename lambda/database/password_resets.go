@@ -0,0 +1,85 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"lambda-func/types"
+)
+
+const PASSWORD_RESETS_TABLE="passwordResetsTable"
+
+// unknown, expired and already used tokens all look the same to the caller
+var ErrPasswordResetInvalid = errors.New("password reset token is invalid")
+
+type PasswordResetStore interface {
+  InsertPasswordReset(reset types.PasswordReset) error
+  ConsumePasswordReset(tokenHash string, usedAt time.Time) (types.PasswordReset, error)
+}
+
+type DynamoPasswordResetStore struct {
+  databaseStore *dynamodb.DynamoDB
+}
+
+func (u DynamoPasswordResetStore) InsertPasswordReset(reset types.PasswordReset) error {
+  item, err := dynamodbattribute.MarshalMap(reset)
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.PutItem(&dynamodb.PutItemInput{
+    TableName: aws.String(PASSWORD_RESETS_TABLE),
+    Item: item,
+  })
+  if err != nil {
+    return fmt.Errorf("failed to insert password reset: %w", err)
+  }
+
+  return nil
+}
+
+// marks the token used in the same write that checks it, two concurrent resets can't both succeed.
+// ttl deletion is lazy so expiry is checked here as well
+func (u DynamoPasswordResetStore) ConsumePasswordReset(tokenHash string, usedAt time.Time) (types.PasswordReset, error) {
+  var reset types.PasswordReset
+
+  result, err := u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(PASSWORD_RESETS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "token_hash": {
+        S: aws.String(tokenHash),
+      },
+    },
+    UpdateExpression: aws.String("SET used_at = :used_at"),
+    ConditionExpression: aws.String("attribute_exists(token_hash) AND attribute_not_exists(used_at) AND expires_at > :now"),
+    ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+      ":used_at": {
+        S: aws.String(usedAt.UTC().Format(time.RFC3339)),
+      },
+      ":now": {
+        N: aws.String(strconv.FormatInt(usedAt.Unix(), 10)),
+      },
+    },
+    ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+  })
+
+  if isConditionFailed(err) {
+    return reset, ErrPasswordResetInvalid
+  }
+
+  if err != nil {
+    return reset, fmt.Errorf("failed to consume password reset: %w", err)
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Attributes, &reset)
+  if err != nil {
+    return reset, err
+  }
+
+  return reset, nil
+}
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"lambda-func/types"
+)
+
+const (
+  REFRESH_TOKENS_TABLE="refreshTokensTable"
+  REFRESH_TOKENS_FAMILY_INDEX="familyIndex"
+  REFRESH_TOKENS_USERNAME_INDEX="usernameIndex"
+)
+
+var (
+  ErrRefreshTokenNotFound = errors.New("refresh token not found")
+  ErrRefreshTokenReused = errors.New("refresh token already used")
+)
+
+type RefreshTokenStore interface {
+  InsertRefreshToken(token types.RefreshToken) error
+  GetRefreshToken(tokenHash string) (types.RefreshToken, error)
+  MarkRefreshTokenUsed(tokenHash string, usedAt time.Time) error
+  RevokeRefreshTokenFamily(familyID string) error
+  RevokeUserRefreshTokens(username string) error
+}
+
+type DynamoRefreshTokenStore struct {
+  databaseStore *dynamodb.DynamoDB
+}
+
+func (u DynamoRefreshTokenStore) InsertRefreshToken(token types.RefreshToken) error {
+  item, err := dynamodbattribute.MarshalMap(token)
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.PutItem(&dynamodb.PutItemInput{
+    TableName: aws.String(REFRESH_TOKENS_TABLE),
+    Item: item,
+  })
+  if err != nil {
+    return fmt.Errorf("failed to insert refresh token: %w", err)
+  }
+
+  return nil
+}
+
+func (u DynamoRefreshTokenStore) GetRefreshToken(tokenHash string) (types.RefreshToken, error) {
+  var token types.RefreshToken
+  result, err := u.databaseStore.GetItem(&dynamodb.GetItemInput{
+    TableName: aws.String(REFRESH_TOKENS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "token_hash": {
+        S: aws.String(tokenHash),
+      },
+    },
+  })
+
+  if err != nil {
+    return token, err
+  }
+
+  if result.Item == nil {
+    return token, ErrRefreshTokenNotFound
+  }
+
+  err = dynamodbattribute.UnmarshalMap(result.Item, &token)
+  if err != nil {
+    return token, err
+  }
+
+  return token, nil
+}
+
+// conditional so two concurrent refreshes with the same token can't both succeed,
+// the loser gets ErrRefreshTokenReused
+func (u DynamoRefreshTokenStore) MarkRefreshTokenUsed(tokenHash string, usedAt time.Time) error {
+  expr, err := expression.NewBuilder().
+    WithUpdate(expression.Set(expression.Name("used_at"), expression.Value(usedAt.UTC().Format(time.RFC3339)))).
+    WithCondition(expression.And(
+      expression.AttributeExists(expression.Name("token_hash")),
+      expression.AttributeNotExists(expression.Name("used_at")),
+    )).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  _, err = u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+    TableName: aws.String(REFRESH_TOKENS_TABLE),
+    Key: map[string]*dynamodb.AttributeValue {
+      "token_hash": {
+        S: aws.String(tokenHash),
+      },
+    },
+    UpdateExpression: expr.Update(),
+    ConditionExpression: expr.Condition(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  })
+
+  if isConditionFailed(err) {
+    return ErrRefreshTokenReused
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to mark refresh token used: %w", err)
+  }
+
+  return nil
+}
+
+// marks every token of the family revoked, used ones included so a later reuse is still detected
+func (u DynamoRefreshTokenStore) RevokeRefreshTokenFamily(familyID string) error {
+  return u.revokeWhere(REFRESH_TOKENS_FAMILY_INDEX, expression.Key("family_id").Equal(expression.Value(familyID)))
+}
+
+func (u DynamoRefreshTokenStore) RevokeUserRefreshTokens(username string) error {
+  return u.revokeWhere(REFRESH_TOKENS_USERNAME_INDEX, expression.Key("username").Equal(expression.Value(username)))
+}
+
+func (u DynamoRefreshTokenStore) revokeWhere(indexName string, keyCondition expression.KeyConditionBuilder) error {
+  expr, err := expression.NewBuilder().
+    WithKeyCondition(keyCondition).
+    WithProjection(expression.NamesList(expression.Name("token_hash"))).
+    Build()
+  if err != nil {
+    return err
+  }
+
+  var tokenHashes []string
+
+  err = u.databaseStore.QueryPages(&dynamodb.QueryInput{
+    TableName: aws.String(REFRESH_TOKENS_TABLE),
+    IndexName: aws.String(indexName),
+    KeyConditionExpression: expr.KeyCondition(),
+    ProjectionExpression: expr.Projection(),
+    ExpressionAttributeNames: expr.Names(),
+    ExpressionAttributeValues: expr.Values(),
+  }, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+    for _, item := range page.Items {
+      if hash := item["token_hash"]; hash != nil && hash.S != nil {
+        tokenHashes = append(tokenHashes, *hash.S)
+      }
+    }
+    return true
+  })
+  if err != nil {
+    return fmt.Errorf("failed to query refresh tokens: %w", err)
+  }
+
+  for _, tokenHash := range tokenHashes {
+    _, err := u.databaseStore.UpdateItem(&dynamodb.UpdateItemInput{
+      TableName: aws.String(REFRESH_TOKENS_TABLE),
+      Key: map[string]*dynamodb.AttributeValue {
+        "token_hash": {
+          S: aws.String(tokenHash),
+        },
+      },
+      UpdateExpression: aws.String("SET revoked = :revoked"),
+      ExpressionAttributeValues: map[string]*dynamodb.AttributeValue {
+        ":revoked": {
+          BOOL: aws.Bool(true),
+        },
+      },
+    })
+    if err != nil {
+      return fmt.Errorf("failed to revoke refresh token: %w", err)
+    }
+  }
+
+  return nil
+}
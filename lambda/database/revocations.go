@@ -0,0 +1,153 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const REVOKED_TOKENS_TABLE="revokedTokensTable"
+
+var ErrTokenAlreadyUsed = errors.New("token already used")
+
+// one table holds two kinds of items, "jti#<id>" for a single revoked access token and
+// "user#<username>" for "every token of this user issued up to revoked_before", in seconds with
+// millisecond decimals.
+// Both expire through the table ttl once the tokens they cover can no longer be valid
+type RevocationStore interface {
+  RevokeToken(tokenID string, expiresAt time.Time) error
+  RevokeUserTokens(username string, revokedBefore time.Time, expiresAt time.Time) error
+  IsRevoked(tokenID string, username string, issuedAt time.Time) (bool, error)
+  ConsumeToken(tokenID string, expiresAt time.Time) error
+}
+
+type DynamoRevocationStore struct {
+  databaseStore *dynamodb.DynamoDB
+}
+
+func (u DynamoRevocationStore) RevokeToken(tokenID string, expiresAt time.Time) error {
+  _, err := u.databaseStore.PutItem(&dynamodb.PutItemInput{
+    TableName: aws.String(REVOKED_TOKENS_TABLE),
+    Item: map[string]*dynamodb.AttributeValue{
+      "id": {
+        S: aws.String(tokenRevocationKey(tokenID)),
+      },
+      "expires_at": {
+        N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10)),
+      },
+    },
+  })
+  if err != nil {
+    return fmt.Errorf("failed to revoke token: %w", err)
+  }
+
+  return nil
+}
+
+// for single use tokens, revokes it and fails with ErrTokenAlreadyUsed when it already was
+func (u DynamoRevocationStore) ConsumeToken(tokenID string, expiresAt time.Time) error {
+  _, err := u.databaseStore.PutItem(&dynamodb.PutItemInput{
+    TableName: aws.String(REVOKED_TOKENS_TABLE),
+    Item: map[string]*dynamodb.AttributeValue{
+      "id": {
+        S: aws.String(tokenRevocationKey(tokenID)),
+      },
+      "expires_at": {
+        N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10)),
+      },
+    },
+    ConditionExpression: aws.String("attribute_not_exists(id)"),
+  })
+
+  if isConditionFailed(err) {
+    return ErrTokenAlreadyUsed
+  }
+
+  if err != nil {
+    return fmt.Errorf("failed to use token: %w", err)
+  }
+
+  return nil
+}
+
+func (u DynamoRevocationStore) RevokeUserTokens(username string, revokedBefore time.Time, expiresAt time.Time) error {
+  _, err := u.databaseStore.PutItem(&dynamodb.PutItemInput{
+    TableName: aws.String(REVOKED_TOKENS_TABLE),
+    Item: map[string]*dynamodb.AttributeValue{
+      "id": {
+        S: aws.String(userRevocationKey(username)),
+      },
+      "revoked_before": {
+        N: aws.String(strconv.FormatFloat(float64(revokedBefore.UnixMilli()) / 1000, 'f', 3, 64)),
+      },
+      "expires_at": {
+        N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10)),
+      },
+    },
+  })
+  if err != nil {
+    return fmt.Errorf("failed to revoke user tokens: %w", err)
+  }
+
+  return nil
+}
+
+// both checks in one round trip since this runs on every authenticated request
+func (u DynamoRevocationStore) IsRevoked(tokenID string, username string, issuedAt time.Time) (bool, error) {
+  result, err := u.databaseStore.BatchGetItem(&dynamodb.BatchGetItemInput{
+    RequestItems: map[string]*dynamodb.KeysAndAttributes{
+      REVOKED_TOKENS_TABLE: {
+        Keys: []map[string]*dynamodb.AttributeValue{
+          {"id": {S: aws.String(tokenRevocationKey(tokenID))}},
+          {"id": {S: aws.String(userRevocationKey(username))}},
+        },
+      },
+    },
+  })
+  if err != nil {
+    return true, fmt.Errorf("failed to check token revocation: %w", err)
+  }
+
+  // unprocessed keys mean we don't know, fail closed
+  if len(result.UnprocessedKeys) > 0 {
+    return true, fmt.Errorf("token revocation check was throttled")
+  }
+
+  for _, item := range result.Responses[REVOKED_TOKENS_TABLE] {
+    // ttl deletion is lazy, ignore items that already expired
+    if expiresAt := item["expires_at"]; expiresAt != nil && expiresAt.N != nil {
+      expires, _ := strconv.ParseInt(*expiresAt.N, 10, 64)
+      if expires <= time.Now().Unix() {
+        continue
+      }
+    }
+
+    revokedBefore := item["revoked_before"]
+    if revokedBefore == nil || revokedBefore.N == nil {
+      // jti item
+      return true, nil
+    }
+
+    // items written before the cutoff had decimals hold whole seconds, which parse the same.
+    // A token issued in the very millisecond of the cutoff is revoked too
+    before, _ := strconv.ParseFloat(*revokedBefore.N, 64)
+    if issuedAt.UnixMilli() <= int64(math.Round(before * 1000)) {
+      return true, nil
+    }
+  }
+
+  return false, nil
+}
+
+func tokenRevocationKey(tokenID string) string {
+  return "jti#" + tokenID
+}
+
+func userRevocationKey(username string) string {
+  return "user#" + username
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// stands in for the revoked tokens table, puts and batch gets by id
+func fakeRevokedTokensTable(t *testing.T, items map[string]map[string]*dynamodb.AttributeValue) *dynamodb.DynamoDB {
+  return fakeDynamoDB(t, func(operation string, body []byte) (interface{}, bool) {
+    switch operation {
+      case "PutItem":
+        var input dynamodb.PutItemInput
+        json.Unmarshal(body, &input)
+
+        id := *input.Item["id"].S
+        if aws.StringValue(input.ConditionExpression) == "attribute_not_exists(id)" && items[id] != nil {
+          return nil, true
+        }
+
+        items[id] = input.Item
+        return dynamodb.PutItemOutput{}, false
+
+      case "BatchGetItem":
+        var input dynamodb.BatchGetItemInput
+        json.Unmarshal(body, &input)
+
+        found := []map[string]*dynamodb.AttributeValue{}
+        for _, key := range input.RequestItems[REVOKED_TOKENS_TABLE].Keys {
+          if item := items[*key["id"].S]; item != nil {
+            found = append(found, item)
+          }
+        }
+
+        return dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]*dynamodb.AttributeValue{REVOKED_TOKENS_TABLE: found}}, false
+    }
+
+    t.Errorf("unexpected %s request", operation)
+    return nil, false
+  })
+}
+
+func TestRevokeUserTokensCutoff(t *testing.T) {
+  // a cutoff with a millisecond part, tokens issued in the rest of that second come after it
+  cutoff := time.Unix(1700000000, 250 * int64(time.Millisecond))
+
+  tests := []struct {
+    name string
+    issuedAt time.Time
+    wantRevoked bool
+  }{
+    {"issued a second before", cutoff.Add(-time.Second), true},
+    {"issued a millisecond before", cutoff.Add(-time.Millisecond), true},
+    {"issued in the same millisecond", cutoff.Add(time.Microsecond * 500), true},
+    // the fresh pair handed out right after changing the password
+    {"issued a millisecond after, in the same second", cutoff.Add(time.Millisecond), false},
+    {"issued a second after", cutoff.Add(time.Second), false},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      items := map[string]map[string]*dynamodb.AttributeValue{}
+      store := DynamoRevocationStore{databaseStore: fakeRevokedTokensTable(t, items)}
+
+      err := store.RevokeUserTokens("alice", cutoff, time.Now().Add(time.Hour))
+      if err != nil {
+        t.Fatalf("RevokeUserTokens() error = %v", err)
+      }
+
+      revoked, err := store.IsRevoked("token-1", "alice", tt.issuedAt)
+      if err != nil {
+        t.Fatalf("IsRevoked() error = %v", err)
+      }
+
+      if revoked != tt.wantRevoked {
+        t.Errorf("IsRevoked() = %v, want %v", revoked, tt.wantRevoked)
+      }
+
+      // somebody else's tokens are untouched
+      revoked, _ = store.IsRevoked("token-2", "bob", tt.issuedAt)
+      if revoked {
+        t.Errorf("IsRevoked() for another user = true")
+      }
+    })
+  }
+}
+
+func TestIsRevokedStoredItems(t *testing.T) {
+  issuedAt := time.Unix(1700000000, 0)
+  live := numberValue(time.Now().Add(time.Hour).Unix())
+
+  tests := []struct {
+    name string
+    item map[string]*dynamodb.AttributeValue
+    issuedAt time.Time
+    wantRevoked bool
+  }{
+    {"revoked token", map[string]*dynamodb.AttributeValue{
+      "id": {S: aws.String("jti#token-1")},
+      "expires_at": live,
+    }, issuedAt, true},
+    // revoke-all items written before the cutoff had milliseconds hold whole seconds
+    {"whole second cutoff, issued in that second", map[string]*dynamodb.AttributeValue{
+      "id": {S: aws.String("user#alice")},
+      "revoked_before": {N: aws.String(strconv.FormatInt(issuedAt.Unix(), 10))},
+      "expires_at": live,
+    }, issuedAt, true},
+    {"whole second cutoff, issued just after", map[string]*dynamodb.AttributeValue{
+      "id": {S: aws.String("user#alice")},
+      "revoked_before": {N: aws.String(strconv.FormatInt(issuedAt.Unix(), 10))},
+      "expires_at": live,
+    }, issuedAt.Add(time.Millisecond), false},
+    // ttl deletion is lazy
+    {"expired revoke-all not yet deleted", map[string]*dynamodb.AttributeValue{
+      "id": {S: aws.String("user#alice")},
+      "revoked_before": {N: aws.String(strconv.FormatInt(issuedAt.Unix() + 60, 10))},
+      "expires_at": numberValue(time.Now().Add(-time.Second).Unix()),
+    }, issuedAt, false},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      items := map[string]map[string]*dynamodb.AttributeValue{*tt.item["id"].S: tt.item}
+      store := DynamoRevocationStore{databaseStore: fakeRevokedTokensTable(t, items)}
+
+      revoked, err := store.IsRevoked("token-1", "alice", tt.issuedAt)
+      if err != nil {
+        t.Fatalf("IsRevoked() error = %v", err)
+      }
+
+      if revoked != tt.wantRevoked {
+        t.Errorf("IsRevoked() = %v, want %v", revoked, tt.wantRevoked)
+      }
+    })
+  }
+}
@@ -0,0 +1,114 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// the owasp minimum for argon2id, 19 MiB fits comfortably in a small lambda
+const (
+  DEFAULT_ARGON2_MEMORY = 19 * 1024
+  DEFAULT_ARGON2_TIME = 2
+  DEFAULT_ARGON2_THREADS = 1
+  ARGON2_SALT_LENGTH = 16
+  ARGON2_KEY_LENGTH = 32
+)
+
+// hashes are stored in the PHC string format, $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+type Argon2idHasher struct {
+  Memory uint32
+  Time uint32
+  Threads uint8
+}
+
+type argon2Params struct {
+  memory uint32
+  time uint32
+  threads uint8
+  salt []byte
+  key []byte
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+  salt := make([]byte, ARGON2_SALT_LENGTH)
+  _, err := rand.Read(salt)
+  if err != nil {
+    return "", err
+  }
+
+  key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, ARGON2_KEY_LENGTH)
+
+  return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+    argon2.Version, h.Memory, h.Time, h.Threads,
+    base64.RawStdEncoding.EncodeToString(salt),
+    base64.RawStdEncoding.EncodeToString(key),
+  ), nil
+}
+
+// the parameters stored with the hash are used, not the configured ones
+func (h Argon2idHasher) Verify(encoded string, password string) (bool, error) {
+  params, err := decodeArgon2id(encoded)
+  if err != nil {
+    return false, err
+  }
+
+  key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+
+  return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+  params, err := decodeArgon2id(encoded)
+  if err != nil {
+    return true
+  }
+
+  return params.memory < h.Memory || params.time < h.Time || params.threads < h.Threads || len(params.key) < ARGON2_KEY_LENGTH
+}
+
+func (h Argon2idHasher) validate() error {
+  if h.Memory < 8 * uint32(h.Threads) || h.Time < 1 || h.Threads < 1 {
+    return errors.New("ARGON2_MEMORY, ARGON2_TIME and ARGON2_THREADS must be positive, with at least 8 KiB of memory per thread")
+  }
+
+  return nil
+}
+
+func decodeArgon2id(encoded string) (argon2Params, error) {
+  var params argon2Params
+
+  // "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+  parts := strings.Split(encoded, "$")
+  if len(parts) != 6 || parts[1] != "argon2id" {
+    return params, ErrUnsupportedHash
+  }
+
+  var version int
+  _, err := fmt.Sscanf(parts[2], "v=%d", &version)
+  if err != nil || version != argon2.Version {
+    return params, fmt.Errorf("unsupported argon2 version: %s", parts[2])
+  }
+
+  _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+  if err != nil {
+    return params, fmt.Errorf("malformed argon2 parameters: %w", err)
+  }
+
+  params.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+  if err != nil {
+    return params, fmt.Errorf("malformed argon2 salt: %w", err)
+  }
+
+  params.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+  if err != nil || len(params.key) == 0 {
+    return params, errors.New("malformed argon2 key")
+  }
+
+  return params, nil
+}
@@ -0,0 +1,58 @@
+package hasher
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accounts made with the old default of 10 are upgraded on their next login
+const DEFAULT_BCRYPT_COST = 12
+
+type BcryptHasher struct {
+  Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+  hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+  if err != nil {
+    return "", err
+  }
+
+  return string(hashedPassword), nil
+}
+
+func (h BcryptHasher) Verify(encoded string, password string) (bool, error) {
+  if _, err := bcrypt.Cost([]byte(encoded)); err != nil {
+    return false, ErrUnsupportedHash
+  }
+
+  err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+  if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+    return false, nil
+  }
+
+  if err != nil {
+    return false, err
+  }
+
+  return true, nil
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+  cost, err := bcrypt.Cost([]byte(encoded))
+  if err != nil {
+    return true
+  }
+
+  return cost < h.Cost
+}
+
+func (h BcryptHasher) validate() error {
+  if h.Cost < bcrypt.MinCost || h.Cost > bcrypt.MaxCost {
+    return fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+  }
+
+  return nil
+}
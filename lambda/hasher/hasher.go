@@ -0,0 +1,107 @@
+package hasher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// returned by Verify when the encoded hash was made by a different algorithm
+var ErrUnsupportedHash = errors.New("unsupported password hash format")
+
+// Hasher turns passwords into self describing encoded hashes, the algorithm and its
+// parameters are part of the string so old hashes keep verifying after the settings change
+type Hasher interface {
+  Hash(password string) (string, error)
+  Verify(encoded string, password string) (bool, error)
+  // true when encoded is from another algorithm or weaker parameters than Hash uses now
+  NeedsRehash(encoded string) bool
+}
+
+// hashes with the configured algorithm and verifies hashes from any of the known ones
+type PasswordHasher struct {
+  current Hasher
+  known []Hasher
+
+  dummyOnce *sync.Once
+  dummyHash *string
+}
+
+// PASSWORD_HASHER picks bcrypt (default) or argon2id. BCRYPT_COST, ARGON2_MEMORY (KiB),
+// ARGON2_TIME and ARGON2_THREADS override the parameters
+func NewPasswordHasher() (PasswordHasher, error) {
+  bcryptHasher := BcryptHasher{Cost: envInt("BCRYPT_COST", DEFAULT_BCRYPT_COST)}
+  argon2Hasher := Argon2idHasher{
+    Memory: uint32(envInt("ARGON2_MEMORY", DEFAULT_ARGON2_MEMORY)),
+    Time: uint32(envInt("ARGON2_TIME", DEFAULT_ARGON2_TIME)),
+    Threads: uint8(envInt("ARGON2_THREADS", DEFAULT_ARGON2_THREADS)),
+  }
+
+  passwordHasher := PasswordHasher{
+    known: []Hasher{bcryptHasher, argon2Hasher},
+    dummyOnce: &sync.Once{},
+    dummyHash: new(string),
+  }
+
+  switch algorithm := os.Getenv("PASSWORD_HASHER"); algorithm {
+    case "", "bcrypt":
+      passwordHasher.current = bcryptHasher
+    case "argon2id":
+      passwordHasher.current = argon2Hasher
+    default:
+      return passwordHasher, fmt.Errorf("unknown PASSWORD_HASHER %q, use bcrypt or argon2id", algorithm)
+  }
+
+  if err := bcryptHasher.validate(); err != nil {
+    return passwordHasher, err
+  }
+
+  if err := argon2Hasher.validate(); err != nil {
+    return passwordHasher, err
+  }
+
+  return passwordHasher, nil
+}
+
+func (p PasswordHasher) Hash(password string) (string, error) {
+  return p.current.Hash(password)
+}
+
+// a malformed or unknown hash never matches
+func (p PasswordHasher) Verify(encoded string, password string) (bool, error) {
+  for _, hasher := range p.known {
+    ok, err := hasher.Verify(encoded, password)
+    if errors.Is(err, ErrUnsupportedHash) {
+      continue
+    }
+
+    return ok, err
+  }
+
+  return false, ErrUnsupportedHash
+}
+
+func (p PasswordHasher) NeedsRehash(encoded string) bool {
+  return p.current.NeedsRehash(encoded)
+}
+
+// a real hash with the current settings, checking a password against it when the user
+// doesn't exist makes the response take as long as for a real user with a wrong password
+func (p PasswordHasher) DummyHash() string {
+  p.dummyOnce.Do(func() {
+    *p.dummyHash, _ = p.current.Hash("not-a-real-password")
+  })
+
+  return *p.dummyHash
+}
+
+func envInt(name string, fallback int) int {
+  value, err := strconv.Atoi(os.Getenv(name))
+  if err != nil {
+    return fallback
+  }
+
+  return value
+}
@@ -0,0 +1,150 @@
+package hasher
+
+import (
+	"errors"
+	"testing"
+)
+
+// cheap parameters so the tests run fast, the rules are the same as at the defaults
+func newTestHasher(t *testing.T, algorithm string, bcryptCost string, argon2Time string) PasswordHasher {
+  t.Helper()
+
+  t.Setenv("PASSWORD_HASHER", algorithm)
+  t.Setenv("BCRYPT_COST", bcryptCost)
+  t.Setenv("ARGON2_MEMORY", "64")
+  t.Setenv("ARGON2_TIME", argon2Time)
+  t.Setenv("ARGON2_THREADS", "1")
+
+  passwordHasher, err := NewPasswordHasher()
+  if err != nil {
+    t.Fatalf("NewPasswordHasher: %v", err)
+  }
+
+  return passwordHasher
+}
+
+func TestVerifyAcrossAlgorithms(t *testing.T) {
+  bcryptHasher := newTestHasher(t, "bcrypt", "4", "1")
+  bcryptHash, err := bcryptHasher.Hash("correct horse")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  argon2Hasher := newTestHasher(t, "argon2id", "4", "1")
+  argon2Hash, err := argon2Hasher.Hash("correct horse")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    name string
+    encoded string
+    password string
+    want bool
+    wantErr error
+  }{
+    {"bcrypt right password", bcryptHash, "correct horse", true, nil},
+    {"bcrypt wrong password", bcryptHash, "battery staple", false, nil},
+    {"argon2id right password", argon2Hash, "correct horse", true, nil},
+    {"argon2id wrong password", argon2Hash, "battery staple", false, nil},
+    {"empty hash", "", "correct horse", false, ErrUnsupportedHash},
+    {"unknown format", "$scrypt$abc", "correct horse", false, ErrUnsupportedHash},
+  }
+
+  // either configured algorithm verifies hashes made by the other
+  for _, passwordHasher := range []PasswordHasher{bcryptHasher, argon2Hasher} {
+    for _, test := range tests {
+      t.Run(test.name, func(t *testing.T) {
+        ok, err := passwordHasher.Verify(test.encoded, test.password)
+        if ok != test.want {
+          t.Errorf("Verify = %v, want %v", ok, test.want)
+        }
+
+        if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+          t.Errorf("Verify error = %v, want %v", err, test.wantErr)
+        }
+
+        if test.wantErr == nil && err != nil {
+          t.Errorf("Verify error = %v", err)
+        }
+      })
+    }
+  }
+}
+
+func TestVerifyMalformedArgon2id(t *testing.T) {
+  passwordHasher := newTestHasher(t, "argon2id", "4", "1")
+
+  for _, encoded := range []string{
+    "$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5",
+    "$argon2id$v=19$m=64$c2FsdA$a2V5",
+    "$argon2id$v=19$m=64,t=1,p=1$!!$a2V5",
+    "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+  } {
+    ok, err := passwordHasher.Verify(encoded, "correct horse")
+    if ok || err == nil {
+      t.Errorf("Verify(%q) = %v, %v, want false and an error", encoded, ok, err)
+    }
+  }
+}
+
+func TestNeedsRehash(t *testing.T) {
+  bcrypt4, _ := newTestHasher(t, "bcrypt", "4", "1").Hash("correct horse")
+  bcrypt5, _ := newTestHasher(t, "bcrypt", "5", "1").Hash("correct horse")
+  argon2t1, _ := newTestHasher(t, "argon2id", "4", "1").Hash("correct horse")
+  argon2t2, _ := newTestHasher(t, "argon2id", "4", "2").Hash("correct horse")
+
+  tests := []struct {
+    name string
+    algorithm string
+    bcryptCost string
+    argon2Time string
+    encoded string
+    want bool
+  }{
+    {"bcrypt at the current cost", "bcrypt", "5", "1", bcrypt5, false},
+    {"bcrypt at a lower cost", "bcrypt", "5", "1", bcrypt4, true},
+    {"bcrypt at a higher cost", "bcrypt", "4", "1", bcrypt5, false},
+    {"argon2id while bcrypt is current", "bcrypt", "4", "1", argon2t1, true},
+    {"argon2id at the current parameters", "argon2id", "4", "2", argon2t2, false},
+    {"argon2id with less time", "argon2id", "4", "2", argon2t1, true},
+    {"bcrypt while argon2id is current", "argon2id", "4", "1", bcrypt4, true},
+    {"malformed", "bcrypt", "4", "1", "not a hash", true},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      passwordHasher := newTestHasher(t, test.algorithm, test.bcryptCost, test.argon2Time)
+
+      if got := passwordHasher.NeedsRehash(test.encoded); got != test.want {
+        t.Errorf("NeedsRehash = %v, want %v", got, test.want)
+      }
+    })
+  }
+}
+
+func TestNewPasswordHasherRejectsBadSettings(t *testing.T) {
+  tests := []struct {
+    name string
+    env map[string]string
+  }{
+    {"unknown algorithm", map[string]string{"PASSWORD_HASHER": "md5"}},
+    {"bcrypt cost too low", map[string]string{"BCRYPT_COST": "3"}},
+    {"bcrypt cost too high", map[string]string{"BCRYPT_COST": "32"}},
+    {"argon2 time zero", map[string]string{"ARGON2_TIME": "0"}},
+    {"argon2 memory below 8 KiB per thread", map[string]string{"ARGON2_MEMORY": "8", "ARGON2_THREADS": "2"}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      for _, name := range []string{"PASSWORD_HASHER", "BCRYPT_COST", "ARGON2_MEMORY", "ARGON2_TIME", "ARGON2_THREADS"} {
+        t.Setenv(name, test.env[name])
+      }
+
+      _, err := NewPasswordHasher()
+      if err == nil {
+        t.Error("NewPasswordHasher accepted the settings")
+      }
+    })
+  }
+}
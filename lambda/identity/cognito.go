@@ -0,0 +1,99 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"lambda-func/keys"
+	"lambda-func/types"
+)
+
+// id tokens from a cognito user pool app client, as checked by the api gateway cognito authorizer
+type CognitoTokenVerifier struct {
+  issuer string
+  clientID string
+  jwks keys.RemoteJWKS
+}
+
+type cognitoClaims struct {
+  TokenUse string `json:"token_use"`
+  Username string `json:"cognito:username"`
+  Groups []string `json:"cognito:groups"`
+  // id tokens issued before cognito added jti only carry the jti of the session's access token
+  OriginJTI string `json:"origin_jti"`
+  jwt.RegisteredClaims
+}
+
+func NewCognitoTokenVerifier(region string, userPoolID string, clientID string) CognitoTokenVerifier {
+  issuer := fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/%s", region, userPoolID)
+
+  return CognitoTokenVerifier{
+    issuer: issuer,
+    clientID: clientID,
+    jwks: keys.NewRemoteJWKS(issuer + "/.well-known/jwks.json", &http.Client{Timeout: 5 * time.Second}),
+  }
+}
+
+// cognito groups named like our roles become roles, anyone else is a reader
+func (v CognitoTokenVerifier) VerifyToken(tokenString string) (*types.Claims, error) {
+  claims := &cognitoClaims{}
+
+  _, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    return v.jwks.PublicKey(kid)
+  },
+    jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+    jwt.WithIssuer(v.issuer),
+    jwt.WithAudience(v.clientID),
+    jwt.WithExpirationRequired(),
+    jwt.WithIssuedAt(),
+  )
+
+  if err != nil {
+    return nil, fmt.Errorf("unauthorized: %w", err)
+  }
+
+  if claims.TokenUse != "id" {
+    return nil, errors.New("token is not a cognito id token - unauthorized")
+  }
+
+  if claims.Username == "" || claims.IssuedAt == nil {
+    return nil, errors.New("token has no username or iat - unauthorized")
+  }
+
+  tokenID := claims.ID
+  if tokenID == "" {
+    tokenID = claims.OriginJTI
+  }
+
+  if tokenID == "" {
+    return nil, errors.New("token has no jti - unauthorized")
+  }
+
+  roles := []string{}
+  for _, group := range claims.Groups {
+    if types.IsValidRole(group) {
+      roles = append(roles, group)
+    }
+  }
+
+  if len(roles) == 0 {
+    roles = append(roles, types.RoleReader)
+  }
+
+  return &types.Claims{
+    Roles: roles,
+    TokenUse: types.TokenUseAccess,
+    RegisteredClaims: jwt.RegisteredClaims{
+      Subject: claims.Username,
+      Issuer: claims.Issuer,
+      Audience: claims.Audience,
+      ExpiresAt: claims.ExpiresAt,
+      IssuedAt: claims.IssuedAt,
+      ID: tokenID,
+    },
+  }, nil
+}
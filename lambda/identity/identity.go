@@ -0,0 +1,69 @@
+package identity
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"lambda-func/keys"
+	"lambda-func/types"
+)
+
+// where users and their tokens come from, picked with IDENTITY_BACKEND
+const (
+  BACKEND_LOCAL = "local"
+  BACKEND_COGNITO = "cognito"
+)
+
+// cognito lets an app client's id tokens live for up to a day, whatever the pool is set to
+const COGNITO_MAX_ID_TOKEN_TTL = time.Hour * 24
+
+// TokenVerifier checks a bearer token and returns its claims, the subject is always the username
+type TokenVerifier interface {
+  VerifyToken(tokenString string) (*types.Claims, error)
+}
+
+// local unless IDENTITY_BACKEND is cognito
+func Backend() string {
+  if os.Getenv("IDENTITY_BACKEND") == BACKEND_COGNITO {
+    return BACKEND_COGNITO
+  }
+
+  return BACKEND_LOCAL
+}
+
+// the longest a token the backend issues can stay valid, a revoke-all has to be kept that long
+func MaxTokenTTL(tokenConfig types.TokenConfig) time.Duration {
+  if Backend() == BACKEND_COGNITO && COGNITO_MAX_ID_TOKEN_TTL > tokenConfig.TTL {
+    return COGNITO_MAX_ID_TOKEN_TTL
+  }
+
+  return tokenConfig.TTL
+}
+
+// the backend's verifier, cognito reads COGNITO_USER_POOL_ID, COGNITO_CLIENT_ID and AWS_REGION
+func NewTokenVerifier(publicKeys keys.PublicKeys, tokenConfig types.TokenConfig) (TokenVerifier, error) {
+  if Backend() == BACKEND_LOCAL {
+    return LocalTokenVerifier{publicKeys: publicKeys, tokenConfig: tokenConfig}, nil
+  }
+
+  region := os.Getenv("AWS_REGION")
+  userPoolID := os.Getenv("COGNITO_USER_POOL_ID")
+  clientID := os.Getenv("COGNITO_CLIENT_ID")
+
+  if region == "" || userPoolID == "" || clientID == "" {
+    return nil, fmt.Errorf("IDENTITY_BACKEND is cognito but AWS_REGION, COGNITO_USER_POOL_ID or COGNITO_CLIENT_ID is not set")
+  }
+
+  return NewCognitoTokenVerifier(region, userPoolID, clientID), nil
+}
+
+// access tokens signed by this api
+type LocalTokenVerifier struct {
+  publicKeys keys.PublicKeys
+  tokenConfig types.TokenConfig
+}
+
+func (v LocalTokenVerifier) VerifyToken(tokenString string) (*types.Claims, error) {
+  return types.ParseTokenWithPublicKeys(tokenString, types.TokenUseAccess, v.publicKeys, v.tokenConfig)
+}
@@ -0,0 +1,98 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// public keys only, in the rfc 7517 format other services fetch to verify our tokens
+type JWKS struct {
+  Keys []JWK `json:"keys"`
+}
+
+type JWK struct {
+  Kid string `json:"kid"`
+  Kty string `json:"kty"`
+  Alg string `json:"alg,omitempty"`
+  Use string `json:"use,omitempty"`
+  N string `json:"n,omitempty"`
+  E string `json:"e,omitempty"`
+  Crv string `json:"crv,omitempty"`
+  X string `json:"x,omitempty"`
+  Y string `json:"y,omitempty"`
+}
+
+func NewJWK(kid string, algorithm string, publicKey crypto.PublicKey) (JWK, error) {
+  switch key := publicKey.(type) {
+    case *rsa.PublicKey:
+      return JWK{
+        Kid: kid,
+        Kty: "RSA",
+        Alg: algorithm,
+        Use: "sig",
+        N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+        E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+      }, nil
+    case *ecdsa.PublicKey:
+      // coordinates are fixed width, 32 bytes for P-256
+      size := (key.Curve.Params().BitSize + 7) / 8
+      return JWK{
+        Kid: kid,
+        Kty: "EC",
+        Alg: algorithm,
+        Use: "sig",
+        Crv: key.Curve.Params().Name,
+        X: base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+        Y: base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+      }, nil
+  }
+
+  return JWK{}, fmt.Errorf("unsupported public key type %T", publicKey)
+}
+
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+  switch j.Kty {
+    case "RSA":
+      n, err := base64.RawURLEncoding.DecodeString(j.N)
+      if err != nil {
+        return nil, fmt.Errorf("malformed jwk modulus: %w", err)
+      }
+
+      e, err := base64.RawURLEncoding.DecodeString(j.E)
+      if err != nil {
+        return nil, fmt.Errorf("malformed jwk exponent: %w", err)
+      }
+
+      return &rsa.PublicKey{
+        N: new(big.Int).SetBytes(n),
+        E: int(new(big.Int).SetBytes(e).Int64()),
+      }, nil
+    case "EC":
+      if j.Crv != "P-256" {
+        return nil, fmt.Errorf("unsupported jwk curve %q", j.Crv)
+      }
+
+      x, err := base64.RawURLEncoding.DecodeString(j.X)
+      if err != nil {
+        return nil, fmt.Errorf("malformed jwk x: %w", err)
+      }
+
+      y, err := base64.RawURLEncoding.DecodeString(j.Y)
+      if err != nil {
+        return nil, fmt.Errorf("malformed jwk y: %w", err)
+      }
+
+      return &ecdsa.PublicKey{
+        Curve: elliptic.P256(),
+        X: new(big.Int).SetBytes(x),
+        Y: new(big.Int).SetBytes(y),
+      }, nil
+  }
+
+  return nil, fmt.Errorf("unsupported jwk key type %q", j.Kty)
+}
@@ -0,0 +1,222 @@
+package keys
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// how long a fetched key set is reused before asking secrets manager again,
+// a rotated key set is picked up by warm lambdas within this window
+const SECRET_CACHE_TTL = 5 * time.Minute
+
+// a token signed with a kid we don't know yet makes us refetch early, but at most this often
+const UNKNOWN_KID_REFRESH = time.Minute
+
+// KeyProvider hands out the keys used to sign and verify jwts
+type KeyProvider interface {
+  // the active key, every new token is signed with it
+  SigningKey() (Key, error)
+  // the key a token names in its kid header, retired keys included
+  VerificationKey(kid string) (Key, error)
+  // every key that still verifies tokens
+  KeySet() (KeySet, error)
+}
+
+// PublicKeys finds the public key a token's kid names. It is all a verifier needs and, unlike a
+// KeyProvider, can't be used to sign
+type PublicKeys interface {
+  PublicKey(kid string) (crypto.PublicKey, error)
+}
+
+type providerPublicKeys struct {
+  keyProvider KeyProvider
+}
+
+// the public half of a KeyProvider's verification keys
+func ProviderPublicKeys(keyProvider KeyProvider) PublicKeys {
+  return providerPublicKeys{keyProvider: keyProvider}
+}
+
+func (p providerPublicKeys) PublicKey(kid string) (crypto.PublicKey, error) {
+  key, err := p.keyProvider.VerificationKey(kid)
+  if err != nil {
+    return nil, err
+  }
+
+  return key.PublicKey(), nil
+}
+
+// secrets manager when JWT_SECRET_ARN is set (deployed), otherwise the JWT_SIGNING_KEYS env var (local runs).
+// Both hold a key set as written by cmd/rotatekeys
+func NewKeyProvider() KeyProvider {
+  secretArn := os.Getenv("JWT_SECRET_ARN")
+  if secretArn != "" {
+    return NewSecretsManagerKeyProvider(secretArn)
+  }
+
+  return NewEnvKeyProvider("JWT_SIGNING_KEYS")
+}
+
+type SecretsManagerKeyProvider struct {
+  client *secretsmanager.SecretsManager
+  secretId string
+
+  mu sync.Mutex
+  keySet *KeySet
+  fetchedAt time.Time
+}
+
+func NewSecretsManagerKeyProvider(secretId string) *SecretsManagerKeyProvider {
+  awsSession := session.Must(session.NewSession())
+
+  return &SecretsManagerKeyProvider{
+    client: secretsmanager.New(awsSession),
+    secretId: secretId,
+  }
+}
+
+func (p *SecretsManagerKeyProvider) SigningKey() (Key, error) {
+  keySet, err := p.KeySet()
+  if err != nil {
+    return Key{}, err
+  }
+
+  return activeKey(keySet)
+}
+
+func (p *SecretsManagerKeyProvider) VerificationKey(kid string) (Key, error) {
+  keySet, err := p.KeySet()
+  if err != nil {
+    return Key{}, err
+  }
+
+  if key, ok := keySet.Key(kid); ok {
+    return key, nil
+  }
+
+  // signed by a key rotated in after our last fetch
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if time.Since(p.fetchedAt) > UNKNOWN_KID_REFRESH {
+    err = p.fetch()
+    if err != nil {
+      return Key{}, err
+    }
+  }
+
+  if p.keySet != nil {
+    if key, ok := p.keySet.Key(kid); ok {
+      return key, nil
+    }
+  }
+
+  return Key{}, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (p *SecretsManagerKeyProvider) KeySet() (KeySet, error) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if p.keySet != nil && time.Since(p.fetchedAt) < SECRET_CACHE_TTL {
+    return *p.keySet, nil
+  }
+
+  err := p.fetch()
+  if err != nil {
+    // keep using the last known keys rather than failing every request
+    if p.keySet != nil {
+      return *p.keySet, nil
+    }
+    return KeySet{}, err
+  }
+
+  return *p.keySet, nil
+}
+
+// callers hold mu
+func (p *SecretsManagerKeyProvider) fetch() error {
+  result, err := p.client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+    SecretId: aws.String(p.secretId),
+  })
+
+  if err != nil {
+    return fmt.Errorf("failed to fetch jwt signing keys: %w", err)
+  }
+
+  if result.SecretString == nil || *result.SecretString == "" {
+    return errors.New("jwt signing key secret is empty")
+  }
+
+  keySet, err := ParseKeySet([]byte(*result.SecretString))
+  if err != nil {
+    return fmt.Errorf("jwt signing key secret is not a key set, run cmd/rotatekeys against it: %w", err)
+  }
+
+  p.keySet = &keySet
+  p.fetchedAt = time.Now()
+
+  return nil
+}
+
+// parsed once, a change to the variable needs a restart
+type EnvKeyProvider struct {
+  keySet KeySet
+  err error
+}
+
+func NewEnvKeyProvider(variable string) EnvKeyProvider {
+  value := os.Getenv(variable)
+  if value == "" {
+    return EnvKeyProvider{err: fmt.Errorf("no jwt signing keys configured, set JWT_SECRET_ARN or %s", variable)}
+  }
+
+  keySet, err := ParseKeySet([]byte(value))
+  if err != nil {
+    return EnvKeyProvider{err: fmt.Errorf("%s: %w", variable, err)}
+  }
+
+  return EnvKeyProvider{keySet: keySet}
+}
+
+func (p EnvKeyProvider) SigningKey() (Key, error) {
+  if p.err != nil {
+    return Key{}, p.err
+  }
+
+  return activeKey(p.keySet)
+}
+
+func (p EnvKeyProvider) VerificationKey(kid string) (Key, error) {
+  if p.err != nil {
+    return Key{}, p.err
+  }
+
+  key, ok := p.keySet.Key(kid)
+  if !ok {
+    return Key{}, fmt.Errorf("unknown signing key %q", kid)
+  }
+
+  return key, nil
+}
+
+func (p EnvKeyProvider) KeySet() (KeySet, error) {
+  return p.keySet, p.err
+}
+
+func activeKey(keySet KeySet) (Key, error) {
+  key, ok := keySet.Key(keySet.Active)
+  if !ok {
+    return Key{}, errors.New("key set has no active key")
+  }
+
+  return key, nil
+}
@@ -0,0 +1,195 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+  ALG_RS256 = "RS256"
+  ALG_ES256 = "ES256"
+)
+
+// one signing key. Retired keys no longer sign but still verify tokens issued before the rotation
+type Key struct {
+  ID string `json:"kid"`
+  Algorithm string `json:"alg"`
+  PrivateKeyPEM string `json:"private_key"`
+  CreatedAt string `json:"created_at"`
+  RetiredAt string `json:"retired_at,omitempty"`
+
+  privateKey crypto.Signer
+}
+
+// what is stored in secrets manager or JWT_SIGNING_KEYS, Active is the kid that signs new tokens
+type KeySet struct {
+  Active string `json:"active"`
+  Keys []Key `json:"keys"`
+}
+
+func GenerateKey(algorithm string, now time.Time) (Key, error) {
+  var privateKey crypto.Signer
+  var err error
+
+  switch algorithm {
+    case ALG_RS256:
+      privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+    case ALG_ES256:
+      privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    default:
+      return Key{}, fmt.Errorf("unsupported key algorithm %q, use %s or %s", algorithm, ALG_RS256, ALG_ES256)
+  }
+
+  if err != nil {
+    return Key{}, err
+  }
+
+  der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+  if err != nil {
+    return Key{}, err
+  }
+
+  return Key{
+    ID: uuid.NewString(),
+    Algorithm: algorithm,
+    PrivateKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+    CreatedAt: now.UTC().Format(time.RFC3339),
+    privateKey: privateKey,
+  }, nil
+}
+
+// parses the stored json and every private key in it, the active key must be present
+func ParseKeySet(data []byte) (KeySet, error) {
+  var keySet KeySet
+
+  err := json.Unmarshal(data, &keySet)
+  if err != nil {
+    return keySet, fmt.Errorf("malformed key set: %w", err)
+  }
+
+  for i := range keySet.Keys {
+    err = keySet.Keys[i].parsePrivateKey()
+    if err != nil {
+      return keySet, err
+    }
+  }
+
+  if _, ok := keySet.Key(keySet.Active); !ok {
+    return keySet, errors.New("key set has no active key")
+  }
+
+  return keySet, nil
+}
+
+func (s KeySet) Marshal() ([]byte, error) {
+  return json.MarshalIndent(s, "", "  ")
+}
+
+func (s KeySet) Key(kid string) (Key, bool) {
+  for _, key := range s.Keys {
+    if key.ID == kid {
+      return key, true
+    }
+  }
+
+  return Key{}, false
+}
+
+// the new key signs from now on, the old active key is retired but kept for verifying. Keys
+// retired longer ago than retain are dropped, retain has to outlive the longest token ttl
+func (s KeySet) Rotate(newKey Key, now time.Time, retain time.Duration) KeySet {
+  rotated := KeySet{Active: newKey.ID, Keys: []Key{newKey}}
+
+  for _, key := range s.Keys {
+    if key.RetiredAt == "" {
+      key.RetiredAt = now.UTC().Format(time.RFC3339)
+    }
+
+    retiredAt, err := time.Parse(time.RFC3339, key.RetiredAt)
+    if err == nil && now.Sub(retiredAt) > retain {
+      continue
+    }
+
+    rotated.Keys = append(rotated.Keys, key)
+  }
+
+  return rotated
+}
+
+// every key that may still verify a token, as published on /.well-known/jwks.json
+func (s KeySet) JWKS() (JWKS, error) {
+  jwks := JWKS{Keys: []JWK{}}
+
+  for _, key := range s.Keys {
+    jwk, err := NewJWK(key.ID, key.Algorithm, key.PublicKey())
+    if err != nil {
+      return jwks, err
+    }
+
+    jwks.Keys = append(jwks.Keys, jwk)
+  }
+
+  return jwks, nil
+}
+
+// the algorithm a public key signs with, ParseKeySet only lets RSA keys be RS256 and P-256 keys ES256
+func Algorithm(publicKey crypto.PublicKey) (string, error) {
+  switch key := publicKey.(type) {
+    case *rsa.PublicKey:
+      return ALG_RS256, nil
+    case *ecdsa.PublicKey:
+      if key.Curve == elliptic.P256() {
+        return ALG_ES256, nil
+      }
+  }
+
+  return "", fmt.Errorf("unsupported public key type %T", publicKey)
+}
+
+func (k Key) PrivateKey() crypto.Signer {
+  return k.privateKey
+}
+
+func (k Key) PublicKey() crypto.PublicKey {
+  return k.privateKey.Public()
+}
+
+func (k *Key) parsePrivateKey() error {
+  block, _ := pem.Decode([]byte(k.PrivateKeyPEM))
+  if block == nil {
+    return fmt.Errorf("key %s has no pem private key", k.ID)
+  }
+
+  parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+  if err != nil {
+    return fmt.Errorf("key %s: %w", k.ID, err)
+  }
+
+  switch privateKey := parsed.(type) {
+    case *rsa.PrivateKey:
+      if k.Algorithm != ALG_RS256 {
+        return fmt.Errorf("key %s is rsa but says %s", k.ID, k.Algorithm)
+      }
+      k.privateKey = privateKey
+    case *ecdsa.PrivateKey:
+      if k.Algorithm != ALG_ES256 || privateKey.Curve != elliptic.P256() {
+        return fmt.Errorf("key %s is not a P-256 key for %s", k.ID, k.Algorithm)
+      }
+      k.privateKey = privateKey
+    default:
+      return fmt.Errorf("key %s has an unsupported key type", k.ID)
+  }
+
+  return nil
+}
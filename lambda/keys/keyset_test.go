@@ -0,0 +1,176 @@
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func generateTestKey(t *testing.T, algorithm string, now time.Time) Key {
+  t.Helper()
+
+  key, err := GenerateKey(algorithm, now)
+  if err != nil {
+    t.Fatalf("GenerateKey(%s): %v", algorithm, err)
+  }
+
+  return key
+}
+
+func keyIDs(keySet KeySet) []string {
+  ids := []string{}
+  for _, key := range keySet.Keys {
+    ids = append(ids, key.ID)
+  }
+
+  return ids
+}
+
+func TestRotate(t *testing.T) {
+  start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+  retain := 24 * time.Hour
+
+  first := generateTestKey(t, ALG_ES256, start)
+  keySet := KeySet{}.Rotate(first, start, retain)
+
+  if keySet.Active != first.ID || len(keySet.Keys) != 1 {
+    t.Fatalf("first rotation = %s %v, want only %s", keySet.Active, keyIDs(keySet), first.ID)
+  }
+
+  second := generateTestKey(t, ALG_ES256, start.Add(time.Hour))
+  keySet = keySet.Rotate(second, start.Add(time.Hour), retain)
+
+  if keySet.Active != second.ID {
+    t.Errorf("active = %s, want the new key %s", keySet.Active, second.ID)
+  }
+
+  retired, ok := keySet.Key(first.ID)
+  if !ok {
+    t.Fatal("the previous key was dropped straight away")
+  }
+
+  if retired.RetiredAt != start.Add(time.Hour).Format(time.RFC3339) {
+    t.Errorf("previous key retired at %q, want the rotation time", retired.RetiredAt)
+  }
+
+  tests := []struct {
+    name string
+    at time.Time
+    wantFirst bool
+  }{
+    // first was retired at start+1h
+    {"within retain", start.Add(time.Hour + retain), true},
+    {"past retain", start.Add(time.Hour + retain + time.Second), false},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      next := generateTestKey(t, ALG_ES256, test.at)
+      rotated := keySet.Rotate(next, test.at, retain)
+
+      if rotated.Active != next.ID {
+        t.Errorf("active = %s, want %s", rotated.Active, next.ID)
+      }
+
+      if _, ok := rotated.Key(second.ID); !ok {
+        t.Error("the key retired by this rotation was dropped")
+      }
+
+      if _, ok := rotated.Key(first.ID); ok != test.wantFirst {
+        t.Errorf("first key kept = %v, want %v", ok, test.wantFirst)
+      }
+
+      // retiring must not move the time a key was retired at
+      if kept, ok := rotated.Key(first.ID); ok && kept.RetiredAt != retired.RetiredAt {
+        t.Errorf("retired_at moved from %s to %s", retired.RetiredAt, kept.RetiredAt)
+      }
+    })
+  }
+}
+
+func TestParseKeySetRoundTrip(t *testing.T) {
+  now := time.Now()
+  keySet := KeySet{}.
+    Rotate(generateTestKey(t, ALG_RS256, now), now, time.Hour).
+    Rotate(generateTestKey(t, ALG_ES256, now), now, time.Hour)
+
+  data, err := keySet.Marshal()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  parsed, err := ParseKeySet(data)
+  if err != nil {
+    t.Fatalf("ParseKeySet: %v", err)
+  }
+
+  if parsed.Active != keySet.Active || len(parsed.Keys) != 2 {
+    t.Fatalf("parsed %s %v, want %s %v", parsed.Active, keyIDs(parsed), keySet.Active, keyIDs(keySet))
+  }
+
+  for _, key := range parsed.Keys {
+    if key.PrivateKey() == nil {
+      t.Errorf("key %s has no private key after parsing", key.ID)
+    }
+  }
+}
+
+func TestParseKeySetRejects(t *testing.T) {
+  now := time.Now()
+  rsaKey := generateTestKey(t, ALG_RS256, now)
+  ecKey := generateTestKey(t, ALG_ES256, now)
+
+  p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  der, err := x509.MarshalPKCS8PrivateKey(p384)
+  if err != nil {
+    t.Fatal(err)
+  }
+  p384PEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+  relabel := func(key Key, algorithm string, privateKeyPEM string) Key {
+    key.Algorithm = algorithm
+    if privateKeyPEM != "" {
+      key.PrivateKeyPEM = privateKeyPEM
+    }
+    return key
+  }
+
+  tests := []struct {
+    name string
+    keySet KeySet
+  }{
+    {"rsa key labelled ES256", KeySet{Active: rsaKey.ID, Keys: []Key{relabel(rsaKey, ALG_ES256, "")}}},
+    {"ec key labelled RS256", KeySet{Active: ecKey.ID, Keys: []Key{relabel(ecKey, ALG_RS256, "")}}},
+    {"P-384 key labelled ES256", KeySet{Active: ecKey.ID, Keys: []Key{relabel(ecKey, ALG_ES256, p384PEM)}}},
+    {"mismatch on a retired key", KeySet{Active: ecKey.ID, Keys: []Key{ecKey, relabel(rsaKey, ALG_ES256, "")}}},
+    {"unknown algorithm", KeySet{Active: ecKey.ID, Keys: []Key{relabel(ecKey, "HS256", "")}}},
+    {"no pem", KeySet{Active: ecKey.ID, Keys: []Key{relabel(ecKey, ALG_ES256, "not a key")}}},
+    {"active key missing", KeySet{Active: "missing", Keys: []Key{ecKey}}},
+    {"empty", KeySet{}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      data, err := test.keySet.Marshal()
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      _, err = ParseKeySet(data)
+      if err == nil {
+        t.Error("ParseKeySet accepted the key set")
+      }
+    })
+  }
+
+  if _, err := ParseKeySet([]byte("not json")); err == nil {
+    t.Error("ParseKeySet accepted malformed json")
+  }
+}
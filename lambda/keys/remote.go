@@ -0,0 +1,94 @@
+package keys
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// issuers rotate their signing keys rarely, a kid we haven't seen triggers an early refetch
+// but no more often than JWKS_MIN_REFRESH so bad tokens can't make us hammer the endpoint
+const (
+  JWKS_CACHE_TTL = time.Hour
+  JWKS_MIN_REFRESH = time.Minute
+)
+
+// public keys published at a jwks url, like a cognito user pool's, an oidc provider's or our own api's
+type RemoteJWKS struct {
+  url string
+  httpClient *http.Client
+
+  mu *sync.Mutex
+  keys *map[string]crypto.PublicKey
+  fetchedAt *time.Time
+}
+
+func NewRemoteJWKS(url string, httpClient *http.Client) RemoteJWKS {
+  return RemoteJWKS{
+    url: url,
+    httpClient: httpClient,
+    mu: &sync.Mutex{},
+    keys: &map[string]crypto.PublicKey{},
+    fetchedAt: &time.Time{},
+  }
+}
+
+func (r RemoteJWKS) PublicKey(kid string) (crypto.PublicKey, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  key, known := (*r.keys)[kid]
+  age := time.Since(*r.fetchedAt)
+
+  if (!known && age > JWKS_MIN_REFRESH) || age > JWKS_CACHE_TTL {
+    err := r.fetch()
+    // a stale key set is better than none while the issuer can't be reached
+    if err != nil && len(*r.keys) == 0 {
+      return nil, err
+    }
+    key, known = (*r.keys)[kid]
+  }
+
+  if !known {
+    return nil, fmt.Errorf("unknown signing key %q", kid)
+  }
+
+  return key, nil
+}
+
+// callers hold mu. Keys of a type we can't use are skipped rather than failing the whole set
+func (r RemoteJWKS) fetch() error {
+  response, err := r.httpClient.Get(r.url)
+  if err != nil {
+    return fmt.Errorf("failed to fetch jwks: %w", err)
+  }
+  defer response.Body.Close()
+
+  if response.StatusCode != http.StatusOK {
+    return fmt.Errorf("failed to fetch jwks: status %d", response.StatusCode)
+  }
+
+  var keySet JWKS
+  err = json.NewDecoder(response.Body).Decode(&keySet)
+  if err != nil {
+    return fmt.Errorf("failed to decode jwks: %w", err)
+  }
+
+  publicKeys := map[string]crypto.PublicKey{}
+  for _, jwk := range keySet.Keys {
+    key, err := jwk.PublicKey()
+    if err != nil {
+      continue
+    }
+
+    publicKeys[jwk.Kid] = key
+  }
+
+  *r.keys = publicKeys
+  *r.fetchedAt = time.Now()
+
+  return nil
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
-	// "fmt"
+	"fmt"
 	"lambda-func/app"
-	"net/http"
+	"lambda-func/identity"
 	"lambda-func/middleware"
+	"lambda-func/types"
+	"net/http"
+	"lambda-func/router"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-  "strings"
 )
 
 // not needed any more, below code was used to test routes
@@ -24,8 +26,10 @@ import (
 // }
 
 func ProtectedHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  principal, _ := middleware.GetPrincipal(request)
+
   return events.APIGatewayProxyResponse{
-    Body: "This is a protected path",
+    Body: fmt.Sprintf("This is a protected path - called by %s", principal.Username),
     StatusCode: http.StatusOK,
   }, nil
 }
@@ -33,34 +37,66 @@ func ProtectedHandler(request events.APIGatewayProxyRequest) (events.APIGatewayP
 func main() {
   myApp := app.NewApp()
 
-  lambda.Start(func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  r := router.New()
+
+  r.GET("/blogs", myApp.BlogHandler.GetAllBlogsHandler)
+  r.GET("/blog/{slug}", myApp.BlogHandler.GetBlogHandler)
+  r.GET("/users/{username}/blogs", myApp.BlogHandler.GetUserBlogsHandler)
+
+  // every route in this group has to pass the jwt check first
+  authenticated := r.Group("", myApp.AuthMiddleware.ValidateJWTMiddleware)
+  authenticated.POST("/logout", myApp.TokenHandler.LogoutHandler)
+
+  // with cognito, sign up, sign in, passwords and mfa are the user pool's job and
+  // users aren't in userTable, so none of the account routes or api keys exist
+  machine := authenticated
+  if myApp.IdentityBackend == identity.BACKEND_LOCAL {
+    r.POST("/register", myApp.UserHandler.RegisterUserHandler)
+    r.POST("/login", myApp.UserHandler.LoginUser)
+    r.POST("/login/mfa", myApp.UserHandler.LoginMFAHandler)
+    r.POST("/password/forgot", myApp.PasswordHandler.ForgotPasswordHandler)
+    r.POST("/password/reset", myApp.PasswordHandler.ResetPasswordHandler)
+    r.GET("/verify-email", myApp.EmailVerificationHandler.VerifyEmailHandler)
+    r.POST("/verify-email/resend", myApp.EmailVerificationHandler.ResendVerificationHandler)
+    r.POST("/token/refresh", myApp.TokenHandler.RefreshTokenHandler)
+    r.GET("/users/{username}", myApp.AccountHandler.GetProfileHandler)
+    r.GET("/.well-known/jwks.json", myApp.TokenHandler.JWKSHandler)
+    r.GET("/oidc/{provider}/start", myApp.OIDCHandler.StartOIDCHandler)
+    r.GET("/oidc/{provider}/callback", myApp.OIDCHandler.OIDCCallbackHandler)
+    r.GET("/oidc/{provider}/link", myApp.OIDCHandler.StartLinkOIDCHandler)
+
+    authenticated.PATCH("/me", myApp.AccountHandler.UpdateAccountHandler)
+    authenticated.PUT("/me/password", myApp.PasswordHandler.ChangePasswordHandler)
+    authenticated.DELETE("/me", myApp.AccountHandler.DeleteAccountHandler)
+    authenticated.POST("/me/mfa", myApp.UserHandler.EnrollMFAHandler)
+    authenticated.POST("/me/mfa/verify", myApp.UserHandler.VerifyMFAHandler)
+    authenticated.POST("/me/api-keys", myApp.APIKeyHandler.CreateAPIKeyHandler)
+    authenticated.GET("/me/api-keys", myApp.APIKeyHandler.ListAPIKeysHandler)
+    authenticated.DELETE("/me/api-keys/{id}", myApp.APIKeyHandler.RevokeAPIKeyHandler)
+    authenticated.POST("/me/identities/{provider}", myApp.OIDCHandler.LinkOIDCHandler)
+
+    // machine clients can use an api key here instead, as X-API-Key or the bearer token, limited to the key's scopes
+    machine = r.Group("", myApp.AuthMiddleware.ValidateJWTOrAPIKeyMiddleware)
+    machine.GET("/me", myApp.AccountHandler.GetAccountHandler, middleware.RequireScope(types.ScopeAccountRead))
+  }
+
+  machine.GET("/protected", ProtectedHandler)
+  machine.POST("/blog", myApp.BlogHandler.CreateBlogHandler, middleware.RequireScope(types.ScopeBlogsWrite), middleware.RequireRole(types.RoleAuthor))
+  // the handlers also check the caller wrote the blog or is an editor
+  machine.PUT("/blog/{slug}", myApp.BlogHandler.UpdateBlogHandler, middleware.RequireScope(types.ScopeBlogsWrite), middleware.RequireRole(types.RoleAuthor))
+  machine.DELETE("/blog/{slug}", myApp.BlogHandler.DeleteBlogHandler, middleware.RequireScope(types.ScopeBlogsWrite), middleware.RequireRole(types.RoleAuthor))
 
-    // Handle /blog/{slug}
-    if strings.HasPrefix(request.Path, "/blog/") && request.HTTPMethod == "GET" {
-        slug := request.PathParameters["slug"]
-        if slug != "" {
-          return myApp.BlogHandler.GetBlogHandler(request)
-        }
-    }
+  // restore and purge are admin only, editors can only soft delete
+  admin := authenticated.Group("", middleware.RequireRole(types.RoleAdmin))
+  admin.POST("/blog/{slug}/restore", myApp.BlogHandler.RestoreBlogHandler)
+  admin.DELETE("/blog/{slug}/purge", myApp.BlogHandler.PurgeBlogHandler)
+  admin.DELETE("/users/{username}/sessions", myApp.TokenHandler.RevokeUserSessionsHandler)
 
-    switch request.Path {
-      // case "/register":
-      //   return myApp.ApiHandler.RegisterUserHandler(request)
-      case "/login":
-        return myApp.UserHandler.LoginUser(request)
-      // case "/blog":
-      //     return myApp.BlogHandler.CreateBlogHandler(request)
-      case "/blogs":
-        return myApp.BlogHandler.GetAllBlogsHandler(request)
-      case "/protected":
-        // this syntax is chaining functions, this is how next function is called in the chain
-        return middleware.ValidateJWTMiddleware(ProtectedHandler)(request)
+  // cognito roles come from user pool groups and lockouts are cognito's own
+  if myApp.IdentityBackend == identity.BACKEND_LOCAL {
+    admin.PUT("/users/{username}/roles", myApp.UserHandler.SetUserRolesHandler)
+    admin.POST("/users/{username}/unlock", myApp.UserHandler.UnlockUserHandler)
+  }
 
-      default:
-        return events.APIGatewayProxyResponse{
-          Body: "Not Found",
-          StatusCode: http.StatusNotFound,
-        }, nil
-    }
-  })
+  lambda.Start(r.ServeRequest)
 }
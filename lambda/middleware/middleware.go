@@ -1,82 +1,380 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
-  "time"
+	"time"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/golang-jwt/jwt/v5"
+	"lambda-func/database"
+	"lambda-func/identity"
+	"lambda-func/types"
 )
 
-func ValidateJWTMiddleware(next func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+// a credential that doesn't check out, any other error from Authenticate is an internal failure
+var (
+  ErrMissingToken = errors.New("missing auth token")
+  ErrTokenExpired = errors.New("token expired")
+  ErrTokenRevoked = errors.New("token revoked")
+  ErrInvalidToken = errors.New("invalid token")
+  ErrInvalidAPIKey = errors.New("invalid api key")
+  ErrAPIKeyExpired = errors.New("api key expired")
+)
+
+type AuthMiddleware struct {
+  tokenVerifier identity.TokenVerifier
+  revocationStore database.RevocationStore
+  userStore database.UserStore
+  apiKeyStore database.APIKeyStore
+  // set when the lambda authorizer sits in front of the api, see authenticateRequest
+  trustAuthorizer bool
+}
+
+func NewAuthMiddleware(tokenVerifier identity.TokenVerifier, revocationStore database.RevocationStore, userStore database.UserStore, apiKeyStore database.APIKeyStore, trustAuthorizer bool) AuthMiddleware {
+  return AuthMiddleware{
+    tokenVerifier: tokenVerifier,
+    revocationStore: revocationStore,
+    userStore: userStore,
+    apiKeyStore: apiKeyStore,
+    trustAuthorizer: trustAuthorizer,
+  }
+}
+
+func (m AuthMiddleware) ValidateJWTMiddleware(next func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 
   return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    tokenString := extractTokenFromHeaders(request.Headers)
-    if tokenString == "" {
-      return events.APIGatewayProxyResponse{
-        Body: "Missing Auth Token",
-        StatusCode: http.StatusUnauthorized,
-      }, nil
+    principal, err := m.authenticateRequest(request, false)
+    if err != nil {
+      return authErrorResponse(err)
     }
 
-    claims, err := parseToken(tokenString) 
+    return next(withPrincipal(request, principal))
+  }
+}
+
+// for routes machine clients may call, an api key is accepted as an X-API-Key header or as the
+// bearer token, a jwt otherwise. Pair it with RequireScope, api keys are refused where their scopes don't reach
+func (m AuthMiddleware) ValidateJWTOrAPIKeyMiddleware(next func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 
+  return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    principal, err := m.authenticateRequest(request, true)
     if err != nil {
-      return events.APIGatewayProxyResponse{
-        Body: "User unauthorized",
-        StatusCode: http.StatusUnauthorized,
-      }, err
+      return authErrorResponse(err)
     }
 
-    expires := int64(claims["expires"].(float64))
+    return next(withPrincipal(request, principal))
+  }
+}
 
-    if time.Now().Unix() > expires {
-      return events.APIGatewayProxyResponse{
-        Body: "Token expired",
-        StatusCode: http.StatusUnauthorized,
-      }, err
+// runs after ValidateJWTOrAPIKeyMiddleware, jwt principals always pass
+func RequireScope(scope string) func(next func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+  return func(next func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+    return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+      principal, ok := GetPrincipal(request)
+      if !ok {
+        return events.APIGatewayProxyResponse{
+          Body: "User unauthorized",
+          StatusCode: http.StatusUnauthorized,
+        }, nil
+      }
+
+      if !principal.HasScope(scope) {
+        return events.APIGatewayProxyResponse{
+          Body: "API key is missing the " + scope + " scope",
+          StatusCode: http.StatusForbidden,
+        }, nil
+      }
+
+      return next(request)
     }
+  }
+}
+
+// runs after ValidateJWTMiddleware, which puts the principal on the request
+func RequireRole(role string) func(next func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+  return func(next func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+    return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+      principal, ok := GetPrincipal(request)
+      if !ok {
+        return events.APIGatewayProxyResponse{
+          Body: "User unauthorized",
+          StatusCode: http.StatusUnauthorized,
+        }, nil
+      }
 
-    return next(request)
+      if !principal.HasRole(role) {
+        return events.APIGatewayProxyResponse{
+          Body: "Forbidden",
+          StatusCode: http.StatusForbidden,
+        }, nil
+      }
+
+      return next(request)
+    }
   }
 }
 
-func extractTokenFromHeaders(headers map[string]string) string {
+// Authenticate checks the credential sent as "Authorization: Bearer ...", an api key when it starts
+// with gck_ and allowAPIKey is set, an access token otherwise. The lambda authorizer runs the same checks
+func (m AuthMiddleware) Authenticate(credential string, allowAPIKey bool) (types.Principal, error) {
+  if credential == "" {
+    return types.Principal{}, ErrMissingToken
+  }
 
-  authHeader, ok := headers["Authorization"]
-  if !ok {
-    return ""
+  if allowAPIKey && strings.HasPrefix(credential, types.API_KEY_PREFIX) {
+    return m.validateAPIKey(credential)
   }
 
-  splitToken := strings.Split(authHeader, "Bearer ")
+  return m.validateToken(credential)
+}
 
-  if len(splitToken) != 2 {
-    return ""
+// with the lambda authorizer in front, api gateway has already run Authenticate and passes the
+// principal in the request context, so the signature isn't checked again. Revocations and deleted
+// api keys still are. TRUST_AUTHORIZER_CONTEXT is set for the whole function, so this only applies to
+// a context our authorizer filled in. Routes it doesn't cover arrive without one, or with the cognito
+// authorizer's claims, and the credential is checked here
+func (m AuthMiddleware) authenticateRequest(request events.APIGatewayProxyRequest, allowAPIKey bool) (types.Principal, error) {
+  if m.trustAuthorizer {
+    if principal, ok := authorizerPrincipal(request); ok {
+      if principal.APIKeyID != "" && !allowAPIKey {
+        return types.Principal{}, ErrInvalidToken
+      }
+      return m.recheckPrincipal(principal)
+    }
   }
 
-  return splitToken[1]
+  return m.AuthenticateHeaders(request.Headers, allowAPIKey)
+}
+
+// AuthenticateHeaders takes the credential from the request headers, an X-API-Key header when
+// allowAPIKey is set and one was sent, "Authorization: Bearer ..." otherwise
+func (m AuthMiddleware) AuthenticateHeaders(headers map[string]string, allowAPIKey bool) (types.Principal, error) {
+  if allowAPIKey {
+    if apiKey := HeaderValue(headers, "X-API-Key"); apiKey != "" {
+      return m.validateAPIKey(apiKey)
+    }
+  }
+
+  return m.Authenticate(extractTokenFromHeaders(headers), allowAPIKey)
 }
 
-func parseToken(tokenString string) (jwt.MapClaims, error) {
-  token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-    secret := "jiahua-zheshiyigemimi-stuff"
-    return []byte(secret), nil
-  })
+func (m AuthMiddleware) validateToken(tokenString string) (types.Principal, error) {
+  claims, err := m.tokenVerifier.VerifyToken(tokenString)
+
+  if errors.Is(err, jwt.ErrTokenExpired) {
+    return types.Principal{}, ErrTokenExpired
+  }
+
+  if err != nil {
+    return types.Principal{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+  }
+
+  revoked, err := m.revocationStore.IsRevoked(claims.ID, claims.Subject, claims.IssuedAt.Time)
+  if err != nil {
+    return types.Principal{}, err
+  }
+
+  if revoked {
+    return types.Principal{}, ErrTokenRevoked
+  }
+
+  principal := types.Principal{
+    Username: claims.Subject,
+    Roles: claims.Roles,
+    TokenID: claims.ID,
+    IssuedAt: claims.IssuedAt.Time,
+    ExpiresAt: claims.ExpiresAt.Time,
+  }
+
+  return principal, nil
+}
+
+// api gateway sets principalId from the lambda authorizer's response, next to the context it returned
+func authorizerPrincipal(request events.APIGatewayProxyRequest) (types.Principal, bool) {
+  principal, ok := GetPrincipal(request)
+  if !ok {
+    return types.Principal{}, false
+  }
+
+  principalID, _ := request.RequestContext.Authorizer["principalId"].(string)
+  if principalID != principal.Username {
+    return types.Principal{}, false
+  }
+
+  return principal, true
+}
+
+// the parts of Authenticate that can change while api gateway has the authorizer's answer cached
+func (m AuthMiddleware) recheckPrincipal(principal types.Principal) (types.Principal, error) {
+  if principal.APIKeyID != "" {
+    apiKey, err := m.apiKeyStore.GetAPIKey(principal.APIKeyID)
+
+    if errors.Is(err, database.ErrAPIKeyNotFound) {
+      return types.Principal{}, ErrInvalidAPIKey
+    }
+
+    if err != nil {
+      return types.Principal{}, err
+    }
+
+    if apiKey.IsExpired() {
+      return types.Principal{}, ErrAPIKeyExpired
+    }
+
+    return principal, nil
+  }
+
+  // a context without these came from something other than our authorizer
+  if principal.TokenID == "" || principal.IssuedAt.IsZero() {
+    return types.Principal{}, ErrInvalidToken
+  }
 
+  revoked, err := m.revocationStore.IsRevoked(principal.TokenID, principal.Username, principal.IssuedAt)
   if err != nil {
-    return nil, fmt.Errorf("unauthorized")
+    return types.Principal{}, err
   }
 
-  if !token.Valid {
-    return nil, fmt.Errorf("Token is not valid - unauthorized")
+  if revoked {
+    return types.Principal{}, ErrTokenRevoked
   }
 
-  claims, ok := token.Claims.(jwt.MapClaims)
+  return principal, nil
+}
 
+// the key acts with its owner's current roles, so taking a role away also takes it from their keys
+func (m AuthMiddleware) validateAPIKey(plainKey string) (types.Principal, error) {
+  id, ok := types.APIKeyID(plainKey)
   if !ok {
-    return nil, fmt.Errorf("claims of unauthorized type")
+    return types.Principal{}, ErrInvalidAPIKey
+  }
+
+  apiKey, err := m.apiKeyStore.GetAPIKey(id)
+
+  if errors.Is(err, database.ErrAPIKeyNotFound) {
+    return types.Principal{}, ErrInvalidAPIKey
+  }
+
+  if err != nil {
+    return types.Principal{}, err
+  }
+
+  if subtle.ConstantTimeCompare([]byte(types.HashToken(plainKey)), []byte(apiKey.KeyHash)) != 1 {
+    return types.Principal{}, ErrInvalidAPIKey
+  }
+
+  if apiKey.IsExpired() {
+    return types.Principal{}, ErrAPIKeyExpired
+  }
+
+  user, err := m.userStore.GetUser(apiKey.Username)
+
+  if errors.Is(err, database.ErrUserNotFound) {
+    return types.Principal{}, ErrInvalidAPIKey
+  }
+
+  if err != nil {
+    return types.Principal{}, err
+  }
+
+  principal := types.Principal{
+    Username: user.Username,
+    Roles: user.UserRoles(),
+    APIKeyID: apiKey.ID,
+    Scopes: apiKey.Scopes,
+  }
+
+  if apiKey.ExpiresAt != 0 {
+    principal.ExpiresAt = time.Unix(apiKey.ExpiresAt, 0)
+  }
+
+  // bookkeeping only, a failed write shouldn't fail the request
+  err = m.apiKeyStore.TouchAPIKey(apiKey.ID, time.Now())
+  if err != nil {
+    log.Printf("failed to record api key use: %v", err)
+  }
+
+  return principal, nil
+}
+
+func authErrorResponse(err error) (events.APIGatewayProxyResponse, error) {
+  switch {
+    case errors.Is(err, ErrMissingToken):
+      return events.APIGatewayProxyResponse{
+        Body: "Missing Auth Token",
+        StatusCode: http.StatusUnauthorized,
+      }, nil
+    case errors.Is(err, ErrTokenExpired):
+      return events.APIGatewayProxyResponse{
+        Body: "Token expired",
+        StatusCode: http.StatusUnauthorized,
+      }, nil
+    case errors.Is(err, ErrTokenRevoked):
+      return events.APIGatewayProxyResponse{
+        Body: "Token revoked",
+        StatusCode: http.StatusUnauthorized,
+      }, nil
+    case errors.Is(err, ErrInvalidToken):
+      // returned so the router logs why the token was rejected
+      return events.APIGatewayProxyResponse{
+        Body: "User unauthorized",
+        StatusCode: http.StatusUnauthorized,
+      }, err
+    case errors.Is(err, ErrInvalidAPIKey):
+      return events.APIGatewayProxyResponse{
+        Body: "Invalid API key",
+        StatusCode: http.StatusUnauthorized,
+      }, nil
+    case errors.Is(err, ErrAPIKeyExpired):
+      return events.APIGatewayProxyResponse{
+        Body: "API key expired",
+        StatusCode: http.StatusUnauthorized,
+      }, nil
   }
 
-  return claims, nil
+  return events.APIGatewayProxyResponse{
+    Body: "Internal Server Error",
+    StatusCode: http.StatusInternalServerError,
+  }, err
+}
+
+// HeaderValue looks a header up by name. Names are case-insensitive, and http/2 clients send them in lower case
+func HeaderValue(headers map[string]string, name string) string {
+  if value, ok := headers[name]; ok {
+    return value
+  }
+
+  for key, value := range headers {
+    if strings.EqualFold(key, name) {
+      return value
+    }
+  }
+
+  return ""
+}
+
+func extractTokenFromHeaders(headers map[string]string) string {
+  return BearerToken(HeaderValue(headers, "Authorization"))
+}
+
+// the token from an Authorization header value, empty when it isn't "Bearer <token>"
+func BearerToken(authHeader string) string {
+  if authHeader == "" {
+    return ""
+  }
+
+  splitToken := strings.Split(authHeader, "Bearer ")
+
+  if len(splitToken) != 2 {
+    return ""
+  }
+
+  return splitToken[1]
 }
@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/golang-jwt/jwt/v5"
+	"lambda-func/database"
+	"lambda-func/types"
+)
+
+// accepts "good" as alice's access token and nothing else
+type fakeTokenVerifier struct{}
+
+func (fakeTokenVerifier) VerifyToken(tokenString string) (*types.Claims, error) {
+  if tokenString != "good" {
+    return nil, errors.New("bad signature")
+  }
+
+  now := time.Now()
+  return &types.Claims{
+    RegisteredClaims: jwt.RegisteredClaims{
+      Subject: "alice",
+      ID: "token-1",
+      IssuedAt: jwt.NewNumericDate(now),
+      ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+    },
+  }, nil
+}
+
+// token ids and usernames in revoked count as revoked
+type fakeRevocationStore struct {
+  database.RevocationStore
+  revoked map[string]bool
+  checked int
+}
+
+func (s *fakeRevocationStore) IsRevoked(tokenID string, username string, issuedAt time.Time) (bool, error) {
+  s.checked++
+  return s.revoked[tokenID] || s.revoked[username], nil
+}
+
+type fakeAPIKeyStore struct {
+  database.APIKeyStore
+  keys map[string]types.APIKey
+}
+
+func (s fakeAPIKeyStore) GetAPIKey(id string) (types.APIKey, error) {
+  apiKey, ok := s.keys[id]
+  if !ok {
+    return types.APIKey{}, database.ErrAPIKeyNotFound
+  }
+
+  return apiKey, nil
+}
+
+func (s fakeAPIKeyStore) TouchAPIKey(id string, usedAt time.Time) error {
+  return nil
+}
+
+type fakeUserStore struct {
+  database.UserStore
+  users map[string]types.User
+}
+
+func (s fakeUserStore) GetUser(username string) (types.User, error) {
+  user, ok := s.users[username]
+  if !ok {
+    return types.User{}, database.ErrUserNotFound
+  }
+
+  return user, nil
+}
+
+// the request api gateway hands the main function after the lambda authorizer approved principal
+func authorizedRequest(principal types.Principal) events.APIGatewayProxyRequest {
+  return withPrincipal(events.APIGatewayProxyRequest{}, principal)
+}
+
+func TestAuthenticateRequestTrustingAuthorizer(t *testing.T) {
+  tokenPrincipal := types.Principal{
+    Username: "alice",
+    TokenID: "token-1",
+    IssuedAt: time.Now().Add(-time.Minute),
+    ExpiresAt: time.Now().Add(time.Minute),
+  }
+  keyPrincipal := types.Principal{
+    Username: "alice",
+    APIKeyID: "key-1",
+    Scopes: []string{"blogs:write"},
+  }
+
+  // a cognito authorizer puts the id token's claims in the context, never our principal
+  cognitoRequest := events.APIGatewayProxyRequest{}
+  cognitoRequest.RequestContext.Authorizer = map[string]interface{}{
+    "claims": map[string]interface{}{"cognito:username": "mallory"},
+  }
+
+  // our principal without the principalId api gateway adds, not something our authorizer returned
+  withoutPrincipalID := authorizedRequest(tokenPrincipal)
+  delete(withoutPrincipalID.RequestContext.Authorizer, "principalId")
+
+  tests := []struct {
+    name string
+    request events.APIGatewayProxyRequest
+    allowAPIKey bool
+    revoked map[string]bool
+    keys map[string]types.APIKey
+    wantErr error
+    wantUsername string
+  }{
+    {"token the authorizer approved", authorizedRequest(tokenPrincipal), false, nil, nil, nil, "alice"},
+    {"token revoked after the authorizer approved it", authorizedRequest(tokenPrincipal), false, map[string]bool{"token-1": true}, nil, ErrTokenRevoked, ""},
+    {"user logged out everywhere after the authorizer approved", authorizedRequest(tokenPrincipal), false, map[string]bool{"alice": true}, nil, ErrTokenRevoked, ""},
+    {"api key the authorizer approved", authorizedRequest(keyPrincipal), true, nil, map[string]types.APIKey{"key-1": {ID: "key-1", Username: "alice"}}, nil, "alice"},
+    {"api key deleted after the authorizer approved it", authorizedRequest(keyPrincipal), true, nil, nil, ErrInvalidAPIKey, ""},
+    {"api key expired after the authorizer approved it", authorizedRequest(keyPrincipal), true, nil, map[string]types.APIKey{"key-1": {ID: "key-1", Username: "alice", ExpiresAt: time.Now().Add(-time.Second).Unix()}}, ErrAPIKeyExpired, ""},
+    {"api key on a jwt only route", authorizedRequest(keyPrincipal), false, nil, map[string]types.APIKey{"key-1": {ID: "key-1", Username: "alice"}}, ErrInvalidToken, ""},
+    {"context without token id", authorizedRequest(types.Principal{Username: "alice"}), false, nil, nil, ErrInvalidToken, ""},
+    // routes the authorizer doesn't cover check the credential themselves
+    {"no authorizer and no token", events.APIGatewayProxyRequest{}, false, nil, nil, ErrMissingToken, ""},
+    {"cognito claims are not trusted", cognitoRequest, false, nil, nil, ErrMissingToken, ""},
+    {"context without principal id is not trusted", withoutPrincipalID, false, nil, nil, ErrMissingToken, ""},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      m := NewAuthMiddleware(fakeTokenVerifier{}, &fakeRevocationStore{revoked: tt.revoked}, nil, fakeAPIKeyStore{keys: tt.keys}, true)
+
+      principal, err := m.authenticateRequest(tt.request, tt.allowAPIKey)
+      if !errors.Is(err, tt.wantErr) {
+        t.Fatalf("authenticateRequest() error = %v, want %v", err, tt.wantErr)
+      }
+
+      if principal.Username != tt.wantUsername {
+        t.Errorf("authenticateRequest() username = %q, want %q", principal.Username, tt.wantUsername)
+      }
+    })
+  }
+}
+
+func TestAuthenticateRequestWithoutAuthorizerVerifiesToken(t *testing.T) {
+  revocationStore := &fakeRevocationStore{}
+  m := NewAuthMiddleware(fakeTokenVerifier{}, revocationStore, nil, fakeAPIKeyStore{}, true)
+
+  request := events.APIGatewayProxyRequest{Headers: map[string]string{"authorization": "Bearer forged"}}
+  _, err := m.authenticateRequest(request, false)
+  if !errors.Is(err, ErrInvalidToken) {
+    t.Fatalf("forged token error = %v, want %v", err, ErrInvalidToken)
+  }
+
+  request.Headers["authorization"] = "Bearer good"
+  principal, err := m.authenticateRequest(request, false)
+  if err != nil || principal.Username != "alice" {
+    t.Fatalf("good token = %q, %v, want alice", principal.Username, err)
+  }
+
+  if revocationStore.checked != 1 {
+    t.Errorf("revocation checked %d times, want 1", revocationStore.checked)
+  }
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+  plainKey, apiKey, err := types.NewAPIKey("alice", "ci", []string{types.ScopeBlogsWrite}, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expiredKey, expired, err := types.NewAPIKey("alice", "old", []string{types.ScopeBlogsWrite}, time.Hour)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expired.ExpiresAt = time.Now().Add(-time.Second).Unix()
+
+  orphanKey, orphan, err := types.NewAPIKey("deleted-alice", "ci", []string{types.ScopeBlogsWrite}, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  readKey, readOnly, err := types.NewAPIKey("alice", "reader", []string{types.ScopeAccountRead}, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // the right id with somebody else's secret
+  id, _ := types.APIKeyID(plainKey)
+  wrongSecret := types.API_KEY_PREFIX + id + "_" + strings.Repeat("A", 43)
+
+  store := fakeAPIKeyStore{keys: map[string]types.APIKey{
+    apiKey.ID: apiKey,
+    expired.ID: expired,
+    orphan.ID: orphan,
+    readOnly.ID: readOnly,
+  }}
+  userStore := fakeUserStore{users: map[string]types.User{
+    "alice": {Username: "alice", Roles: []string{types.RoleEditor}},
+  }}
+
+  m := NewAuthMiddleware(fakeTokenVerifier{}, &fakeRevocationStore{}, userStore, store, false)
+
+  // the principal the handler saw, if it ran
+  var got *types.Principal
+  handler := func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    principal, _ := GetPrincipal(request)
+    got = &principal
+    return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+  }
+
+  apiKeyRoute := m.ValidateJWTOrAPIKeyMiddleware(RequireScope(types.ScopeBlogsWrite)(handler))
+  jwtRoute := m.ValidateJWTMiddleware(handler)
+
+  tests := []struct {
+    name string
+    route func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+    headers map[string]string
+    wantStatus int
+  }{
+    {"X-API-Key header", apiKeyRoute, map[string]string{"X-API-Key": plainKey}, http.StatusOK},
+    {"lower case header", apiKeyRoute, map[string]string{"x-api-key": plainKey}, http.StatusOK},
+    {"as the bearer token", apiKeyRoute, map[string]string{"Authorization": "Bearer " + plainKey}, http.StatusOK},
+    {"jwt on an api key route", apiKeyRoute, map[string]string{"Authorization": "Bearer good"}, http.StatusOK},
+    {"wrong secret", apiKeyRoute, map[string]string{"X-API-Key": wrongSecret}, http.StatusUnauthorized},
+    {"not shaped like a key", apiKeyRoute, map[string]string{"X-API-Key": types.API_KEY_PREFIX + "short_secret"}, http.StatusUnauthorized},
+    {"unknown key", apiKeyRoute, map[string]string{"X-API-Key": types.API_KEY_PREFIX + strings.Repeat("0", types.API_KEY_ID_LENGTH) + "_secret"}, http.StatusUnauthorized},
+    {"expired", apiKeyRoute, map[string]string{"X-API-Key": expiredKey}, http.StatusUnauthorized},
+    {"owner deleted", apiKeyRoute, map[string]string{"X-API-Key": orphanKey}, http.StatusUnauthorized},
+    {"missing the route's scope", apiKeyRoute, map[string]string{"X-API-Key": readKey}, http.StatusForbidden},
+    {"X-API-Key on a jwt only route", jwtRoute, map[string]string{"X-API-Key": plainKey}, http.StatusUnauthorized},
+    {"bearer api key on a jwt only route", jwtRoute, map[string]string{"Authorization": "Bearer " + plainKey}, http.StatusUnauthorized},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      got = nil
+
+      response, _ := tt.route(events.APIGatewayProxyRequest{Headers: tt.headers})
+      if response.StatusCode != tt.wantStatus {
+        t.Fatalf("status = %d %q, want %d", response.StatusCode, response.Body, tt.wantStatus)
+      }
+
+      if (got != nil) != (tt.wantStatus == http.StatusOK) {
+        t.Fatalf("handler ran = %v", got != nil)
+      }
+
+      // "good" is the jwt, everything else that gets through is a key
+      if got != nil && (got.APIKeyID == "") != (tt.headers["Authorization"] == "Bearer good") {
+        t.Errorf("principal = %+v", *got)
+      }
+    })
+  }
+
+  // the key acts with its owner's roles as they are now, and only within its scopes
+  response, _ := apiKeyRoute(events.APIGatewayProxyRequest{Headers: map[string]string{"X-API-Key": plainKey}})
+  if response.StatusCode != http.StatusOK || got.Username != "alice" || got.APIKeyID != apiKey.ID || !got.HasRole(types.RoleEditor) || got.HasScope(types.ScopeAccountRead) {
+    t.Errorf("principal = %+v", got)
+  }
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"lambda-func/types"
+)
+
+// the principal travels in the request context authorizer map, the same place API Gateway puts
+// the output of an authorizer. Clients can't set the request context, only API Gateway and the
+// middleware here do. Values are flat strings because that is all an authorizer context can hold
+const (
+  PRINCIPAL_USERNAME_KEY="username"
+  PRINCIPAL_ROLES_KEY="roles"
+  PRINCIPAL_TOKEN_ID_KEY="token_id"
+  PRINCIPAL_ISSUED_AT_KEY="issued_at"
+  PRINCIPAL_EXPIRES_AT_KEY="expires_at"
+  PRINCIPAL_API_KEY_ID_KEY="api_key_id"
+  PRINCIPAL_SCOPES_KEY="scopes"
+)
+
+// GetPrincipal returns who made the request, ok is false on routes without auth middleware
+func GetPrincipal(request events.APIGatewayProxyRequest) (types.Principal, bool) {
+  authorizer := request.RequestContext.Authorizer
+  if authorizer == nil {
+    return types.Principal{}, false
+  }
+
+  username, _ := authorizer[PRINCIPAL_USERNAME_KEY].(string)
+  if username == "" {
+    return types.Principal{}, false
+  }
+
+  principal := types.Principal{
+    Username: username,
+  }
+
+  principal.TokenID, _ = authorizer[PRINCIPAL_TOKEN_ID_KEY].(string)
+
+  // in milliseconds, revocations are
+  if issuedAt, _ := authorizer[PRINCIPAL_ISSUED_AT_KEY].(string); issuedAt != "" {
+    if unixMilli, err := strconv.ParseInt(issuedAt, 10, 64); err == nil {
+      principal.IssuedAt = time.UnixMilli(unixMilli)
+    }
+  }
+
+  if expiresAt, _ := authorizer[PRINCIPAL_EXPIRES_AT_KEY].(string); expiresAt != "" {
+    if unix, err := strconv.ParseInt(expiresAt, 10, 64); err == nil {
+      principal.ExpiresAt = time.Unix(unix, 0)
+    }
+  }
+
+  if roles, _ := authorizer[PRINCIPAL_ROLES_KEY].(string); roles != "" {
+    principal.Roles = strings.Split(roles, ",")
+  }
+
+  principal.APIKeyID, _ = authorizer[PRINCIPAL_API_KEY_ID_KEY].(string)
+
+  if scopes, _ := authorizer[PRINCIPAL_SCOPES_KEY].(string); scopes != "" {
+    principal.Scopes = strings.Split(scopes, ",")
+  }
+
+  return principal, true
+}
+
+func withPrincipal(request events.APIGatewayProxyRequest, principal types.Principal) events.APIGatewayProxyRequest {
+  // copy, the map may be shared with the caller's request
+  authorizer := map[string]interface{}{}
+  for key, value := range request.RequestContext.Authorizer {
+    authorizer[key] = value
+  }
+
+  // api gateway sets principalId from the authorizer's response, we set it ourselves
+  authorizer["principalId"] = principal.Username
+  for key, value := range PrincipalContext(principal) {
+    authorizer[key] = value
+  }
+
+  request.RequestContext.Authorizer = authorizer
+
+  return request
+}
+
+// the authorizer map entries for a principal, also returned as the lambda authorizer's context.
+// principalId is left out, api gateway adds it from the authorizer response
+func PrincipalContext(principal types.Principal) map[string]interface{} {
+  context := map[string]interface{}{
+    PRINCIPAL_USERNAME_KEY: principal.Username,
+    PRINCIPAL_ROLES_KEY: strings.Join(principal.Roles, ","),
+    PRINCIPAL_TOKEN_ID_KEY: principal.TokenID,
+    PRINCIPAL_ISSUED_AT_KEY: "",
+    PRINCIPAL_EXPIRES_AT_KEY: "",
+    PRINCIPAL_API_KEY_ID_KEY: principal.APIKeyID,
+    PRINCIPAL_SCOPES_KEY: strings.Join(principal.Scopes, ","),
+  }
+
+  if !principal.IssuedAt.IsZero() {
+    context[PRINCIPAL_ISSUED_AT_KEY] = strconv.FormatInt(principal.IssuedAt.UnixMilli(), 10)
+  }
+
+  if !principal.ExpiresAt.IsZero() {
+    context[PRINCIPAL_EXPIRES_AT_KEY] = strconv.FormatInt(principal.ExpiresAt.Unix(), 10)
+  }
+
+  return context
+}
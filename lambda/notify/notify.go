@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// a plain text message to one recipient
+type Message struct {
+  To string `json:"to"`
+  Subject string `json:"subject"`
+  Body string `json:"body"`
+}
+
+// Notifier delivers messages to users, the api never cares how
+type Notifier interface {
+  Send(message Message) error
+}
+
+// ses when SES_FROM_ADDRESS is set (deployed), otherwise NOTIFIER_FILE or the log (local runs)
+func NewNotifier() Notifier {
+  fromAddress := os.Getenv("SES_FROM_ADDRESS")
+  if fromAddress != "" {
+    return NewSESNotifier(fromAddress)
+  }
+
+  path := os.Getenv("NOTIFIER_FILE")
+  if path != "" {
+    return &FileNotifier{path: path}
+  }
+
+  return LogNotifier{}
+}
+
+type SESNotifier struct {
+  client *ses.SES
+  fromAddress string
+}
+
+func NewSESNotifier(fromAddress string) SESNotifier {
+  awsSession := session.Must(session.NewSession())
+
+  return SESNotifier{
+    client: ses.New(awsSession),
+    fromAddress: fromAddress,
+  }
+}
+
+func (n SESNotifier) Send(message Message) error {
+  _, err := n.client.SendEmail(&ses.SendEmailInput{
+    Source: aws.String(n.fromAddress),
+    Destination: &ses.Destination{
+      ToAddresses: []*string{aws.String(message.To)},
+    },
+    Message: &ses.Message{
+      Subject: &ses.Content{
+        Data: aws.String(message.Subject),
+        Charset: aws.String("UTF-8"),
+      },
+      Body: &ses.Body{
+        Text: &ses.Content{
+          Data: aws.String(message.Body),
+          Charset: aws.String("UTF-8"),
+        },
+      },
+    },
+  })
+
+  if err != nil {
+    return fmt.Errorf("failed to send email: %w", err)
+  }
+
+  return nil
+}
+
+// appends one json line per message, handy for picking links out of a local run
+type FileNotifier struct {
+  path string
+  mu sync.Mutex
+}
+
+func (n *FileNotifier) Send(message Message) error {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+
+  line, err := json.Marshal(struct {
+    SentAt string `json:"sent_at"`
+    Message
+  }{
+    SentAt: time.Now().UTC().Format(time.RFC3339),
+    Message: message,
+  })
+  if err != nil {
+    return err
+  }
+
+  file, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+  if err != nil {
+    return fmt.Errorf("failed to open notifier file: %w", err)
+  }
+  defer file.Close()
+
+  _, err = file.Write(append(line, '\n'))
+  if err != nil {
+    return fmt.Errorf("failed to write notification: %w", err)
+  }
+
+  return nil
+}
+
+// never use this in production, the message bodies carry secrets like reset links
+type LogNotifier struct {}
+
+func (n LogNotifier) Send(message Message) error {
+  log.Printf("notification to %s: %s\n%s", message.To, message.Subject, message.Body)
+  return nil
+}
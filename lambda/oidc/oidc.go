@@ -0,0 +1,320 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"lambda-func/keys"
+)
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+var ErrProviderNotFound = errors.New("oidc provider not found")
+
+// one entry of OIDC_PROVIDERS. The client secret can be left out for public clients, pkce
+// protects the code either way. RedirectURL is this api's /oidc/{provider}/callback and has
+// to be registered with the provider exactly as written here
+type ProviderConfig struct {
+  Issuer string `json:"issuer"`
+  ClientID string `json:"client_id"`
+  ClientSecret string `json:"client_secret,omitempty"`
+  RedirectURL string `json:"redirect_url"`
+  // defaults to openid, email and profile
+  Scopes []string `json:"scopes,omitempty"`
+}
+
+// providers by the name used in the url
+type Providers map[string]Provider
+
+// OIDC_PROVIDERS holds a json object of provider name to ProviderConfig, e.g.
+// {"google": {"issuer": "https://accounts.google.com", "client_id": "...", "redirect_url": "..."}}
+func NewProviders() (Providers, error) {
+  providers := Providers{}
+
+  value := os.Getenv("OIDC_PROVIDERS")
+  if value == "" {
+    return providers, nil
+  }
+
+  var configs map[string]ProviderConfig
+  err := json.Unmarshal([]byte(value), &configs)
+  if err != nil {
+    return providers, fmt.Errorf("OIDC_PROVIDERS is not a json object of providers: %w", err)
+  }
+
+  httpClient := &http.Client{Timeout: 5 * time.Second}
+
+  for name, config := range configs {
+    if !providerNamePattern.MatchString(name) {
+      return providers, fmt.Errorf("oidc provider name %q may only contain a-z, 0-9 and '-'", name)
+    }
+
+    if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+      return providers, fmt.Errorf("oidc provider %s needs an issuer, client_id and redirect_url", name)
+    }
+
+    providers[name] = NewProvider(name, config, httpClient)
+  }
+
+  return providers, nil
+}
+
+func (p Providers) Get(name string) (Provider, error) {
+  provider, ok := p[name]
+  if !ok {
+    return Provider{}, ErrProviderNotFound
+  }
+
+  return provider, nil
+}
+
+type Provider struct {
+  Name string
+  config ProviderConfig
+  httpClient *http.Client
+
+  // filled from the discovery document on first use
+  mu *sync.Mutex
+  metadata *metadata
+  jwks *keys.RemoteJWKS
+}
+
+// the parts of /.well-known/openid-configuration we use
+type metadata struct {
+  Issuer string `json:"issuer"`
+  AuthorizationEndpoint string `json:"authorization_endpoint"`
+  TokenEndpoint string `json:"token_endpoint"`
+  JWKSURI string `json:"jwks_uri"`
+}
+
+// what the provider says about the user. Subject is the only stable identifier, an email
+// address can be changed or reused so it is never used to find an account
+type Identity struct {
+  Subject string
+  Email string
+  EmailVerified bool
+  PreferredUsername string
+  Name string
+}
+
+type idTokenClaims struct {
+  Nonce string `json:"nonce"`
+  AuthorizedParty string `json:"azp"`
+  Email string `json:"email"`
+  // some providers send "true" as a string
+  EmailVerified interface{} `json:"email_verified"`
+  PreferredUsername string `json:"preferred_username"`
+  Name string `json:"name"`
+  jwt.RegisteredClaims
+}
+
+func NewProvider(name string, config ProviderConfig, httpClient *http.Client) Provider {
+  if len(config.Scopes) == 0 {
+    config.Scopes = []string{"openid", "email", "profile"}
+  }
+
+  return Provider{
+    Name: name,
+    config: config,
+    httpClient: httpClient,
+    mu: &sync.Mutex{},
+    metadata: &metadata{},
+    jwks: &keys.RemoteJWKS{},
+  }
+}
+
+// where to send the browser, the code challenge is the S256 hash of codeVerifier
+func (p Provider) AuthorizationURL(state string, nonce string, codeVerifier string) (string, error) {
+  endpoints, err := p.discover()
+  if err != nil {
+    return "", err
+  }
+
+  authorizationURL, err := url.Parse(endpoints.AuthorizationEndpoint)
+  if err != nil {
+    return "", fmt.Errorf("malformed authorization endpoint: %w", err)
+  }
+
+  query := authorizationURL.Query()
+  query.Set("response_type", "code")
+  query.Set("client_id", p.config.ClientID)
+  query.Set("redirect_uri", p.config.RedirectURL)
+  query.Set("scope", strings.Join(p.config.Scopes, " "))
+  query.Set("state", state)
+  query.Set("nonce", nonce)
+  query.Set("code_challenge", CodeChallenge(codeVerifier))
+  query.Set("code_challenge_method", "S256")
+  authorizationURL.RawQuery = query.Encode()
+
+  return authorizationURL.String(), nil
+}
+
+// trades the code from the callback for the user's id token
+func (p Provider) Exchange(code string, codeVerifier string) (string, error) {
+  endpoints, err := p.discover()
+  if err != nil {
+    return "", err
+  }
+
+  form := url.Values{}
+  form.Set("grant_type", "authorization_code")
+  form.Set("code", code)
+  form.Set("redirect_uri", p.config.RedirectURL)
+  form.Set("client_id", p.config.ClientID)
+  form.Set("code_verifier", codeVerifier)
+
+  request, err := http.NewRequest(http.MethodPost, endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+  if err != nil {
+    return "", err
+  }
+  request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  request.Header.Set("Accept", "application/json")
+
+  // client_secret_basic, the one every provider has to support
+  if p.config.ClientSecret != "" {
+    request.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+  }
+
+  response, err := p.httpClient.Do(request)
+  if err != nil {
+    return "", fmt.Errorf("failed to call token endpoint: %w", err)
+  }
+  defer response.Body.Close()
+
+  var tokenResponse struct {
+    IDToken string `json:"id_token"`
+    Error string `json:"error"`
+    ErrorDescription string `json:"error_description"`
+  }
+
+  err = json.NewDecoder(response.Body).Decode(&tokenResponse)
+  if err != nil {
+    return "", fmt.Errorf("failed to decode token response: %w", err)
+  }
+
+  if response.StatusCode != http.StatusOK {
+    return "", fmt.Errorf("token endpoint returned %d: %s %s", response.StatusCode, tokenResponse.Error, tokenResponse.ErrorDescription)
+  }
+
+  if tokenResponse.IDToken == "" {
+    return "", errors.New("token response has no id_token")
+  }
+
+  return tokenResponse.IDToken, nil
+}
+
+// checks the signature against the provider's jwks, iss, aud, exp and that the nonce is the one
+// stored when the sign in was started, so an id token from another sign in can't be swapped in
+func (p Provider) VerifyIDToken(idToken string, nonce string) (Identity, error) {
+  _, err := p.discover()
+  if err != nil {
+    return Identity{}, err
+  }
+
+  claims := &idTokenClaims{}
+
+  _, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    return p.jwks.PublicKey(kid)
+  },
+    jwt.WithValidMethods([]string{keys.ALG_RS256, keys.ALG_ES256}),
+    jwt.WithIssuer(p.config.Issuer),
+    jwt.WithAudience(p.config.ClientID),
+    jwt.WithExpirationRequired(),
+    jwt.WithIssuedAt(),
+  )
+
+  if err != nil {
+    return Identity{}, fmt.Errorf("invalid id token: %w", err)
+  }
+
+  if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+    return Identity{}, errors.New("id token nonce does not match")
+  }
+
+  if len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+    return Identity{}, errors.New("id token was issued to another client")
+  }
+
+  if claims.Subject == "" {
+    return Identity{}, errors.New("id token has no subject")
+  }
+
+  return Identity{
+    Subject: claims.Subject,
+    Email: claims.Email,
+    EmailVerified: claims.EmailVerified == true || claims.EmailVerified == "true",
+    PreferredUsername: claims.PreferredUsername,
+    Name: claims.Name,
+  }, nil
+}
+
+// fetched once per warm lambda, a failed fetch is retried on the next request
+func (p Provider) discover() (metadata, error) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if p.metadata.Issuer != "" {
+    return *p.metadata, nil
+  }
+
+  response, err := p.httpClient.Get(strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration")
+  if err != nil {
+    return metadata{}, fmt.Errorf("failed to fetch oidc discovery document: %w", err)
+  }
+  defer response.Body.Close()
+
+  if response.StatusCode != http.StatusOK {
+    return metadata{}, fmt.Errorf("failed to fetch oidc discovery document: status %d", response.StatusCode)
+  }
+
+  var document metadata
+  err = json.NewDecoder(response.Body).Decode(&document)
+  if err != nil {
+    return metadata{}, fmt.Errorf("failed to decode oidc discovery document: %w", err)
+  }
+
+  // the spec requires an exact match, anything else may be a different provider answering
+  if document.Issuer != p.config.Issuer {
+    return metadata{}, fmt.Errorf("oidc discovery document is for issuer %q, expected %q", document.Issuer, p.config.Issuer)
+  }
+
+  if document.AuthorizationEndpoint == "" || document.TokenEndpoint == "" || document.JWKSURI == "" {
+    return metadata{}, errors.New("oidc discovery document is missing an endpoint")
+  }
+
+  *p.metadata = document
+  *p.jwks = keys.NewRemoteJWKS(document.JWKSURI, p.httpClient)
+
+  return document, nil
+}
+
+// an unguessable url-safe string, used for state, nonce and the pkce code verifier
+func RandomString() (string, error) {
+  raw := make([]byte, 32)
+  _, err := rand.Read(raw)
+  if err != nil {
+    return "", err
+  }
+
+  return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// the pkce S256 challenge for a code verifier
+func CodeChallenge(codeVerifier string) string {
+  sum := sha256.Sum256([]byte(codeVerifier))
+  return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,291 @@
+package policy
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"lambda-func/types"
+)
+
+// common breached passwords that are at least the default 12 characters, anything shorter is already
+// rejected by the length rule. PASSWORD_BLOCKLIST_FILE can add a longer list
+//go:embed breached_passwords.txt
+var breachedPasswords string
+
+// names that would be confusing or misleading as a username, or collide with routes like /users/me
+var reservedUsernames = map[string]bool{
+  "admin": true,
+  "administrator": true,
+  "root": true,
+  "system": true,
+  "support": true,
+  "help": true,
+  "security": true,
+  "api": true,
+  "me": true,
+  "null": true,
+  "undefined": true,
+  "anonymous": true,
+  "deleted-user": true,
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// one failed rule, returned to the client so it can tell the user what to fix
+type Violation struct {
+  Field string `json:"field"`
+  Rule string `json:"rule"`
+  Message string `json:"message"`
+}
+
+type PasswordPolicy struct {
+  MinLength int
+  MaxLength int
+  // how many of lower case, upper case, digits and symbols must appear
+  MinCharacterClasses int
+  breached map[string]bool
+}
+
+// PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH, PASSWORD_MIN_CHARACTER_CLASSES and PASSWORD_BLOCKLIST_FILE
+// override the defaults. The max stays at 72 by default since bcrypt ignores anything longer
+func NewPasswordPolicy() (PasswordPolicy, error) {
+  passwordPolicy := PasswordPolicy{
+    MinLength: envInt("PASSWORD_MIN_LENGTH", 12),
+    MaxLength: envInt("PASSWORD_MAX_LENGTH", 72),
+    MinCharacterClasses: envInt("PASSWORD_MIN_CHARACTER_CLASSES", 0),
+    breached: map[string]bool{},
+  }
+
+  addPasswords(passwordPolicy.breached, breachedPasswords, passwordPolicy.MinLength)
+
+  if path := os.Getenv("PASSWORD_BLOCKLIST_FILE"); path != "" {
+    contents, err := os.ReadFile(path)
+    if err != nil {
+      return passwordPolicy, fmt.Errorf("failed to read password blocklist: %w", err)
+    }
+    addPasswords(passwordPolicy.breached, string(contents), passwordPolicy.MinLength)
+  }
+
+  return passwordPolicy, nil
+}
+
+func (p PasswordPolicy) Validate(username string, password string) []Violation {
+  violations := []Violation{}
+  length := len([]rune(password))
+
+  if length < p.MinLength {
+    violations = append(violations, Violation{
+      Field: "password",
+      Rule: "min_length",
+      Message: fmt.Sprintf("password must be at least %d characters", p.MinLength),
+    })
+  }
+
+  // bytes, not runes, that is what the hash sees
+  if p.MaxLength > 0 && len(password) > p.MaxLength {
+    violations = append(violations, Violation{
+      Field: "password",
+      Rule: "max_length",
+      Message: fmt.Sprintf("password must be at most %d bytes", p.MaxLength),
+    })
+  }
+
+  if characterClasses(password) < p.MinCharacterClasses {
+    violations = append(violations, Violation{
+      Field: "password",
+      Rule: "character_classes",
+      Message: fmt.Sprintf("password must mix at least %d of lower case, upper case, digits and symbols", p.MinCharacterClasses),
+    })
+  }
+
+  if p.breached[strings.ToLower(password)] {
+    violations = append(violations, Violation{
+      Field: "password",
+      Rule: "breached",
+      Message: "password appears in a list of breached passwords",
+    })
+  }
+
+  if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+    violations = append(violations, Violation{
+      Field: "password",
+      Rule: "contains_username",
+      Message: "password must not contain the username",
+    })
+  }
+
+  return violations
+}
+
+// usernames are case-folded and trimmed so "Alice" and "alice " are the same account
+func NormalizeUsername(username string) string {
+  return strings.ToLower(strings.TrimSpace(username))
+}
+
+// expects a username already passed through NormalizeUsername
+func ValidateUsername(username string) []Violation {
+  violations := []Violation{}
+  length := len(username)
+
+  if length < 3 || length > 32 {
+    violations = append(violations, Violation{
+      Field: "username",
+      Rule: "length",
+      Message: "username must be between 3 and 32 characters",
+    })
+  }
+
+  if !usernamePattern.MatchString(username) {
+    violations = append(violations, Violation{
+      Field: "username",
+      Rule: "allowed_characters",
+      Message: "username may only contain a-z, 0-9, '.', '_' and '-' and must start with a letter or digit",
+    })
+  }
+
+  if reservedUsernames[username] {
+    violations = append(violations, Violation{
+      Field: "username",
+      Rule: "reserved",
+      Message: "username is reserved",
+    })
+  }
+
+  return violations
+}
+
+var usernameDisallowed = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// turns a name from somewhere else, like an oidc preferred_username or the local part of an
+// email address, into one that passes ValidateUsername, empty when nothing usable is left.
+// Leaves room for a suffix in case the name is taken
+func SuggestUsername(name string) string {
+  username := usernameDisallowed.ReplaceAllString(NormalizeUsername(name), "-")
+  username = strings.TrimLeft(username, "._-")
+
+  if len(username) > 24 {
+    username = username[:24]
+  }
+  username = strings.TrimRight(username, "._-")
+
+  if len(ValidateUsername(username)) > 0 {
+    return ""
+  }
+
+  return username
+}
+
+// email addresses are compared case-insensitively
+func NormalizeEmail(email string) string {
+  return strings.ToLower(strings.TrimSpace(email))
+}
+
+// a bare address, no display name
+func ValidateEmail(email string) []Violation {
+  violations := []Violation{}
+
+  address, err := mail.ParseAddress(email)
+  if err != nil || address.Address != email || len(email) > 254 {
+    violations = append(violations, Violation{
+      Field: "email",
+      Rule: "format",
+      Message: "email must be a valid address like name@example.com",
+    })
+  }
+
+  return violations
+}
+
+// length limits keep profiles small enough to list, avatars must be https so pages don't mix content
+func ValidateProfile(update types.UpdateProfile) []Violation {
+  violations := []Violation{}
+
+  if update.DisplayName != nil {
+    if utf8.RuneCountInString(*update.DisplayName) > 64 || hasControlCharacters(*update.DisplayName) {
+      violations = append(violations, Violation{
+        Field: "display_name",
+        Rule: "format",
+        Message: "display name must be at most 64 characters on a single line",
+      })
+    }
+  }
+
+  if update.Bio != nil && utf8.RuneCountInString(*update.Bio) > 500 {
+    violations = append(violations, Violation{
+      Field: "bio",
+      Rule: "max_length",
+      Message: "bio must be at most 500 characters",
+    })
+  }
+
+  if update.AvatarURL != nil && *update.AvatarURL != "" {
+    avatarURL, err := url.Parse(*update.AvatarURL)
+    if err != nil || avatarURL.Scheme != "https" || avatarURL.Host == "" || len(*update.AvatarURL) > 2048 {
+      violations = append(violations, Violation{
+        Field: "avatar_url",
+        Rule: "format",
+        Message: "avatar url must be an https url of at most 2048 characters",
+      })
+    }
+  }
+
+  return violations
+}
+
+func hasControlCharacters(value string) bool {
+  for _, r := range value {
+    if unicode.IsControl(r) {
+      return true
+    }
+  }
+
+  return false
+}
+
+func characterClasses(password string) int {
+  var lower, upper, digit, symbol int
+
+  for _, r := range password {
+    switch {
+      case unicode.IsLower(r):
+        lower = 1
+      case unicode.IsUpper(r):
+        upper = 1
+      case unicode.IsDigit(r):
+        digit = 1
+      default:
+        symbol = 1
+    }
+  }
+
+  return lower + upper + digit + symbol
+}
+
+// skips entries shorter than minLength, the length rule rejects those before the list is checked
+func addPasswords(set map[string]bool, list string, minLength int) {
+  scanner := bufio.NewScanner(strings.NewReader(list))
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if line != "" && len([]rune(line)) >= minLength {
+      set[strings.ToLower(line)] = true
+    }
+  }
+}
+
+func envInt(name string, fallback int) int {
+  value, err := strconv.Atoi(os.Getenv(name))
+  if err != nil {
+    return fallback
+  }
+
+  return value
+}
@@ -0,0 +1,76 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func rules(violations []Violation) []string {
+  names := []string{}
+  for _, violation := range violations {
+    names = append(names, violation.Rule)
+  }
+
+  return names
+}
+
+func TestValidateBreachedPasswords(t *testing.T) {
+  blocklist := filepath.Join(t.TempDir(), "blocklist.txt")
+  if err := os.WriteFile(blocklist, []byte("Tr0ub4dor&3xyz\nshort1\n"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  t.Setenv("PASSWORD_BLOCKLIST_FILE", blocklist)
+
+  passwordPolicy, err := NewPasswordPolicy()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    name string
+    password string
+    wantRules []string
+  }{
+    {name: "breached and long enough", password: "qwertyuiop123", wantRules: []string{"breached"}},
+    {name: "breached is case insensitive", password: "IloveYou1234", wantRules: []string{"breached"}},
+    {name: "from the blocklist file", password: "tr0ub4dor&3XYZ", wantRules: []string{"breached"}},
+    {name: "not breached", password: "velvet-otter-harbor", wantRules: []string{}},
+    {name: "too short is only a length problem", password: "short1", wantRules: []string{"min_length"}},
+  }
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      got := rules(passwordPolicy.Validate("alice", tt.password))
+      if len(got) != len(tt.wantRules) {
+        t.Fatalf("Validate(%q) = %v, want %v", tt.password, got, tt.wantRules)
+      }
+
+      for i := range got {
+        if got[i] != tt.wantRules[i] {
+          t.Fatalf("Validate(%q) = %v, want %v", tt.password, got, tt.wantRules)
+        }
+      }
+    })
+  }
+}
+
+// every shipped entry has to be one the length rule lets through, or the check never fires
+func TestBreachedPasswordsAreLongEnough(t *testing.T) {
+  passwordPolicy, err := NewPasswordPolicy()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(passwordPolicy.breached) < 100 {
+    t.Fatalf("only %d breached passwords of at least %d characters", len(passwordPolicy.breached), passwordPolicy.MinLength)
+  }
+
+  set := map[string]bool{}
+  addPasswords(set, breachedPasswords, 0)
+  for password := range set {
+    if len([]rune(password)) < passwordPolicy.MinLength {
+      t.Errorf("%q is shorter than the %d character minimum", password, passwordPolicy.MinLength)
+    }
+  }
+}
@@ -0,0 +1,206 @@
+package router
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// aliases so plain handler funcs and the existing middleware can be passed in without conversion
+type HandlerFunc = func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+type Middleware = func(next HandlerFunc) HandlerFunc
+
+type route struct {
+  method string
+  segments []string
+  handler HandlerFunc
+}
+
+// a group is a Router sharing the route table of its parent, with a path prefix and middleware of its own
+type Router struct {
+  prefix string
+  middleware []Middleware
+  routes *[]route
+}
+
+func New() *Router {
+  return &Router{
+    routes: &[]route{},
+  }
+}
+
+// routes registered on the group get the prefix and run the group middleware before their own
+func (r *Router) Group(prefix string, middleware ...Middleware) *Router {
+  groupMiddleware := append([]Middleware{}, r.middleware...)
+  groupMiddleware = append(groupMiddleware, middleware...)
+
+  return &Router{
+    prefix: r.prefix + prefix,
+    middleware: groupMiddleware,
+    routes: r.routes,
+  }
+}
+
+// path is a template like "/blog/{slug}", matched values end up in request.PathParameters
+func (r *Router) Handle(method string, path string, handler HandlerFunc, middleware ...Middleware) {
+  all := append([]Middleware{}, r.middleware...)
+  all = append(all, middleware...)
+
+  // first middleware in the list is the outermost one
+  for i := len(all) - 1; i >= 0; i-- {
+    handler = all[i](handler)
+  }
+
+  *r.routes = append(*r.routes, route{
+    method: method,
+    segments: splitPath(r.prefix + path),
+    handler: handler,
+  })
+}
+
+func (r *Router) GET(path string, handler HandlerFunc, middleware ...Middleware) {
+  r.Handle(http.MethodGet, path, handler, middleware...)
+}
+
+func (r *Router) POST(path string, handler HandlerFunc, middleware ...Middleware) {
+  r.Handle(http.MethodPost, path, handler, middleware...)
+}
+
+func (r *Router) PUT(path string, handler HandlerFunc, middleware ...Middleware) {
+  r.Handle(http.MethodPut, path, handler, middleware...)
+}
+
+func (r *Router) PATCH(path string, handler HandlerFunc, middleware ...Middleware) {
+  r.Handle(http.MethodPatch, path, handler, middleware...)
+}
+
+func (r *Router) DELETE(path string, handler HandlerFunc, middleware ...Middleware) {
+  r.Handle(http.MethodDelete, path, handler, middleware...)
+}
+
+// ServeRequest is the lambda entry point. Handler errors are logged rather than returned,
+// returning them to lambda makes API Gateway answer 502 and drop the handler's response
+func (r *Router) ServeRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+  pathSegments := splitPath(request.Path)
+
+  var matched *route
+  var params map[string]string
+  // a set, several templates can match the path with the same method
+  allowed := map[string]bool{}
+
+  for i := range *r.routes {
+    candidate := &(*r.routes)[i]
+
+    candidateParams, ok := match(candidate.segments, pathSegments)
+    if !ok {
+      continue
+    }
+
+    if candidate.method != request.HTTPMethod {
+      allowed[candidate.method] = true
+      continue
+    }
+
+    // static segments win over parameters, "/users/me" before "/users/{username}"
+    if matched == nil || moreSpecific(candidate.segments, matched.segments) {
+      matched = candidate
+      params = candidateParams
+    }
+  }
+
+  if matched == nil {
+    if len(allowed) > 0 {
+      methods := make([]string, 0, len(allowed))
+      for method := range allowed {
+        methods = append(methods, method)
+      }
+      sort.Strings(methods)
+
+      return events.APIGatewayProxyResponse{
+        Body: "Method Not Allowed",
+        StatusCode: http.StatusMethodNotAllowed,
+        Headers: map[string]string{
+          "Allow": strings.Join(methods, ", "),
+        },
+      }, nil
+    }
+
+    return events.APIGatewayProxyResponse{
+      Body: "Not Found",
+      StatusCode: http.StatusNotFound,
+    }, nil
+  }
+
+  pathParameters := map[string]string{}
+  for key, value := range request.PathParameters {
+    pathParameters[key] = value
+  }
+  for key, value := range params {
+    pathParameters[key] = value
+  }
+  request.PathParameters = pathParameters
+
+  response, err := matched.handler(request)
+  if err != nil {
+    log.Printf("%s %s: %v", request.HTTPMethod, request.Path, err)
+  }
+
+  return response, nil
+}
+
+func match(template []string, path []string) (map[string]string, bool) {
+  if len(template) != len(path) {
+    return nil, false
+  }
+
+  params := map[string]string{}
+
+  for i, segment := range template {
+    if isParam(segment) {
+      if path[i] == "" {
+        return nil, false
+      }
+
+      value, err := url.PathUnescape(path[i])
+      if err != nil {
+        value = path[i]
+      }
+
+      params[segment[1:len(segment)-1]] = value
+      continue
+    }
+
+    if segment != path[i] {
+      return nil, false
+    }
+  }
+
+  return params, true
+}
+
+func moreSpecific(a []string, b []string) bool {
+  for i := range a {
+    if isParam(a[i]) != isParam(b[i]) {
+      return !isParam(a[i])
+    }
+  }
+
+  return false
+}
+
+func isParam(segment string) bool {
+  return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+func splitPath(path string) []string {
+  path = strings.Trim(path, "/")
+  if path == "" {
+    return []string{}
+  }
+
+  return strings.Split(path, "/")
+}
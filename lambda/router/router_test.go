@@ -0,0 +1,141 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestServeRequest(t *testing.T) {
+  // the path parameters the last matched handler was called with
+  var gotParams map[string]string
+
+  // answers with the route's name so the test can see which one matched
+  named := func(name string) HandlerFunc {
+    return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+      gotParams = request.PathParameters
+      return events.APIGatewayProxyResponse{Body: name, StatusCode: http.StatusOK}, nil
+    }
+  }
+
+  r := New()
+  r.GET("/blogs", named("list blogs"))
+  r.POST("/blog", named("create blog"))
+  r.GET("/blog/{slug}", named("get blog"))
+  r.PUT("/blog/{slug}", named("update blog"))
+  r.DELETE("/blog/{slug}", named("delete blog"))
+  r.GET("/users/me", named("me"))
+  r.GET("/users/{username}", named("get user"))
+  r.GET("/users/{username}/blogs", named("user blogs"))
+  r.PATCH("/users/{username}", named("patch user"))
+  r.DELETE("/users/{id}", named("delete user"))
+
+  tests := []struct {
+    name string
+    method string
+    path string
+    wantStatus int
+    wantBody string
+    wantParams map[string]string
+    wantAllow string
+  }{
+    {"static route", "GET", "/blogs", 200, "list blogs", nil, ""},
+    {"trailing slash", "GET", "/blogs/", 200, "list blogs", nil, ""},
+    {"parameter", "GET", "/blog/hello-world", 200, "get blog", map[string]string{"slug": "hello-world"}, ""},
+    {"escaped parameter", "GET", "/blog/a%20b", 200, "get blog", map[string]string{"slug": "a b"}, ""},
+    {"same template other method", "DELETE", "/blog/hello", 200, "delete blog", map[string]string{"slug": "hello"}, ""},
+    {"static wins over parameter", "GET", "/users/me", 200, "me", nil, ""},
+    {"parameter next to static", "GET", "/users/alice", 200, "get user", map[string]string{"username": "alice"}, ""},
+    {"nested parameter", "GET", "/users/alice/blogs", 200, "user blogs", map[string]string{"username": "alice"}, ""},
+    {"parameter names differ by method", "DELETE", "/users/alice", 200, "delete user", map[string]string{"id": "alice"}, ""},
+    {"unknown path", "GET", "/nope", 404, "Not Found", nil, ""},
+    {"too many segments", "GET", "/blog/a/b", 404, "Not Found", nil, ""},
+    {"empty parameter", "GET", "/users//blogs", 404, "Not Found", nil, ""},
+    {"wrong method", "POST", "/blog/hello", 405, "Method Not Allowed", nil, "DELETE, GET, PUT"},
+    {"wrong method on static path", "GET", "/blog", 405, "Method Not Allowed", nil, "POST"},
+    // /users/me and /users/{username} both allow GET, it is listed once
+    {"allow lists each method once", "PUT", "/users/me", 405, "Method Not Allowed", nil, "DELETE, GET, PATCH"},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      gotParams = nil
+      request := events.APIGatewayProxyRequest{HTTPMethod: test.method, Path: test.path}
+
+      response, err := r.ServeRequest(request)
+      if err != nil {
+        t.Fatalf("ServeRequest error = %v", err)
+      }
+
+      if response.StatusCode != test.wantStatus || response.Body != test.wantBody {
+        t.Errorf("ServeRequest = %d %q, want %d %q", response.StatusCode, response.Body, test.wantStatus, test.wantBody)
+      }
+
+      if allow := response.Headers["Allow"]; allow != test.wantAllow {
+        t.Errorf("Allow = %q, want %q", allow, test.wantAllow)
+      }
+
+      for key, want := range test.wantParams {
+        if gotParams[key] != want {
+          t.Errorf("PathParameters[%s] = %q, want %q", key, gotParams[key], want)
+        }
+      }
+    })
+  }
+}
+
+func TestGroup(t *testing.T) {
+  calls := []string{}
+
+  record := func(name string) Middleware {
+    return func(next HandlerFunc) HandlerFunc {
+      return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+        calls = append(calls, name)
+        return next(request)
+      }
+    }
+  }
+
+  handler := func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    calls = append(calls, "handler")
+    return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+  }
+
+  r := New()
+  admin := r.Group("/admin", record("group"))
+  admin.GET("/blogs/{slug}", handler, record("route"))
+  r.GET("/blogs", handler)
+
+  calls = nil
+  response, _ := r.ServeRequest(events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/admin/blogs/x"})
+  if response.StatusCode != http.StatusOK {
+    t.Fatalf("group route = %d, want 200", response.StatusCode)
+  }
+
+  want := []string{"group", "route", "handler"}
+  if len(calls) != len(want) || calls[0] != want[0] || calls[1] != want[1] || calls[2] != want[2] {
+    t.Errorf("calls = %v, want %v", calls, want)
+  }
+
+  // the group's middleware stays on the group's routes
+  calls = nil
+  r.ServeRequest(events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/blogs"})
+  if len(calls) != 1 || calls[0] != "handler" {
+    t.Errorf("calls outside the group = %v, want [handler]", calls)
+  }
+}
+
+// a handler error is logged, returning it would make api gateway drop the response for a 502
+func TestServeRequestKeepsHandlerResponseOnError(t *testing.T) {
+  r := New()
+  r.GET("/fail", func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    return events.APIGatewayProxyResponse{Body: "Internal Server Error", StatusCode: http.StatusInternalServerError}, errors.New("boom")
+  })
+
+  response, err := r.ServeRequest(events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/fail"})
+  if err != nil || response.StatusCode != http.StatusInternalServerError {
+    t.Errorf("ServeRequest = %d, %v, want 500 and no error", response.StatusCode, err)
+  }
+}
@@ -0,0 +1,110 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// the ascii secret "12345678901234567890" from RFC 6238 appendix B
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// the SHA1 vectors from RFC 6238 appendix B, which are 8 digits, cut to our 6
+func TestCodeRFC6238Vectors(t *testing.T) {
+  tests := []struct {
+    unix int64
+    code string
+  }{
+    {59, "287082"},
+    {1111111109, "081804"},
+    {1111111111, "050471"},
+    {1234567890, "005924"},
+    {2000000000, "279037"},
+    {20000000000, "353130"},
+  }
+
+  for _, test := range tests {
+    code, err := Code(rfcSecret, Step(time.Unix(test.unix, 0)))
+    if err != nil {
+      t.Fatalf("Code at %d: %v", test.unix, err)
+    }
+
+    if code != test.code {
+      t.Errorf("Code at %d = %s, want %s", test.unix, code, test.code)
+    }
+  }
+}
+
+func TestCodeLowerCaseSecret(t *testing.T) {
+  code, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", Step(time.Unix(59, 0)))
+  if err != nil || code != "287082" {
+    t.Errorf("Code with a lower case secret = %s, %v, want 287082", code, err)
+  }
+}
+
+func TestCodeInvalidSecret(t *testing.T) {
+  _, err := Code("not base32!", 1)
+  if err == nil {
+    t.Error("Code accepted an invalid secret")
+  }
+}
+
+func TestValidate(t *testing.T) {
+  now := time.Unix(1111111111, 0)
+  step := Step(now)
+
+  codeAt := func(step int64) string {
+    code, err := Code(rfcSecret, step)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return code
+  }
+
+  tests := []struct {
+    name string
+    code string
+    lastStep int64
+    wantStep int64
+    wantOK bool
+  }{
+    {"current step", codeAt(step), 0, step, true},
+    {"previous step within skew", codeAt(step - 1), 0, step - 1, true},
+    {"next step within skew", codeAt(step + 1), 0, step + 1, true},
+    {"outside skew", codeAt(step - 2), 0, 0, false},
+    {"surrounding spaces", " " + codeAt(step) + " ", 0, step, true},
+    {"wrong length", codeAt(step)[:5], 0, 0, false},
+    {"wrong code", "000000", 0, 0, false},
+    {"replay of the last used step", codeAt(step), step, 0, false},
+    {"earlier step after a later one was used", codeAt(step - 1), step, 0, false},
+    {"later step after an earlier one was used", codeAt(step + 1), step, step + 1, true},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      gotStep, ok := Validate(rfcSecret, test.code, now, test.lastStep)
+      if ok != test.wantOK || gotStep != test.wantStep {
+        t.Errorf("Validate = %d, %v, want %d, %v", gotStep, ok, test.wantStep, test.wantOK)
+      }
+    })
+  }
+}
+
+func TestValidateStoredStepRefusesReuse(t *testing.T) {
+  now := time.Unix(1234567890, 0)
+
+  code, err := Code(rfcSecret, Step(now))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  lastStep, ok := Validate(rfcSecret, code, now, 0)
+  if !ok {
+    t.Fatal("first use of the code was refused")
+  }
+
+  // same code a few seconds later, still inside the skew window
+  _, ok = Validate(rfcSecret, code, now.Add(10 * time.Second), lastStep)
+  if ok {
+    t.Error("a used code was accepted again")
+  }
+}
@@ -0,0 +1,102 @@
+package types
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// keys look like gck_<id>_<secret>, the id finds the stored record and only the sha256 of the
+// whole key is kept, so a leaked table can't be used to call the api
+const (
+  API_KEY_PREFIX = "gck_"
+  API_KEY_ID_LENGTH = 16
+)
+
+// what an api key may be used for, a key can never do more than its owner's roles allow
+const (
+  ScopeBlogsWrite = "blogs:write"
+  ScopeAccountRead = "account:read"
+)
+
+var validScopes = map[string]bool{
+  ScopeBlogsWrite: true,
+  ScopeAccountRead: true,
+}
+
+func IsValidScope(scope string) bool {
+  return validScopes[scope]
+}
+
+type APIKey struct {
+  ID string `json:"id"`
+  Username string `json:"username"`
+  Name string `json:"name"`
+  KeyHash string `json:"-" dynamodbav:"key_hash"`
+  Scopes []string `json:"scopes" dynamodbav:"scopes,stringset"`
+  CreatedAt string `json:"created_at"`
+  LastUsedAt string `json:"last_used_at,omitempty"`
+  // unix seconds, absent for keys that never expire
+  ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// the plain key is only returned here, once, when it is created
+type CreatedAPIKey struct {
+  APIKey
+  Key string `json:"key"`
+}
+
+// a zero ttl makes a key that doesn't expire
+func NewAPIKey(username string, name string, scopes []string, ttl time.Duration) (string, APIKey, error) {
+  idBytes := make([]byte, API_KEY_ID_LENGTH / 2)
+  _, err := rand.Read(idBytes)
+  if err != nil {
+    return "", APIKey{}, err
+  }
+
+  secretBytes := make([]byte, 32)
+  _, err = rand.Read(secretBytes)
+  if err != nil {
+    return "", APIKey{}, err
+  }
+
+  id := hex.EncodeToString(idBytes)
+  plainKey := API_KEY_PREFIX + id + "_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+  now := time.Now().UTC()
+
+  apiKey := APIKey{
+    ID: id,
+    Username: username,
+    Name: name,
+    KeyHash: HashToken(plainKey),
+    Scopes: scopes,
+    CreatedAt: now.Format(time.RFC3339),
+  }
+
+  if ttl > 0 {
+    apiKey.ExpiresAt = now.Add(ttl).Unix()
+  }
+
+  return plainKey, apiKey, nil
+}
+
+// the id part of a plain key, ok is false when it isn't shaped like one of ours
+func APIKeyID(plainKey string) (string, bool) {
+  rest, found := strings.CutPrefix(plainKey, API_KEY_PREFIX)
+  if !found {
+    return "", false
+  }
+
+  id, secret, found := strings.Cut(rest, "_")
+  if !found || len(id) != API_KEY_ID_LENGTH || secret == "" {
+    return "", false
+  }
+
+  return id, true
+}
+
+func (k APIKey) IsExpired() bool {
+  return k.ExpiresAt != 0 && k.ExpiresAt <= time.Now().Unix()
+}
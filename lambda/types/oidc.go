@@ -0,0 +1,69 @@
+package types
+
+import "time"
+
+// how long a user has to finish signing in at the provider
+const OIDC_STATE_TTL = 10 * time.Minute
+
+// one sign in that was started at a provider and not finished yet. Only the sha256 of the state
+// is stored, the code verifier has to be stored as is since the token endpoint wants it back
+type OIDCState struct {
+  StateHash string `json:"state_hash"`
+  Provider string `json:"provider"`
+  Nonce string `json:"nonce"`
+  CodeVerifier string `json:"code_verifier"`
+  // set when a signed in user is linking the provider to their account instead of logging in
+  LinkUsername string `json:"link_username,omitempty"`
+  CreatedAt string `json:"created_at"`
+  ExpiresAt int64 `json:"expires_at"`
+}
+
+func NewOIDCState(state string, provider string, nonce string, codeVerifier string, linkUsername string) OIDCState {
+  now := time.Now().UTC()
+
+  return OIDCState{
+    StateHash: HashToken(state),
+    Provider: provider,
+    Nonce: nonce,
+    CodeVerifier: codeVerifier,
+    LinkUsername: linkUsername,
+    CreatedAt: now.Format(time.RFC3339),
+    ExpiresAt: now.Add(OIDC_STATE_TTL).Unix(),
+  }
+}
+
+// an account at an external provider that signs in as Username, the provider's subject never changes
+type IdentityLink struct {
+  ID string `json:"id"`
+  Provider string `json:"provider"`
+  Subject string `json:"subject"`
+  Username string `json:"username"`
+  Email string `json:"email,omitempty"`
+  CreatedAt string `json:"created_at"`
+}
+
+func NewIdentityLink(provider string, subject string, username string, email string) IdentityLink {
+  return IdentityLink{
+    ID: IdentityLinkID(provider, subject),
+    Provider: provider,
+    Subject: subject,
+    Username: username,
+    Email: email,
+    CreatedAt: time.Now().UTC().Format(time.RFC3339),
+  }
+}
+
+// subjects are only unique per provider
+func IdentityLinkID(provider string, subject string) string {
+  return provider + "|" + subject
+}
+
+// a user signing up through a provider has no password, they set their first one with PUT /me/password
+func NewExternalUser(username string, email string) User {
+  return User{
+    Username: username,
+    Email: email,
+    Roles: []string{RoleReader},
+    CreatedAt: time.Now().UTC().Format(time.RFC3339),
+  }
+}
@@ -0,0 +1,23 @@
+package types
+
+import "time"
+
+// only the sha256 of the emailed token is stored, used_at is set when it is redeemed
+type PasswordReset struct {
+  TokenHash string `json:"token_hash"`
+  Username string `json:"username"`
+  CreatedAt string `json:"created_at"`
+  ExpiresAt int64 `json:"expires_at"`
+  UsedAt string `json:"used_at,omitempty"`
+}
+
+func NewPasswordReset(token string, username string, ttl time.Duration) PasswordReset {
+  now := time.Now().UTC()
+
+  return PasswordReset{
+    TokenHash: HashToken(token),
+    Username: username,
+    CreatedAt: now.Format(time.RFC3339),
+    ExpiresAt: now.Add(ttl).Unix(),
+  }
+}
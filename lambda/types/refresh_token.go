@@ -0,0 +1,61 @@
+package types
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// refresh tokens are opaque random strings, only their sha256 is stored.
+// Every token issued by rotating another one shares its family id
+type RefreshToken struct {
+  TokenHash string `json:"token_hash"`
+  Username string `json:"username"`
+  FamilyID string `json:"family_id"`
+  CreatedAt string `json:"created_at"`
+  ExpiresAt int64 `json:"expires_at"`
+  UsedAt string `json:"used_at,omitempty"`
+  Revoked bool `json:"revoked"`
+}
+
+type TokenResponse struct {
+  AccessToken string `json:"access-token"`
+  RefreshToken string `json:"refresh-token"`
+}
+
+// login answer for accounts with mfa, the mfa token is exchanged at /login/mfa together with a code
+type MFAChallengeResponse struct {
+  MFARequired bool `json:"mfa-required"`
+  MFAToken string `json:"mfa-token"`
+}
+
+func NewRefreshToken(username string, familyID string, ttl time.Duration) (string, RefreshToken, error) {
+  raw := make([]byte, 32)
+  _, err := rand.Read(raw)
+  if err != nil {
+    return "", RefreshToken{}, err
+  }
+
+  plainToken := base64.RawURLEncoding.EncodeToString(raw)
+  now := time.Now().UTC()
+
+  return plainToken, RefreshToken{
+    TokenHash: HashToken(plainToken),
+    Username: username,
+    FamilyID: familyID,
+    CreatedAt: now.Format(time.RFC3339),
+    ExpiresAt: now.Add(ttl).Unix(),
+  }, nil
+}
+
+// sha256 is enough here, unlike passwords the tokens are long and random
+func HashToken(plainToken string) string {
+  sum := sha256.Sum256([]byte(plainToken))
+  return hex.EncodeToString(sum[:])
+}
+
+func (t RefreshToken) IsExpired() bool {
+  return time.Now().Unix() >= t.ExpiresAt
+}
@@ -0,0 +1,193 @@
+package types
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"lambda-func/keys"
+)
+
+// iat in milliseconds, a revocation cutoff in whole seconds would miss tokens issued in the
+// same second as a logout or password change
+func init() {
+  jwt.TimePrecision = time.Millisecond
+}
+
+// token_use keeps the different jwts we sign from being used in place of each other
+const (
+  TokenUseAccess = "access"
+  TokenUseMFA = "mfa"
+  TokenUsePasswordReset = "password_reset"
+  TokenUseEmailVerify = "email_verify"
+  TokenUseOIDCLink = "oidc_link"
+)
+
+// how long a user has to type their code after the password was accepted
+const MFA_TOKEN_TTL = time.Minute * 5
+
+// reset links are emailed, keep the window short
+const PASSWORD_RESET_TOKEN_TTL = time.Hour * 1
+
+// verification links can be resent, so a day is plenty
+const EMAIL_VERIFICATION_TOKEN_TTL = time.Hour * 24
+
+// a link url only has to make it from the api response into the address bar
+const OIDC_LINK_TOKEN_TTL = time.Minute * 2
+
+// sub is the username, validation of the registered claims is left to the jwt library
+type Claims struct {
+  Roles []string `json:"roles,omitempty"`
+  TokenUse string `json:"token_use"`
+  jwt.RegisteredClaims
+}
+
+type TokenConfig struct {
+  Issuer string
+  Audience string
+  TTL time.Duration
+}
+
+// JWT_ISSUER and JWT_AUDIENCE override the defaults, both sides of the token use the same config
+func NewTokenConfig() TokenConfig {
+  config := TokenConfig{
+    Issuer: "go-cdk",
+    Audience: "go-cdk-api",
+    TTL: time.Hour * 1,
+  }
+
+  if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+    config.Issuer = issuer
+  }
+
+  if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+    config.Audience = audience
+  }
+
+  return config
+}
+
+func CreateToken(user User, keyProvider keys.KeyProvider, config TokenConfig) (string, error) {
+  return signToken(user, TokenUseAccess, user.UserRoles(), config.TTL, keyProvider, config)
+}
+
+// proves the password step of a login passed, it carries no roles and is only accepted by /login/mfa
+func CreateMFAToken(user User, keyProvider keys.KeyProvider, config TokenConfig) (string, error) {
+  return signToken(user, TokenUseMFA, nil, MFA_TOKEN_TTL, keyProvider, config)
+}
+
+// the signature proves we issued it, the stored hash makes it single use
+func CreatePasswordResetToken(user User, keyProvider keys.KeyProvider, config TokenConfig) (string, error) {
+  return signToken(user, TokenUsePasswordReset, nil, PASSWORD_RESET_TOKEN_TTL, keyProvider, config)
+}
+
+// proves whoever holds it received the email sent to the address given at registration
+func CreateEmailVerificationToken(user User, keyProvider keys.KeyProvider, config TokenConfig) (string, error) {
+  return signToken(user, TokenUseEmailVerify, nil, EMAIL_VERIFICATION_TOKEN_TTL, keyProvider, config)
+}
+
+// lets a browser navigation start linking a provider to the account, see OIDCHandler. Single use
+func CreateOIDCLinkToken(user User, keyProvider keys.KeyProvider, config TokenConfig) (string, error) {
+  return signToken(user, TokenUseOIDCLink, nil, OIDC_LINK_TOKEN_TTL, keyProvider, config)
+}
+
+func signToken(user User, tokenUse string, roles []string, ttl time.Duration, keyProvider keys.KeyProvider, config TokenConfig) (string, error) {
+  now := time.Now()
+
+  claims := Claims{
+    Roles: roles,
+    TokenUse: tokenUse,
+    RegisteredClaims: jwt.RegisteredClaims{
+      Subject: user.Username,
+      Issuer: config.Issuer,
+      Audience: jwt.ClaimStrings{config.Audience},
+      ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+      IssuedAt: jwt.NewNumericDate(now),
+      NotBefore: jwt.NewNumericDate(now),
+      ID: uuid.NewString(),
+    },
+  }
+
+  key, err := keyProvider.SigningKey()
+  if err != nil {
+    return "", err
+  }
+
+  token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+  // tells verifiers which of the published keys to check against
+  token.Header["kid"] = key.ID
+
+  tokenString, err := token.SignedString(key.PrivateKey())
+  if err != nil {
+    return "", err
+  }
+
+  return tokenString, nil
+}
+
+// exp, nbf, iat, iss and aud are checked by the jwt library. Only RS256 and ES256 are accepted and
+// the algorithm has to match the one stored with the kid, so "none", HS256 signed with the public
+// key and other algorithm swaps are rejected before the key is used.
+// tokenUse must match, an mfa token is never accepted as an access token
+func ParseToken(tokenString string, tokenUse string, keyProvider keys.KeyProvider, config TokenConfig) (*Claims, error) {
+  return ParseTokenWithPublicKeys(tokenString, tokenUse, keys.ProviderPublicKeys(keyProvider), config)
+}
+
+// for verifiers that only have the public keys, like the authorizer reading our jwks
+func ParseTokenWithPublicKeys(tokenString string, tokenUse string, publicKeys keys.PublicKeys, config TokenConfig) (*Claims, error) {
+  claims := &Claims{}
+
+  token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    if kid == "" {
+      return nil, fmt.Errorf("token has no kid")
+    }
+
+    publicKey, err := publicKeys.PublicKey(kid)
+    if err != nil {
+      return nil, err
+    }
+
+    algorithm, err := keys.Algorithm(publicKey)
+    if err != nil {
+      return nil, err
+    }
+
+    if token.Method.Alg() != algorithm {
+      return nil, fmt.Errorf("unexpected signing method %v for key %s", token.Header["alg"], kid)
+    }
+
+    return publicKey, nil
+  },
+    jwt.WithValidMethods([]string{keys.ALG_RS256, keys.ALG_ES256}),
+    jwt.WithIssuer(config.Issuer),
+    jwt.WithAudience(config.Audience),
+    jwt.WithExpirationRequired(),
+    jwt.WithIssuedAt(),
+  )
+
+  if err != nil {
+    return nil, fmt.Errorf("unauthorized: %w", err)
+  }
+
+  if !token.Valid {
+    return nil, fmt.Errorf("Token is not valid - unauthorized")
+  }
+
+  if claims.Subject == "" {
+    return nil, fmt.Errorf("token has no subject - unauthorized")
+  }
+
+  // revocation checks need both
+  if claims.ID == "" || claims.IssuedAt == nil {
+    return nil, fmt.Errorf("token has no jti or iat - unauthorized")
+  }
+
+  if claims.TokenUse != tokenUse {
+    return nil, fmt.Errorf("token is not an %s token - unauthorized", tokenUse)
+  }
+
+  return claims, nil
+}
@@ -1,21 +1,146 @@
 package types
 
 import (
-  "github.com/golang-jwt/jwt/v5"
-  "golang.org/x/crypto/bcrypt"
   "time"
   "strings"
   "regexp"
+
+  "lambda-func/hasher"
 )
 
 type RegisterUser struct {
   Username string `json:"username"`
   Password string `json:"password"`
+  // required, the account stays pending until the emailed link is used
+  Email string `json:"email"`
 }
 
+// never serialize a User in a response, use Profile or Account. The secrets are hidden from
+// json but still need their dynamodbav names since attributevalue falls back to the json tag
 type User struct {
   Username string `json:"username"`
-  PasswordHash string `json:"password"`
+  PasswordHash string `json:"-" dynamodbav:"password"`
+  Email string `json:"email,omitempty"`
+  Roles []string `json:"roles"`
+  DisplayName string `json:"display_name,omitempty"`
+  Bio string `json:"bio,omitempty"`
+  AvatarURL string `json:"avatar_url,omitempty"`
+  // empty for accounts created before it was recorded
+  CreatedAt string `json:"created_at,omitempty"`
+  // when the password was last set, empty if it never changed since the account was created
+  PasswordChangedAt string `json:"-" dynamodbav:"password_changed_at,omitempty"`
+  // UserStatusPendingVerification until the email address is verified. Accounts from before
+  // verification existed and oidc accounts have none and count as active
+  Status string `json:"-" dynamodbav:"status,omitempty"`
+  // when the last verification email went out, resends are throttled on it
+  VerificationSentAt string `json:"-" dynamodbav:"verification_sent_at,omitempty"`
+  MFAEnabled bool `json:"mfa_enabled"`
+  MFASecret string `json:"-" dynamodbav:"mfa_secret,omitempty"`
+  // set while enrolling, until the first code is verified
+  MFAPendingSecret string `json:"-" dynamodbav:"mfa_pending_secret,omitempty"`
+  // last totp step accepted, a code is never accepted twice
+  MFALastStep int64 `json:"-" dynamodbav:"mfa_last_step,omitempty"`
+  // sha256 hashes of the unused recovery codes
+  RecoveryCodes []string `json:"-" dynamodbav:"recovery_codes,stringset,omitempty"`
+}
+
+// what anyone can see about a user
+type Profile struct {
+  Username string `json:"username"`
+  DisplayName string `json:"display_name"`
+  Bio string `json:"bio"`
+  AvatarURL string `json:"avatar_url"`
+  CreatedAt string `json:"created_at,omitempty"`
+}
+
+// what the user sees about themselves on /me
+type Account struct {
+  Profile
+  Email string `json:"email,omitempty"`
+  Roles []string `json:"roles"`
+  MFAEnabled bool `json:"mfa_enabled"`
+  EmailVerified bool `json:"email_verified"`
+}
+
+// nil fields are left as they are, an empty string clears the field
+type UpdateProfile struct {
+  DisplayName *string `json:"display_name"`
+  Bio *string `json:"bio"`
+  AvatarURL *string `json:"avatar_url"`
+}
+
+func (u User) Profile() Profile {
+  return Profile{
+    Username: u.Username,
+    DisplayName: u.DisplayName,
+    Bio: u.Bio,
+    AvatarURL: u.AvatarURL,
+    CreatedAt: u.CreatedAt,
+  }
+}
+
+func (u User) Account() Account {
+  return Account{
+    Profile: u.Profile(),
+    Email: u.Email,
+    Roles: u.UserRoles(),
+    MFAEnabled: u.MFAEnabled,
+    EmailVerified: u.Email != "" && !u.IsPendingVerification(),
+  }
+}
+
+func (u User) IsPendingVerification() bool {
+  return u.Status == UserStatusPendingVerification
+}
+
+// failed logins for one username or source ip
+type LoginAttempts struct {
+  ID string `json:"id"`
+  FailedCount int `json:"failed_count"`
+  LockedUntil int64 `json:"locked_until"`
+  ExpiresAt int64 `json:"expires_at"`
+}
+
+func (a LoginAttempts) IsLocked() bool {
+  return a.LockedUntil > time.Now().Unix()
+}
+
+// stored in User.Status, no status at all also means active
+const (
+  UserStatusPendingVerification = "pending_verification"
+  UserStatusActive = "active"
+)
+
+// each role includes everything the roles before it can do
+const (
+  RoleReader = "reader"
+  RoleAuthor = "author"
+  RoleEditor = "editor"
+  RoleAdmin = "admin"
+)
+
+var roleRanks = map[string]int{
+  RoleReader: 1,
+  RoleAuthor: 2,
+  RoleEditor: 3,
+  RoleAdmin: 4,
+}
+
+// author of blogs whose account was deleted, the name is reserved so nobody can register it
+const DELETED_USER = "deleted-user"
+
+func IsValidRole(role string) bool {
+  _, ok := roleRanks[role]
+  return ok
+}
+
+// users stored before roles existed have none and are treated as readers
+func (u User) UserRoles() []string {
+  if len(u.Roles) == 0 {
+    return []string{RoleReader}
+  }
+
+  return u.Roles
 }
 
 type Blog struct {
@@ -23,7 +148,23 @@ type Blog struct {
   Title string `json:"title"`
   Description string `json:"description"`
   Content string `json:"content"`
+  Author string `json:"author"`
   CreatedAt string  `json:"created_at"`
+  UpdatedAt string  `json:"updated_at,omitempty"`
+  DeletedAt string  `json:"deleted_at,omitempty"`
+}
+
+// next_cursor is empty on the last page, pass it back as ?cursor= to get the next one
+type BlogPage struct {
+  Items []Blog `json:"items"`
+  NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// fields left nil are not touched, the slug is never changed by an update
+type UpdateBlog struct {
+  Title *string `json:"title"`
+  Description *string `json:"description"`
+  Content *string `json:"content"`
 }
 
 func Slugify(title string) string {
@@ -44,43 +185,68 @@ func Slugify(title string) string {
 	return slug
 }
 
-func NewUser(registerUser RegisterUser) (User, error) {
-  //transforms from string to byes
-  hashedPassword, err := bcrypt.GenerateFromPassword([]byte(registerUser.Password), 10) 
+// the password is hashed with whatever algorithm and parameters the hasher is configured for
+func NewUser(registerUser RegisterUser, passwordHasher hasher.Hasher) (User, error) {
+  hashedPassword, err := passwordHasher.Hash(registerUser.Password)
 
   if err != nil {
     return User{}, err
   }
 
+  now := time.Now().UTC().Format(time.RFC3339)
+
+  // new accounts can only read until an admin grants them more, and can't log in until
+  // the email address is verified. The first verification email goes out with the registration
   return User {
     Username: registerUser.Username,
-    PasswordHash: string(hashedPassword),
+    PasswordHash: hashedPassword,
+    Email: registerUser.Email,
+    Roles: []string{RoleReader},
+    CreatedAt: now,
+    Status: UserStatusPendingVerification,
+    VerificationSentAt: now,
   }, nil
 }
 
-func ValidatePassword(hashedPassword, plainTextPassword string) bool {
-  err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(plainTextPassword))
-
-  return err == nil
+// whoever a request was authenticated as
+type Principal struct {
+  Username string
+  Roles []string
+  TokenID string
+  IssuedAt time.Time
+  ExpiresAt time.Time
+  // set when the request used an api key instead of a jwt, the key is then limited to Scopes
+  APIKeyID string
+  Scopes []string
 }
 
-func CreateToken(user User) string {
-  now := time.Now()
-  validUntil := now.Add(time.Hour * 1).Unix()
+// jwts carry the user's full access, api keys only what they were created with
+func (p Principal) HasScope(scope string) bool {
+  if p.APIKeyID == "" {
+    return true
+  }
 
-  claims := jwt.MapClaims{
-    "user": user.Username,
-    "expires": validUntil,
+  for _, s := range p.Scopes {
+    if s == scope {
+      return true
+    }
   }
 
+  return false
+}
 
-  token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims, nil)
-  secret := "jiahua-zheshiyigemimi-stuff"
+// true when any of the principal's roles is the given role or a higher one
+func (p Principal) HasRole(role string) bool {
+  required, ok := roleRanks[role]
+  if !ok {
+    return false
+  }
 
-  tokenString, err := token.SignedString([]byte(secret))
-  if err != nil {
-    return ""
+  for _, r := range p.Roles {
+    if roleRanks[r] >= required {
+      return true
+    }
   }
 
-  return tokenString
+  return false
 }